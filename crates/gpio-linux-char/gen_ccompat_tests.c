@@ -32,19 +32,50 @@ int gpio_ioctl_ccompat_test() {
     fprintf(fp, "#[test]\n");
     fprintf(fp, "fn test_gpio_ioctl_ccompat() {\n");
     EQ_CHECK(GPIO_GET_CHIPINFO_IOCTL);
+    EQ_CHECK(GPIO_GET_LINEHANDLE_IOCTL);
+    EQ_CHECK(GPIOHANDLE_GET_LINE_VALUES_IOCTL);
+    EQ_CHECK(GPIOHANDLE_SET_LINE_VALUES_IOCTL);
     EQ_CHECK(GPIO_GET_LINEINFO_UNWATCH_IOCTL);
     EQ_CHECK(GPIO_V2_GET_LINEINFO_IOCTL);
-    // EQ_CHECK(GPIO_V2_GET_LINEINFO_WATCH_IOCTL);
-    // EQ_CHECK(GPIO_V2_GET_LINE_IOCTL);
-    // EQ_CHECK(GPIO_V2_LINE_SET_CONFIG_IOCTL);
-    // EQ_CHECK(GPIO_V2_LINE_SET_VALUES_IOCTL);
+    EQ_CHECK(GPIO_V2_GET_LINEINFO_WATCH_IOCTL);
+    EQ_CHECK(GPIO_V2_GET_LINE_IOCTL);
+    EQ_CHECK(GPIO_V2_LINE_SET_CONFIG_IOCTL);
+    EQ_CHECK(GPIO_V2_LINE_GET_VALUES_IOCTL);
+    EQ_CHECK(GPIO_V2_LINE_SET_VALUES_IOCTL);
     EQ_CHECK(GPIO_V2_LINE_ATTR_ID_FLAGS);
     EQ_CHECK(GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES);
     EQ_CHECK(GPIO_V2_LINE_ATTR_ID_DEBOUNCE);
+    EQ_CHECK2(GPIOHANDLES_MAX, GPIOHANDLES_MAX);
+    EQ_CHECK(GPIOHANDLE_REQUEST_INPUT);
+    EQ_CHECK(GPIOHANDLE_REQUEST_OUTPUT);
+    EQ_CHECK(GPIOHANDLE_REQUEST_ACTIVE_LOW);
+    EQ_CHECK(GPIOHANDLE_REQUEST_OPEN_DRAIN);
+    EQ_CHECK(GPIOHANDLE_REQUEST_OPEN_SOURCE);
+    EQ_CHECK(GPIOHANDLE_REQUEST_BIAS_PULL_UP);
+    EQ_CHECK(GPIOHANDLE_REQUEST_BIAS_PULL_DOWN);
+    EQ_CHECK(GPIOHANDLE_REQUEST_BIAS_DISABLE);
+    EQ_CHECK(GPIO_V2_LINE_EVENT_RISING_EDGE);
+    EQ_CHECK(GPIO_V2_LINE_EVENT_FALLING_EDGE);
+    EQ_CHECK(GPIO_V2_LINE_CHANGED_REQUESTED);
+    EQ_CHECK(GPIO_V2_LINE_CHANGED_RELEASED);
+    EQ_CHECK(GPIO_V2_LINE_CHANGED_CONFIG);
     SIZE_CHECK(RawGpioChipInfo, gpiochip_info);
     SIZE_CHECK(RawGpioV2LineAttr, gpio_v2_line_attribute);
     SIZE_CHECK(RawGpioV2LineInfo, gpio_v2_line_info);
-    // SIZE_CHECK(RawGpioV2LineValues, gpio_v2_line_values);
+    SIZE_CHECK(RawGpioV2LineConfigAttr, gpio_v2_line_config_attribute);
+    SIZE_CHECK(RawGpioV2LineConfig, gpio_v2_line_config);
+    SIZE_CHECK(RawGpioV2LineRequest, gpio_v2_line_request);
+    SIZE_CHECK(RawGpioV2LineValues, gpio_v2_line_values);
+    SIZE_CHECK(RawGpioV2LineEvent, gpio_v2_line_event);
+    SIZE_CHECK(RawGpioV2LineInfoChanged, gpio_v2_line_info_changed);
+    SIZE_CHECK(RawGpioHandleRequest, gpiohandle_request);
+    SIZE_CHECK(RawGpioHandleData, gpiohandle_data);
+    OFFSET_CHECK(RawGpioHandleRequest, gpiohandle_request, lineoffsets);
+    OFFSET_CHECK(RawGpioHandleRequest, gpiohandle_request, flags);
+    OFFSET_CHECK(RawGpioHandleRequest, gpiohandle_request, default_values);
+    OFFSET_CHECK(RawGpioHandleRequest, gpiohandle_request, consumer_label);
+    OFFSET_CHECK(RawGpioHandleRequest, gpiohandle_request, lines);
+    OFFSET_CHECK(RawGpioHandleRequest, gpiohandle_request, fd);
     OFFSET_CHECK(RawGpioV2LineAttr, gpio_v2_line_attribute, id);
     OFFSET_CHECK(RawGpioV2LineAttr, gpio_v2_line_attribute, padding);
     OFFSET_CHECK_ANON_UNION(RawGpioV2LineAttr, data, RawGpioV2LineAttrValue, gpio_v2_line_attribute, flags);
@@ -57,6 +88,31 @@ int gpio_ioctl_ccompat_test() {
     OFFSET_CHECK(RawGpioV2LineInfo, gpio_v2_line_info, flags);
     OFFSET_CHECK(RawGpioV2LineInfo, gpio_v2_line_info, attrs);
     OFFSET_CHECK(RawGpioV2LineInfo, gpio_v2_line_info, padding);
+    OFFSET_CHECK(RawGpioV2LineConfigAttr, gpio_v2_line_config_attribute, attr);
+    OFFSET_CHECK(RawGpioV2LineConfigAttr, gpio_v2_line_config_attribute, mask);
+    OFFSET_CHECK(RawGpioV2LineConfig, gpio_v2_line_config, flags);
+    OFFSET_CHECK(RawGpioV2LineConfig, gpio_v2_line_config, num_attrs);
+    OFFSET_CHECK(RawGpioV2LineConfig, gpio_v2_line_config, padding);
+    OFFSET_CHECK(RawGpioV2LineConfig, gpio_v2_line_config, attrs);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, offsets);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, consumer);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, config);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, num_lines);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, event_buffer_size);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, padding);
+    OFFSET_CHECK(RawGpioV2LineRequest, gpio_v2_line_request, fd);
+    OFFSET_CHECK(RawGpioV2LineValues, gpio_v2_line_values, bits);
+    OFFSET_CHECK(RawGpioV2LineValues, gpio_v2_line_values, mask);
+    OFFSET_CHECK(RawGpioV2LineEvent, gpio_v2_line_event, timestamp_ns);
+    OFFSET_CHECK(RawGpioV2LineEvent, gpio_v2_line_event, id);
+    OFFSET_CHECK(RawGpioV2LineEvent, gpio_v2_line_event, offset);
+    OFFSET_CHECK(RawGpioV2LineEvent, gpio_v2_line_event, seqno);
+    OFFSET_CHECK(RawGpioV2LineEvent, gpio_v2_line_event, line_seqno);
+    OFFSET_CHECK(RawGpioV2LineEvent, gpio_v2_line_event, padding);
+    OFFSET_CHECK(RawGpioV2LineInfoChanged, gpio_v2_line_info_changed, info);
+    OFFSET_CHECK(RawGpioV2LineInfoChanged, gpio_v2_line_info_changed, timestamp_ns);
+    OFFSET_CHECK(RawGpioV2LineInfoChanged, gpio_v2_line_info_changed, event_type);
+    OFFSET_CHECK(RawGpioV2LineInfoChanged, gpio_v2_line_info_changed, padding);
     fprintf(fp, "}");
     fclose(fp);    
 }
\ No newline at end of file
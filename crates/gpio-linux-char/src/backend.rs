@@ -0,0 +1,127 @@
+//! The boundary between the driver and the kernel.
+//!
+//! The chip and line request methods issue their ioctls through a [`GpioBackend`], so tests can substitute an
+//! in-memory fake for real hardware. The production backend, [`IoctlBackend`], issues the ioctls directly.
+
+use {
+    crate::gpio_ioctl::{
+        self, RawGpioChipInfo, RawGpioHandleData, RawGpioHandleRequest, RawGpioV2LineConfig, RawGpioV2LineInfo,
+        RawGpioV2LineInfoChanged, RawGpioV2LineRequest, RawGpioV2LineValues,
+    },
+    std::{
+        fmt::Debug,
+        io::{Error as IoError, Result as IoResult},
+        os::fd::RawFd,
+    },
+};
+
+#[cfg(any(test, feature = "fake"))]
+pub(crate) mod fake;
+
+/// Operations on GPIO chips and line requests that would otherwise be ioctls.
+pub(crate) trait GpioBackend: Debug + Send + Sync {
+    /// Get information about the chip open on `chip_fd` (`GPIO_GET_CHIPINFO_IOCTL`).
+    fn get_chip_info(&self, chip_fd: RawFd) -> IoResult<RawGpioChipInfo>;
+
+    /// Get information about the line at `offset` on the chip open on `chip_fd` (`GPIO_V2_GET_LINEINFO_IOCTL`).
+    fn get_line_info(&self, chip_fd: RawFd, offset: u32) -> IoResult<RawGpioV2LineInfo>;
+
+    /// Get information about the line at `offset` on the chip open on `chip_fd` and start watching it for changes
+    /// (`GPIO_V2_GET_LINEINFO_WATCH_IOCTL`).
+    fn watch_line_info(&self, chip_fd: RawFd, offset: u32) -> IoResult<RawGpioV2LineInfo>;
+
+    /// Stop watching the line at `offset` on the chip open on `chip_fd` for changes
+    /// (`GPIO_GET_LINEINFO_UNWATCH_IOCTL`).
+    fn unwatch_line_info(&self, chip_fd: RawFd, offset: u32) -> IoResult<()>;
+
+    /// Read the next change to a watched line from the chip open on `chip_fd`, blocking until one is available.
+    fn read_line_info_changed(&self, chip_fd: RawFd) -> IoResult<RawGpioV2LineInfoChanged>;
+
+    /// Request lines from the chip open on `chip_fd`, returning the line request's file descriptor
+    /// (`GPIO_V2_GET_LINE_IOCTL`).
+    fn get_line(&self, chip_fd: RawFd, request: &mut RawGpioV2LineRequest) -> IoResult<RawFd>;
+
+    /// Reconfigure the lines of the line request open on `line_fd` (`GPIO_V2_LINE_SET_CONFIG_IOCTL`).
+    fn set_config(&self, line_fd: RawFd, config: &mut RawGpioV2LineConfig) -> IoResult<()>;
+
+    /// Read the values of the lines selected by `mask` (`GPIO_V2_LINE_GET_VALUES_IOCTL`).
+    fn get_values(&self, line_fd: RawFd, mask: u64) -> IoResult<RawGpioV2LineValues>;
+
+    /// Set the values of the lines selected by `values.mask` (`GPIO_V2_LINE_SET_VALUES_IOCTL`).
+    fn set_values(&self, line_fd: RawFd, values: &mut RawGpioV2LineValues) -> IoResult<()>;
+
+    /// Request lines from the chip open on `chip_fd` with the v1 uAPI, returning the line handle's file descriptor
+    /// (`GPIO_GET_LINEHANDLE_IOCTL`).
+    fn get_line_handle(&self, chip_fd: RawFd, request: &mut RawGpioHandleRequest) -> IoResult<RawFd>;
+
+    /// Read the values of all lines of a v1 line handle (`GPIOHANDLE_GET_LINE_VALUES_IOCTL`).
+    fn get_handle_values(&self, line_fd: RawFd) -> IoResult<RawGpioHandleData>;
+
+    /// Set the values of all lines of a v1 line handle (`GPIOHANDLE_SET_LINE_VALUES_IOCTL`).
+    fn set_handle_values(&self, line_fd: RawFd, data: &mut RawGpioHandleData) -> IoResult<()>;
+
+    /// Release a line request or handle, closing its file descriptor.
+    fn release(&self, line_fd: RawFd) -> IoResult<()>;
+}
+
+/// The production backend, which issues ioctls to the kernel.
+#[derive(Debug)]
+pub(crate) struct IoctlBackend;
+
+impl GpioBackend for IoctlBackend {
+    fn get_chip_info(&self, chip_fd: RawFd) -> IoResult<RawGpioChipInfo> {
+        RawGpioChipInfo::default().get_chip_info(chip_fd)
+    }
+
+    fn get_line_info(&self, chip_fd: RawFd, offset: u32) -> IoResult<RawGpioV2LineInfo> {
+        RawGpioV2LineInfo::get_line_info(chip_fd, offset)
+    }
+
+    fn watch_line_info(&self, chip_fd: RawFd, offset: u32) -> IoResult<RawGpioV2LineInfo> {
+        RawGpioV2LineInfo::watch_line_info(chip_fd, offset)
+    }
+
+    fn unwatch_line_info(&self, chip_fd: RawFd, offset: u32) -> IoResult<()> {
+        gpio_ioctl::unwatch_line_info(chip_fd, offset)
+    }
+
+    fn read_line_info_changed(&self, chip_fd: RawFd) -> IoResult<RawGpioV2LineInfoChanged> {
+        RawGpioV2LineInfoChanged::read(chip_fd)
+    }
+
+    fn get_line(&self, chip_fd: RawFd, request: &mut RawGpioV2LineRequest) -> IoResult<RawFd> {
+        request.get_line(chip_fd)
+    }
+
+    fn set_config(&self, line_fd: RawFd, config: &mut RawGpioV2LineConfig) -> IoResult<()> {
+        config.set_config(line_fd)
+    }
+
+    fn get_values(&self, line_fd: RawFd, mask: u64) -> IoResult<RawGpioV2LineValues> {
+        RawGpioV2LineValues::get_values(line_fd, mask)
+    }
+
+    fn set_values(&self, line_fd: RawFd, values: &mut RawGpioV2LineValues) -> IoResult<()> {
+        values.set_values(line_fd)
+    }
+
+    fn get_line_handle(&self, chip_fd: RawFd, request: &mut RawGpioHandleRequest) -> IoResult<RawFd> {
+        request.get_line_handle(chip_fd)
+    }
+
+    fn get_handle_values(&self, line_fd: RawFd) -> IoResult<RawGpioHandleData> {
+        RawGpioHandleData::get_values(line_fd)
+    }
+
+    fn set_handle_values(&self, line_fd: RawFd, data: &mut RawGpioHandleData) -> IoResult<()> {
+        data.set_values(line_fd)
+    }
+
+    fn release(&self, line_fd: RawFd) -> IoResult<()> {
+        if unsafe { libc::close(line_fd) } != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(())
+        }
+    }
+}
@@ -0,0 +1,409 @@
+//! An in-memory fake GPIO chip for tests, including those of crates built on this one (see
+//! [`Gpio::fake`][crate::Gpio::fake]).
+
+use {
+    super::GpioBackend,
+    crate::{
+        GpioLineFlag, cstr_to_string,
+        gpio_ioctl::{
+            GPIO_MAX_NAME_SIZE, GPIO_V2_LINE_ATTR_ID_FLAGS, GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES,
+            GPIO_V2_LINE_CHANGED_CONFIG, GPIO_V2_LINE_CHANGED_RELEASED, GPIO_V2_LINE_CHANGED_REQUESTED,
+            GPIOHANDLE_REQUEST_ACTIVE_LOW, GPIOHANDLE_REQUEST_BIAS_DISABLE, GPIOHANDLE_REQUEST_BIAS_PULL_DOWN,
+            GPIOHANDLE_REQUEST_BIAS_PULL_UP, GPIOHANDLE_REQUEST_INPUT, GPIOHANDLE_REQUEST_OPEN_DRAIN,
+            GPIOHANDLE_REQUEST_OPEN_SOURCE, GPIOHANDLE_REQUEST_OUTPUT, RawGpioChipInfo, RawGpioHandleData,
+            RawGpioHandleRequest, RawGpioV2LineConfig, RawGpioV2LineInfo, RawGpioV2LineInfoChanged,
+            RawGpioV2LineRequest, RawGpioV2LineValues,
+        },
+        line_request::{line_mask, string_to_cstr},
+    },
+    std::{
+        collections::{HashMap, HashSet, VecDeque},
+        io::{Error as IoError, Result as IoResult},
+        os::fd::RawFd,
+        sync::Mutex,
+    },
+};
+
+/// A fake GPIO chip whose lines are held in memory.
+///
+/// Line requests are backed by `eventfd`s so that each has a distinct, closeable file descriptor.
+#[derive(Debug)]
+pub(crate) struct FakeChip {
+    label: String,
+    state: Mutex<FakeState>,
+
+    /// Whether to behave like a kernel without the v2 uAPI, rejecting v2 ioctls with `ENOTTY`.
+    v1_only: bool,
+}
+
+#[derive(Debug)]
+struct FakeState {
+    lines: Vec<FakeLine>,
+
+    /// The chip offsets of each open line request, keyed by the request's file descriptor.
+    requests: HashMap<RawFd, Vec<u32>>,
+
+    /// The offsets of the lines being watched for changes.
+    watched: HashSet<u32>,
+
+    /// Changes to watched lines that have not been read yet.
+    changes: VecDeque<FakeChange>,
+
+    /// The errors that watching or unwatching each line fails with, keyed by offset.
+    watch_errors: HashMap<u32, i32>,
+
+    /// The errors that reading each line's information fails with, keyed by offset.
+    info_errors: HashMap<u32, i32>,
+}
+
+impl FakeState {
+    /// Record a change of kind `event_type` to the line at `offset`, if it is watched.
+    fn changed(&mut self, offset: u32, event_type: u32) {
+        if self.watched.contains(&offset) {
+            let line = self.lines[offset as usize].clone();
+            self.changes.push_back(FakeChange {
+                offset,
+                line,
+                event_type,
+            });
+        }
+    }
+}
+
+#[derive(Clone, Debug, Default)]
+struct FakeLine {
+    name: String,
+    consumer: String,
+    flags: u64,
+    value: bool,
+}
+
+impl FakeLine {
+    /// Returns the information about this line, which is at `offset`.
+    fn to_raw(&self, offset: u32) -> RawGpioV2LineInfo {
+        let mut raw = RawGpioV2LineInfo {
+            offset,
+            flags: self.flags,
+            ..Default::default()
+        };
+        string_to_cstr(&self.name, &mut raw.name);
+        string_to_cstr(&self.consumer, &mut raw.consumer);
+        raw
+    }
+}
+
+/// A change to a watched line, holding the line as it was after the change.
+#[derive(Debug)]
+struct FakeChange {
+    offset: u32,
+    line: FakeLine,
+    event_type: u32,
+}
+
+impl FakeChip {
+    /// Create a fake chip with the given label and named lines.
+    pub(crate) fn new(label: &str, line_names: &[&str]) -> Self {
+        Self {
+            label: label.to_string(),
+            state: Mutex::new(FakeState {
+                lines: line_names
+                    .iter()
+                    .map(|name| FakeLine {
+                        name: name.to_string(),
+                        ..Default::default()
+                    })
+                    .collect(),
+                requests: HashMap::new(),
+                watched: HashSet::new(),
+                changes: VecDeque::new(),
+                watch_errors: HashMap::new(),
+                info_errors: HashMap::new(),
+            }),
+            v1_only: false,
+        }
+    }
+
+    /// Make the chip behave like one on a kernel without the v2 uAPI.
+    #[cfg(test)]
+    pub(crate) fn v1_only(mut self) -> Self {
+        self.v1_only = true;
+        self
+    }
+
+    /// Make watching or unwatching the line at `offset` fail with the OS error `errno`.
+    #[cfg(test)]
+    pub(crate) fn fail_watch(&self, offset: u32, errno: i32) {
+        self.state.lock().unwrap().watch_errors.insert(offset, errno);
+    }
+
+    /// Make reading the information of the line at `offset` fail with the OS error `errno`.
+    #[cfg(test)]
+    pub(crate) fn fail_line_info(&self, offset: u32, errno: i32) {
+        self.state.lock().unwrap().info_errors.insert(offset, errno);
+    }
+
+    /// Returns whether the line at `offset` is being watched for changes.
+    #[cfg(test)]
+    pub(crate) fn is_watched(&self, offset: u32) -> bool {
+        self.state.lock().unwrap().watched.contains(&offset)
+    }
+
+    /// Fail with `ENOTTY`, as the kernel does for unknown ioctls, if the chip is v1-only.
+    fn check_v2(&self) -> IoResult<()> {
+        if self.v1_only {
+            Err(IoError::from_raw_os_error(libc::ENOTTY))
+        } else {
+            Ok(())
+        }
+    }
+
+    /// Claim the lines at `offsets` for `consumer`, returning a new file descriptor for the request.
+    /// `line_state` gives the flags and initial value of the line at each index.
+    fn claim(&self, offsets: Vec<u32>, consumer: String, line_state: impl Fn(usize) -> (u64, bool)) -> IoResult<RawFd> {
+        let mut state = self.state.lock().unwrap();
+        for &offset in &offsets {
+            match state.lines.get(offset as usize) {
+                None => return Err(IoError::from_raw_os_error(libc::EINVAL)),
+                Some(line) if line.flags & GpioLineFlag::Used as u64 != 0 => {
+                    return Err(IoError::from_raw_os_error(libc::EBUSY));
+                }
+                Some(_) => (),
+            }
+        }
+
+        let fd = unsafe { libc::eventfd(0, libc::EFD_CLOEXEC) };
+        if fd < 0 {
+            return Err(IoError::last_os_error());
+        }
+
+        for (i, &offset) in offsets.iter().enumerate() {
+            let (flags, value) = line_state(i);
+            let line = &mut state.lines[offset as usize];
+            line.consumer = consumer.clone();
+            line.flags = flags | GpioLineFlag::Used as u64;
+            line.value = value;
+            state.changed(offset, GPIO_V2_LINE_CHANGED_REQUESTED);
+        }
+
+        state.requests.insert(fd, offsets);
+        Ok(fd)
+    }
+
+    /// Returns the offsets held by the line request open on `line_fd`.
+    fn request_offsets(state: &FakeState, line_fd: RawFd) -> IoResult<Vec<u32>> {
+        state.requests.get(&line_fd).cloned().ok_or_else(|| IoError::from_raw_os_error(libc::EBADF))
+    }
+}
+
+/// Returns a [`Gpio`][crate::Gpio] for a fake chip with five lines, named `GPIO0` to `GPIO3` and `LED`.
+#[cfg(test)]
+pub(crate) fn fake_gpio() -> crate::Gpio {
+    crate::Gpio::fake("fake", &["GPIO0", "GPIO1", "GPIO2", "GPIO3", "LED"])
+}
+
+impl GpioBackend for FakeChip {
+    fn get_chip_info(&self, _chip_fd: RawFd) -> IoResult<RawGpioChipInfo> {
+        let state = self.state.lock().unwrap();
+        let mut raw = RawGpioChipInfo {
+            lines: state.lines.len() as u32,
+            ..Default::default()
+        };
+        string_to_cstr("gpiochip-fake", &mut raw.name);
+        string_to_cstr(&self.label, &mut raw.label);
+        Ok(raw)
+    }
+
+    fn get_line_info(&self, _chip_fd: RawFd, offset: u32) -> IoResult<RawGpioV2LineInfo> {
+        self.check_v2()?;
+        let state = self.state.lock().unwrap();
+        let line = state.lines.get(offset as usize).ok_or_else(|| IoError::from_raw_os_error(libc::EINVAL))?;
+        if let Some(&errno) = state.info_errors.get(&offset) {
+            return Err(IoError::from_raw_os_error(errno));
+        }
+
+        Ok(line.to_raw(offset))
+    }
+
+    fn watch_line_info(&self, _chip_fd: RawFd, offset: u32) -> IoResult<RawGpioV2LineInfo> {
+        self.check_v2()?;
+        let mut state = self.state.lock().unwrap();
+        if offset as usize >= state.lines.len() {
+            return Err(IoError::from_raw_os_error(libc::EINVAL));
+        }
+
+        if let Some(&errno) = state.watch_errors.get(&offset) {
+            return Err(IoError::from_raw_os_error(errno));
+        }
+
+        if !state.watched.insert(offset) {
+            return Err(IoError::from_raw_os_error(libc::EBUSY));
+        }
+
+        Ok(state.lines[offset as usize].to_raw(offset))
+    }
+
+    fn unwatch_line_info(&self, _chip_fd: RawFd, offset: u32) -> IoResult<()> {
+        let mut state = self.state.lock().unwrap();
+        if offset as usize >= state.lines.len() {
+            return Err(IoError::from_raw_os_error(libc::EINVAL));
+        }
+
+        if let Some(&errno) = state.watch_errors.get(&offset) {
+            return Err(IoError::from_raw_os_error(errno));
+        }
+
+        if !state.watched.remove(&offset) {
+            return Err(IoError::from_raw_os_error(libc::EBUSY));
+        }
+
+        Ok(())
+    }
+
+    /// Unlike the kernel, this does not block: if no change is pending, it fails with `EAGAIN`.
+    fn read_line_info_changed(&self, _chip_fd: RawFd) -> IoResult<RawGpioV2LineInfoChanged> {
+        let change = self.state.lock().unwrap().changes.pop_front();
+        let change = change.ok_or_else(|| IoError::from_raw_os_error(libc::EAGAIN))?;
+        Ok(RawGpioV2LineInfoChanged {
+            info: change.line.to_raw(change.offset),
+            event_type: change.event_type,
+            ..Default::default()
+        })
+    }
+
+    fn get_line(&self, _chip_fd: RawFd, request: &mut RawGpioV2LineRequest) -> IoResult<RawFd> {
+        self.check_v2()?;
+        let offsets = request.offsets[..request.num_lines as usize].to_vec();
+        let consumer = cstr_to_string(&request.consumer[..GPIO_MAX_NAME_SIZE]);
+        let config = &request.config;
+        self.claim(offsets, consumer, |i| (line_flags(config, i), output_value(config, i).unwrap_or(false)))
+    }
+
+    fn set_config(&self, line_fd: RawFd, config: &mut RawGpioV2LineConfig) -> IoResult<()> {
+        self.check_v2()?;
+        let mut state = self.state.lock().unwrap();
+        let offsets = Self::request_offsets(&state, line_fd)?;
+        for (i, &offset) in offsets.iter().enumerate() {
+            let line = &mut state.lines[offset as usize];
+            line.flags = line_flags(config, i) | GpioLineFlag::Used as u64;
+            if let Some(value) = output_value(config, i) {
+                line.value = value;
+            }
+            state.changed(offset, GPIO_V2_LINE_CHANGED_CONFIG);
+        }
+        Ok(())
+    }
+
+    fn get_values(&self, line_fd: RawFd, mask: u64) -> IoResult<RawGpioV2LineValues> {
+        self.check_v2()?;
+        let state = self.state.lock().unwrap();
+        let offsets = Self::request_offsets(&state, line_fd)?;
+        if mask & !line_mask(offsets.len()) != 0 {
+            return Err(IoError::from_raw_os_error(libc::EINVAL));
+        }
+
+        let mut bits = 0;
+        for (i, &offset) in offsets.iter().enumerate() {
+            if mask & (1 << i) != 0 && state.lines[offset as usize].value {
+                bits |= 1 << i;
+            }
+        }
+
+        Ok(RawGpioV2LineValues {
+            bits,
+            mask,
+        })
+    }
+
+    fn set_values(&self, line_fd: RawFd, values: &mut RawGpioV2LineValues) -> IoResult<()> {
+        self.check_v2()?;
+        let mut state = self.state.lock().unwrap();
+        let offsets = Self::request_offsets(&state, line_fd)?;
+        if values.mask & !line_mask(offsets.len()) != 0 {
+            return Err(IoError::from_raw_os_error(libc::EINVAL));
+        }
+
+        for (i, &offset) in offsets.iter().enumerate() {
+            if values.mask & (1 << i) != 0 {
+                state.lines[offset as usize].value = values.bits & (1 << i) != 0;
+            }
+        }
+        Ok(())
+    }
+
+    fn get_line_handle(&self, _chip_fd: RawFd, request: &mut RawGpioHandleRequest) -> IoResult<RawFd> {
+        let offsets = request.lineoffsets[..request.lines as usize].to_vec();
+        let consumer = cstr_to_string(&request.consumer_label);
+        let flags = v1_to_v2_flags(request.flags);
+        self.claim(offsets, consumer, |i| (flags, request.default_values[i] != 0))
+    }
+
+    fn get_handle_values(&self, line_fd: RawFd) -> IoResult<RawGpioHandleData> {
+        let state = self.state.lock().unwrap();
+        let offsets = Self::request_offsets(&state, line_fd)?;
+        let mut data = RawGpioHandleData::default();
+        for (i, &offset) in offsets.iter().enumerate() {
+            data.values[i] = state.lines[offset as usize].value as u8;
+        }
+        Ok(data)
+    }
+
+    fn set_handle_values(&self, line_fd: RawFd, data: &mut RawGpioHandleData) -> IoResult<()> {
+        let mut state = self.state.lock().unwrap();
+        let offsets = Self::request_offsets(&state, line_fd)?;
+        for (i, &offset) in offsets.iter().enumerate() {
+            state.lines[offset as usize].value = data.values[i] != 0;
+        }
+        Ok(())
+    }
+
+    fn release(&self, line_fd: RawFd) -> IoResult<()> {
+        let mut state = self.state.lock().unwrap();
+        if let Some(offsets) = state.requests.remove(&line_fd) {
+            for offset in offsets {
+                let line = &mut state.lines[offset as usize];
+                line.consumer.clear();
+                line.flags = 0;
+                state.changed(offset, GPIO_V2_LINE_CHANGED_RELEASED);
+            }
+        }
+
+        if unsafe { libc::close(line_fd) } != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(())
+        }
+    }
+}
+
+/// Returns the flags of the line at `index` under `config`, from its flags attribute if it has one.
+fn line_flags(config: &RawGpioV2LineConfig, index: usize) -> u64 {
+    config.attrs[..config.num_attrs as usize]
+        .iter()
+        .find(|attr| attr.attr.id == GPIO_V2_LINE_ATTR_ID_FLAGS && attr.mask & (1 << index) != 0)
+        .map_or(config.flags, |attr| unsafe { attr.attr.data.flags })
+}
+
+/// Returns the output value set for the line at `index` by the output values attribute of `config`, if any.
+fn output_value(config: &RawGpioV2LineConfig, index: usize) -> Option<bool> {
+    config.attrs[..config.num_attrs as usize]
+        .iter()
+        .find(|attr| attr.attr.id == GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES && attr.mask & (1 << index) != 0)
+        .map(|attr| unsafe { attr.attr.data.values } & (1 << index) != 0)
+}
+
+/// Convert v1 line handle request flags to the equivalent v2 line flags.
+fn v1_to_v2_flags(flags: u32) -> u64 {
+    [
+        (GPIOHANDLE_REQUEST_INPUT, GpioLineFlag::Input),
+        (GPIOHANDLE_REQUEST_OUTPUT, GpioLineFlag::Output),
+        (GPIOHANDLE_REQUEST_ACTIVE_LOW, GpioLineFlag::ActiveLow),
+        (GPIOHANDLE_REQUEST_OPEN_DRAIN, GpioLineFlag::OpenDrain),
+        (GPIOHANDLE_REQUEST_OPEN_SOURCE, GpioLineFlag::OpenSource),
+        (GPIOHANDLE_REQUEST_BIAS_PULL_UP, GpioLineFlag::BiasPullUp),
+        (GPIOHANDLE_REQUEST_BIAS_PULL_DOWN, GpioLineFlag::BiasPullDown),
+        (GPIOHANDLE_REQUEST_BIAS_DISABLE, GpioLineFlag::BiasDisabled),
+    ]
+    .into_iter()
+    .filter(|&(v1, _)| flags & v1 != 0)
+    .fold(0, |acc, (_, v2)| acc | v2 as u64)
+}
@@ -0,0 +1,188 @@
+//! Cancellation of blocking operations.
+
+use {
+    crate::GpioError,
+    std::{
+        io::{Error as IoError, Result as IoResult},
+        os::fd::RawFd,
+        sync::{
+            Arc,
+            atomic::{AtomicBool, Ordering},
+        },
+        time::{Duration, Instant},
+    },
+};
+
+/// A token used to cancel blocking waits from another thread.
+///
+/// Clones of a token share the same state: cancelling any clone cancels all of them. Once cancelled, a token stays
+/// cancelled. The token is backed by an `eventfd`, which is closed when the last clone is dropped.
+#[derive(Clone, Debug)]
+pub struct CancelToken {
+    inner: Arc<CancelTokenInner>,
+}
+
+#[derive(Debug)]
+struct CancelTokenInner {
+    cancelled: AtomicBool,
+    fd: RawFd,
+}
+
+impl CancelToken {
+    /// Create a new, uncancelled token.
+    ///
+    /// # Errors
+    /// If the underlying `eventfd` cannot be created, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn new() -> IoResult<Self> {
+        let fd = unsafe { libc::eventfd(0, libc::EFD_CLOEXEC | libc::EFD_NONBLOCK) };
+        if fd < 0 {
+            return Err(IoError::last_os_error());
+        }
+
+        Ok(Self {
+            inner: Arc::new(CancelTokenInner {
+                cancelled: AtomicBool::new(false),
+                fd,
+            }),
+        })
+    }
+
+    /// Cancel this token, waking up any operations waiting on it.
+    pub fn cancel(&self) {
+        if !self.inner.cancelled.swap(true, Ordering::SeqCst) {
+            let value: u64 = 1;
+            unsafe {
+                libc::write(self.inner.fd, &value as *const _ as *const libc::c_void, size_of::<u64>());
+            }
+        }
+    }
+
+    /// Indicates whether this token has been cancelled.
+    pub fn is_cancelled(&self) -> bool {
+        self.inner.cancelled.load(Ordering::SeqCst)
+    }
+
+    /// Sleep for `timeout`, waking up early if this token is cancelled.
+    ///
+    /// Returns `true` if the token has been cancelled, `false` if the timeout elapsed.
+    pub fn wait_timeout(&self, timeout: Duration) -> bool {
+        let deadline = Instant::now() + timeout;
+
+        while !self.is_cancelled() {
+            let remaining = deadline.saturating_duration_since(Instant::now());
+            if remaining.is_zero() {
+                return false;
+            }
+
+            let mut pfd = libc::pollfd {
+                fd: self.inner.fd,
+                events: libc::POLLIN,
+                revents: 0,
+            };
+            let ts = libc::timespec {
+                tv_sec: remaining.as_secs() as libc::time_t,
+                tv_nsec: remaining.subsec_nanos() as libc::c_long,
+            };
+
+            // EINTR and spurious wakeups are handled by re-checking the state and the remaining time.
+            unsafe {
+                libc::ppoll(&mut pfd, 1, &ts, std::ptr::null());
+            }
+        }
+
+        true
+    }
+
+    /// Returns an error if this token has been cancelled.
+    pub(crate) fn check(&self) -> IoResult<()> {
+        if self.is_cancelled() {
+            Err(IoError::other(GpioError::Cancelled))
+        } else {
+            Ok(())
+        }
+    }
+}
+
+impl Drop for CancelTokenInner {
+    fn drop(&mut self) {
+        unsafe {
+            libc::close(self.fd);
+        }
+    }
+}
+
+/// Wait until `fd` is readable or `cancel` is cancelled.
+///
+/// The `eventfd` behind the token is never drained, so once cancelled it remains readable and every subsequent wait
+/// returns immediately.
+pub(crate) fn wait_readable(fd: RawFd, cancel: &CancelToken) -> IoResult<()> {
+    cancel.check()?;
+
+    let mut fds = [
+        libc::pollfd {
+            fd,
+            events: libc::POLLIN,
+            revents: 0,
+        },
+        libc::pollfd {
+            fd: cancel.inner.fd,
+            events: libc::POLLIN,
+            revents: 0,
+        },
+    ];
+
+    loop {
+        let ret = unsafe { libc::poll(fds.as_mut_ptr(), fds.len() as libc::nfds_t, -1) };
+        if ret < 0 {
+            let e = IoError::last_os_error();
+            if e.kind() == std::io::ErrorKind::Interrupted {
+                continue;
+            }
+            return Err(e);
+        }
+
+        // Check cancellation first so a pending event is left for the next reader.
+        cancel.check()?;
+
+        if fds[0].revents != 0 {
+            return Ok(());
+        }
+    }
+}
+
+/// Wait up to `timeout` for `fd` to become readable, returning `false` if it did not.
+///
+/// A zero timeout polls once without blocking.
+pub(crate) fn poll_readable(fd: RawFd, timeout: Duration) -> IoResult<bool> {
+    let deadline = Instant::now() + timeout;
+    let mut pfd = libc::pollfd {
+        fd,
+        events: libc::POLLIN,
+        revents: 0,
+    };
+
+    loop {
+        let remaining = deadline.saturating_duration_since(Instant::now());
+        let ts = libc::timespec {
+            tv_sec: remaining.as_secs() as libc::time_t,
+            tv_nsec: remaining.subsec_nanos() as libc::c_long,
+        };
+
+        let ret = unsafe { libc::ppoll(&mut pfd, 1, &ts, std::ptr::null()) };
+        if ret < 0 {
+            let e = IoError::last_os_error();
+            if e.kind() == std::io::ErrorKind::Interrupted {
+                continue;
+            }
+            return Err(e);
+        }
+
+        if ret > 0 {
+            return Ok(true);
+        }
+
+        if remaining.is_zero() || Instant::now() >= deadline {
+            return Ok(false);
+        }
+    }
+}
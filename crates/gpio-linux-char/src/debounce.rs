@@ -0,0 +1,194 @@
+//! Debouncing edge events in software.
+
+use {
+    crate::{CancelToken, GpioError, GpioLineEvent, GpioLineRequest, line_request::DropTracker},
+    std::{
+        collections::HashMap,
+        io::{Error as IoError, Result as IoResult},
+        sync::mpsc::{Receiver, RecvTimeoutError, SyncSender, sync_channel},
+        thread::Builder,
+        time::{Duration, Instant},
+    },
+};
+
+impl GpioLineRequest {
+    /// Stream edge events on the requested lines, debounced in software.
+    ///
+    /// This is for chips without hardware debounce (see
+    /// [`GpioLineConfig::with_debounce`][crate::GpioLineConfig::with_debounce]), such as the Raspberry Pi's. Events
+    /// are read as with [`events`][Self::events]; each edge on a line restarts a `window` timer for that line, and
+    /// only the last event of a burst is delivered, once the line has been quiet for `window`. Delivered events are
+    /// therefore delayed by `window`, and their sequence numbers skip the events that were coalesced.
+    ///
+    /// Events dropped by the kernel are detected from sequence numbers before coalescing, and reported as an
+    /// [`IoError`][std::io::Error] with a kind of [`Other`][std::io::ErrorKind::Other] wrapping a
+    /// [`GpioError::EventsDropped`]; unlike other errors, this does not end the stream. Errors reading events are
+    /// delivered as the final item, after any pending events.
+    ///
+    /// # Errors
+    /// If the file descriptor cannot be duplicated or the threads cannot be spawned, the underlying
+    /// [`IoError`][std::io::Error] is returned.
+    pub fn debounced_events(
+        &self,
+        cancel: &CancelToken,
+        buffer: usize,
+        window: Duration,
+    ) -> IoResult<Receiver<IoResult<GpioLineEvent>>> {
+        let events = self.events(cancel, buffer)?;
+        let (sender, receiver) = sync_channel(buffer);
+        Builder::new().name("gpio-debounce".to_string()).spawn(move || debounce_loop(&events, &sender, window))?;
+        Ok(receiver)
+    }
+}
+
+/// Debounce events from `events` onto `sender` until either channel is closed.
+fn debounce_loop(
+    events: &Receiver<IoResult<GpioLineEvent>>,
+    sender: &SyncSender<IoResult<GpioLineEvent>>,
+    window: Duration,
+) {
+    let mut debouncer = Debouncer::new(window);
+    let mut tracker = DropTracker::default();
+    loop {
+        let received = match debouncer.next_deadline() {
+            Some(deadline) => events.recv_timeout(deadline.saturating_duration_since(Instant::now())),
+            None => events.recv().map_err(|_| RecvTimeoutError::Disconnected),
+        };
+
+        match received {
+            Ok(Ok(event)) => {
+                if let Some(missed) = tracker.check(&event) {
+                    if sender.send(Err(IoError::other(GpioError::EventsDropped(missed)))).is_err() {
+                        return;
+                    }
+                }
+                debouncer.push(event, Instant::now());
+            }
+            Ok(Err(e)) => {
+                if send_all(sender, debouncer.settled(None)) {
+                    let _ = sender.send(Err(e));
+                }
+                return;
+            }
+            Err(RecvTimeoutError::Timeout) => (),
+            Err(RecvTimeoutError::Disconnected) => {
+                send_all(sender, debouncer.settled(None));
+                return;
+            }
+        }
+
+        if !send_all(sender, debouncer.settled(Some(Instant::now()))) {
+            return;
+        }
+    }
+}
+
+/// Send `events` in order, returning false if the receiver has been dropped.
+fn send_all(sender: &SyncSender<IoResult<GpioLineEvent>>, events: Vec<GpioLineEvent>) -> bool {
+    events.into_iter().all(|event| sender.send(Ok(event)).is_ok())
+}
+
+/// Coalesces bursts of events on each line, keeping the last event of each burst.
+#[derive(Debug)]
+struct Debouncer {
+    window: Duration,
+
+    /// The latest event on each line with a burst in progress and the time it settles, keyed by chip offset.
+    pending: HashMap<usize, (GpioLineEvent, Instant)>,
+}
+
+impl Debouncer {
+    fn new(window: Duration) -> Self {
+        Self {
+            window,
+            pending: HashMap::new(),
+        }
+    }
+
+    /// Record `event`, received at `now`, replacing any pending event on its line and restarting its window.
+    fn push(&mut self, event: GpioLineEvent, now: Instant) {
+        self.pending.insert(event.offset, (event, now + self.window));
+    }
+
+    /// Returns the earliest time a pending event settles, if any are pending.
+    fn next_deadline(&self) -> Option<Instant> {
+        self.pending.values().map(|&(_, deadline)| deadline).min()
+    }
+
+    /// Remove and return the events that have settled by `now` (or all pending events if `now` is `None`), in the
+    /// order they occurred.
+    fn settled(&mut self, now: Option<Instant>) -> Vec<GpioLineEvent> {
+        let mut settled = Vec::new();
+        self.pending.retain(|_, &mut (event, deadline)| {
+            if now.map_or(true, |now| deadline <= now) {
+                settled.push(event);
+                false
+            } else {
+                true
+            }
+        });
+        settled.sort_by_key(|event| event.seqno);
+        settled
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        crate::{GpioEventClock, GpioLineEventKind, GpioTimeConversion},
+        pretty_assertions::assert_eq,
+        std::time::UNIX_EPOCH,
+    };
+
+    fn event(offset: usize, seqno: u32, kind: GpioLineEventKind) -> GpioLineEvent {
+        GpioLineEvent {
+            timestamp: Duration::ZERO,
+            clock: GpioEventClock::Monotonic,
+            kind,
+            offset,
+            seqno,
+            line_seqno: seqno,
+            time: UNIX_EPOCH,
+            time_conversion: GpioTimeConversion::MonotonicOffset,
+        }
+    }
+
+    fn seqnos(events: &[GpioLineEvent]) -> Vec<u32> {
+        events.iter().map(|event| event.seqno).collect()
+    }
+
+    #[test]
+    fn test_debouncer() {
+        let window = Duration::from_millis(10);
+        let start = Instant::now();
+        let at = |ms| start + Duration::from_millis(ms);
+        let mut debouncer = Debouncer::new(window);
+
+        // A burst on line 4 settles 10 ms after its last edge; line 5 settles independently.
+        debouncer.push(event(4, 1, GpioLineEventKind::RisingEdge), at(0));
+        debouncer.push(event(4, 2, GpioLineEventKind::FallingEdge), at(3));
+        debouncer.push(event(5, 3, GpioLineEventKind::RisingEdge), at(5));
+        debouncer.push(event(4, 4, GpioLineEventKind::RisingEdge), at(8));
+        assert_eq!(debouncer.next_deadline(), Some(at(15)));
+        assert!(debouncer.settled(Some(at(14))).is_empty());
+
+        let settled = debouncer.settled(Some(at(15)));
+        assert_eq!(seqnos(&settled), [3]);
+        assert_eq!(debouncer.next_deadline(), Some(at(18)));
+
+        let settled = debouncer.settled(Some(at(18)));
+        assert_eq!(seqnos(&settled), [4]);
+        assert_eq!(settled[0].kind, GpioLineEventKind::RisingEdge);
+        assert_eq!(debouncer.next_deadline(), None);
+    }
+
+    #[test]
+    fn test_debouncer_flush() {
+        let mut debouncer = Debouncer::new(Duration::from_secs(1));
+        let now = Instant::now();
+        debouncer.push(event(5, 7, GpioLineEventKind::RisingEdge), now);
+        debouncer.push(event(4, 6, GpioLineEventKind::FallingEdge), now);
+        assert_eq!(seqnos(&debouncer.settled(None)), [6, 7]);
+    }
+}
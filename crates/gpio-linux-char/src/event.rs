@@ -0,0 +1,286 @@
+//! Events reported by the kernel: edge events on requested lines and changes to watched lines.
+
+use {
+    crate::{GpioError, GpioLineInfo, gpio_ioctl},
+    std::{
+        fmt::{Display, Formatter, Result as FmtResult},
+        io::{Error as IoError, ErrorKind, Result as IoResult},
+        time::{Duration, SystemTime, UNIX_EPOCH},
+    },
+};
+
+/// The kind of edge that triggered a line event.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum GpioLineEventKind {
+    /// The line transitioned from inactive to active.
+    RisingEdge,
+
+    /// The line transitioned from active to inactive.
+    FallingEdge,
+}
+
+impl Display for GpioLineEventKind {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::RisingEdge => f.write_str("RisingEdge"),
+            Self::FallingEdge => f.write_str("FallingEdge"),
+        }
+    }
+}
+
+/// The clock used to timestamp edge events.
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
+pub enum GpioEventClock {
+    /// `CLOCK_MONOTONIC`, the kernel default. Timestamps are suitable for measuring the time between events but are
+    /// not wall-clock times.
+    #[default]
+    Monotonic,
+
+    /// `CLOCK_REALTIME`. Timestamps are wall-clock times since the Unix epoch.
+    Realtime,
+
+    /// The hardware timestamp engine, if the GPIO chip has one.
+    Hte,
+}
+
+impl Display for GpioEventClock {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::Monotonic => f.write_str("Monotonic"),
+            Self::Realtime => f.write_str("Realtime"),
+            Self::Hte => f.write_str("Hte"),
+        }
+    }
+}
+
+/// How the wall-clock time of an edge event was derived from its kernel timestamp.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum GpioTimeConversion {
+    /// The timestamp was read from `CLOCK_REALTIME` and is used as is.
+    Realtime,
+
+    /// The timestamp was read from `CLOCK_MONOTONIC` (or the hardware timestamp engine) and was converted by
+    /// applying the offset between `CLOCK_MONOTONIC` and the wall clock sampled when the event was decoded.
+    ///
+    /// The result is accurate to within the time between sampling the two clocks, but does not account for wall
+    /// clock adjustments made between the event and its decoding. Hardware timestamp engine timestamps are assumed
+    /// to share the `CLOCK_MONOTONIC` timebase, as they do on the Tegra provider.
+    MonotonicOffset,
+}
+
+impl Display for GpioTimeConversion {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::Realtime => f.write_str("Realtime"),
+            Self::MonotonicOffset => f.write_str("MonotonicOffset"),
+        }
+    }
+}
+
+/// An edge event detected on a requested line.
+#[derive(Clone, Copy, Debug)]
+pub struct GpioLineEvent {
+    /// The time the event occurred, as reported by the kernel. How to interpret this depends on `clock`.
+    pub timestamp: Duration,
+
+    /// The clock `timestamp` was read from.
+    pub clock: GpioEventClock,
+
+    /// The kind of edge detected.
+    pub kind: GpioLineEventKind,
+
+    /// The chip offset of the line that triggered the event.
+    pub offset: usize,
+
+    /// The sequence number of this event among all events on the line request.
+    pub seqno: u32,
+
+    /// The sequence number of this event among events on this line.
+    pub line_seqno: u32,
+
+    /// The wall-clock time the event occurred, derived from `timestamp` as described by `time_conversion`.
+    pub time: SystemTime,
+
+    /// How `time` was derived from `timestamp`.
+    pub time_conversion: GpioTimeConversion,
+}
+
+impl GpioLineEvent {
+    /// Decode a raw event from a line request configured to use `clock`.
+    pub(crate) fn from_raw(raw: gpio_ioctl::RawGpioV2LineEvent, clock: GpioEventClock) -> IoResult<Self> {
+        let kind = match raw.id {
+            gpio_ioctl::GPIO_V2_LINE_EVENT_RISING_EDGE => GpioLineEventKind::RisingEdge,
+            gpio_ioctl::GPIO_V2_LINE_EVENT_FALLING_EDGE => GpioLineEventKind::FallingEdge,
+            id => return Err(IoError::new(ErrorKind::InvalidData, GpioError::UnknownEventId(id))),
+        };
+
+        let timestamp = Duration::from_nanos(raw.timestamp_ns);
+        let (time, time_conversion) = match clock {
+            GpioEventClock::Realtime => (UNIX_EPOCH + timestamp, GpioTimeConversion::Realtime),
+            GpioEventClock::Monotonic | GpioEventClock::Hte => {
+                (monotonic_to_wall(timestamp), GpioTimeConversion::MonotonicOffset)
+            }
+        };
+
+        Ok(Self {
+            timestamp,
+            clock,
+            kind,
+            offset: raw.offset as usize,
+            seqno: raw.seqno,
+            line_seqno: raw.line_seqno,
+            time,
+            time_conversion,
+        })
+    }
+}
+
+/// Formats the event as `offset=17 kind=RisingEdge timestamp=12.000345678 clock=Monotonic seqno=3 line_seqno=1`.
+///
+/// The timestamp is in seconds with nanosecond precision, as reported by the kernel on `clock`.
+impl Display for GpioLineEvent {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        write!(
+            f,
+            "offset={} kind={} timestamp={}.{:09} clock={} seqno={} line_seqno={}",
+            self.offset,
+            self.kind,
+            self.timestamp.as_secs(),
+            self.timestamp.subsec_nanos(),
+            self.clock,
+            self.seqno,
+            self.line_seqno
+        )
+    }
+}
+
+/// Convert a `CLOCK_MONOTONIC` timestamp to wall-clock time using the current offset between the two clocks.
+fn monotonic_to_wall(timestamp: Duration) -> SystemTime {
+    let mut now = libc::timespec {
+        tv_sec: 0,
+        tv_nsec: 0,
+    };
+    unsafe {
+        libc::clock_gettime(libc::CLOCK_MONOTONIC, &mut now);
+    }
+    let wall_now = SystemTime::now();
+    let monotonic_now = Duration::new(now.tv_sec as u64, now.tv_nsec as u32);
+
+    if timestamp <= monotonic_now {
+        wall_now - (monotonic_now - timestamp)
+    } else {
+        wall_now + (timestamp - monotonic_now)
+    }
+}
+
+/// The kind of change reported for a watched line.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum GpioLineChangeKind {
+    /// The line was requested.
+    Requested,
+
+    /// The line was released.
+    Released,
+
+    /// The line was reconfigured.
+    Config,
+}
+
+impl Display for GpioLineChangeKind {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::Requested => f.write_str("Requested"),
+            Self::Released => f.write_str("Released"),
+            Self::Config => f.write_str("Config"),
+        }
+    }
+}
+
+/// A change in the status of a watched line.
+#[derive(Clone, Debug)]
+pub struct GpioLineInfoChanged {
+    /// The updated line information.
+    pub info: GpioLineInfo,
+
+    /// The time the change occurred, as reported by the kernel (`CLOCK_MONOTONIC`).
+    pub timestamp: Duration,
+
+    /// The kind of change.
+    pub kind: GpioLineChangeKind,
+}
+
+/// Formats the change as `kind=Requested offset=4 name="LED" timestamp=12.000345678`.
+///
+/// The name is quoted and escaped so embedded special characters are visible, and the timestamp is in seconds of
+/// `CLOCK_MONOTONIC` with nanosecond precision.
+impl Display for GpioLineInfoChanged {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        write!(
+            f,
+            "kind={} offset={} name={:?} timestamp={}.{:09}",
+            self.kind,
+            self.info.offset,
+            self.info.name,
+            self.timestamp.as_secs(),
+            self.timestamp.subsec_nanos()
+        )
+    }
+}
+
+impl TryFrom<gpio_ioctl::RawGpioV2LineInfoChanged> for GpioLineInfoChanged {
+    type Error = IoError;
+
+    fn try_from(raw: gpio_ioctl::RawGpioV2LineInfoChanged) -> IoResult<Self> {
+        let kind = match raw.event_type {
+            gpio_ioctl::GPIO_V2_LINE_CHANGED_REQUESTED => GpioLineChangeKind::Requested,
+            gpio_ioctl::GPIO_V2_LINE_CHANGED_RELEASED => GpioLineChangeKind::Released,
+            gpio_ioctl::GPIO_V2_LINE_CHANGED_CONFIG => GpioLineChangeKind::Config,
+            id => return Err(IoError::new(ErrorKind::InvalidData, GpioError::UnknownEventId(id))),
+        };
+
+        Ok(Self {
+            info: raw.info.into(),
+            timestamp: Duration::from_nanos(raw.timestamp_ns),
+            kind,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {super::*, crate::GpioLineFlags, pretty_assertions::assert_eq};
+
+    #[test]
+    fn test_event_display() {
+        let event = GpioLineEvent {
+            timestamp: Duration::new(12, 345678),
+            clock: GpioEventClock::Monotonic,
+            kind: GpioLineEventKind::RisingEdge,
+            offset: 17,
+            seqno: 3,
+            line_seqno: 1,
+            time: UNIX_EPOCH,
+            time_conversion: GpioTimeConversion::MonotonicOffset,
+        };
+        assert_eq!(
+            event.to_string(),
+            "offset=17 kind=RisingEdge timestamp=12.000345678 clock=Monotonic seqno=3 line_seqno=1"
+        );
+    }
+
+    #[test]
+    fn test_info_changed_display() {
+        let changed = GpioLineInfoChanged {
+            info: GpioLineInfo {
+                name: "LED".to_string(),
+                consumer: String::new(),
+                offset: 4,
+                flags: GpioLineFlags::default(),
+                attrs: Vec::new(),
+            },
+            timestamp: Duration::from_millis(1500),
+            kind: GpioLineChangeKind::Released,
+        };
+        assert_eq!(changed.to_string(), "kind=Released offset=4 name=\"LED\" timestamp=1.500000000");
+    }
+}
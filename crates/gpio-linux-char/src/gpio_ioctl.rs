@@ -1,7 +1,20 @@
+//! Raw GPIO character device ioctls and the kernel structures they exchange.
+//!
+//! The structures are laid out by hand with `#[repr(C)]` to match `/usr/include/linux/gpio.h`, including explicit
+//! padding fields, and ioctls are issued directly with `libc::ioctl`. Nothing is generated from the kernel headers
+//! at build time, so cross-compiling (e.g. for a Raspberry Pi from a laptop) needs only a Rust target and a linker,
+//! not a C toolchain or kernel headers for the target.
+//!
+//! The v2 uAPI structures have the same layout on 32-bit and 64-bit architectures. The sizes and field offsets are
+//! checked against the kernel headers by `ccompat_tests`, which is generated by compiling and running
+//! `gen_ccompat_tests.c` against the installed headers.
+
 use {
+    crate::GpioError,
     ioctl_id::{IoctlId, ior, iowr},
     std::{
-        io::{Error as IoError, Result as IoResult},
+        io::{Error as IoError, ErrorKind, Result as IoResult},
+        mem::size_of,
         os::fd::RawFd,
     },
 };
@@ -18,17 +31,36 @@ pub(crate) const GPIO_V2_LINE_NUM_ATTRS_MAX: usize = 10;
 /// IOCTL: Get chip information.
 pub(crate) const GPIO_GET_CHIPINFO_IOCTL: IoctlId = ior::<RawGpioChipInfo>(0xb4, 0x01) as u64;
 
-/// IOCTL: ?
-#[allow(dead_code)]
+/// IOCTL: Request lines for I/O with the v1 uAPI.
+pub(crate) const GPIO_GET_LINEHANDLE_IOCTL: IoctlId = iowr::<RawGpioHandleRequest>(0xb4, 0x03) as u64;
+
+/// IOCTL: Get the values of lines requested with the v1 uAPI.
+pub(crate) const GPIOHANDLE_GET_LINE_VALUES_IOCTL: IoctlId = iowr::<RawGpioHandleData>(0xb4, 0x08) as u64;
+
+/// IOCTL: Set the values of lines requested with the v1 uAPI.
+pub(crate) const GPIOHANDLE_SET_LINE_VALUES_IOCTL: IoctlId = iowr::<RawGpioHandleData>(0xb4, 0x09) as u64;
+
+/// IOCTL: Stop watching a line for changes.
 pub(crate) const GPIO_GET_LINEINFO_UNWATCH_IOCTL: IoctlId = iowr::<u32>(0xb4, 0x0c) as u64;
 
 /// IOCTL: Get line information.
 pub(crate) const GPIO_V2_GET_LINEINFO_IOCTL: IoctlId = iowr::<RawGpioV2LineInfo>(0xb4, 0x05) as u64;
 
-/// IOCTL: ?
-#[allow(dead_code)]
+/// IOCTL: Get line information and watch the line for changes.
 pub(crate) const GPIO_V2_GET_LINEINFO_WATCH_IOCTL: IoctlId = iowr::<RawGpioV2LineInfo>(0xb4, 0x06) as u64;
 
+/// IOCTL: Request lines for I/O.
+pub(crate) const GPIO_V2_GET_LINE_IOCTL: IoctlId = iowr::<RawGpioV2LineRequest>(0xb4, 0x07) as u64;
+
+/// IOCTL: Reconfigure requested lines.
+pub(crate) const GPIO_V2_LINE_SET_CONFIG_IOCTL: IoctlId = iowr::<RawGpioV2LineConfig>(0xb4, 0x0d) as u64;
+
+/// IOCTL: Get the values of requested lines.
+pub(crate) const GPIO_V2_LINE_GET_VALUES_IOCTL: IoctlId = iowr::<RawGpioV2LineValues>(0xb4, 0x0e) as u64;
+
+/// IOCTL: Set the values of requested lines.
+pub(crate) const GPIO_V2_LINE_SET_VALUES_IOCTL: IoctlId = iowr::<RawGpioV2LineValues>(0xb4, 0x0f) as u64;
+
 /// Line attribute id: flags
 pub(crate) const GPIO_V2_LINE_ATTR_ID_FLAGS: u32 = 1;
 
@@ -38,6 +70,76 @@ pub(crate) const GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES: u32 = 2;
 /// Line attribute id: debounce period
 pub(crate) const GPIO_V2_LINE_ATTR_ID_DEBOUNCE: u32 = 3;
 
+/// Maximum number of lines in a v1 line handle request.
+pub(crate) const GPIOHANDLES_MAX: usize = 64;
+
+/// v1 line handle request flag: input
+pub(crate) const GPIOHANDLE_REQUEST_INPUT: u32 = 1 << 0;
+
+/// v1 line handle request flag: output
+pub(crate) const GPIOHANDLE_REQUEST_OUTPUT: u32 = 1 << 1;
+
+/// v1 line handle request flag: active low
+pub(crate) const GPIOHANDLE_REQUEST_ACTIVE_LOW: u32 = 1 << 2;
+
+/// v1 line handle request flag: open drain
+pub(crate) const GPIOHANDLE_REQUEST_OPEN_DRAIN: u32 = 1 << 3;
+
+/// v1 line handle request flag: open source
+pub(crate) const GPIOHANDLE_REQUEST_OPEN_SOURCE: u32 = 1 << 4;
+
+/// v1 line handle request flag: pull-up bias
+pub(crate) const GPIOHANDLE_REQUEST_BIAS_PULL_UP: u32 = 1 << 5;
+
+/// v1 line handle request flag: pull-down bias
+pub(crate) const GPIOHANDLE_REQUEST_BIAS_PULL_DOWN: u32 = 1 << 6;
+
+/// v1 line handle request flag: bias disabled
+pub(crate) const GPIOHANDLE_REQUEST_BIAS_DISABLE: u32 = 1 << 7;
+
+/// Line event id: rising edge
+pub(crate) const GPIO_V2_LINE_EVENT_RISING_EDGE: u32 = 1;
+
+/// Line event id: falling edge
+pub(crate) const GPIO_V2_LINE_EVENT_FALLING_EDGE: u32 = 2;
+
+/// Line changed type: requested
+pub(crate) const GPIO_V2_LINE_CHANGED_REQUESTED: u32 = 1;
+
+/// Line changed type: released
+pub(crate) const GPIO_V2_LINE_CHANGED_RELEASED: u32 = 2;
+
+/// Line changed type: reconfigured
+pub(crate) const GPIO_V2_LINE_CHANGED_CONFIG: u32 = 3;
+
+/// Read a fixed-size record from `fd`, blocking if none is pending.
+///
+/// The kernel never splits records, so a short read indicates a mismatch between our idea of the record size and
+/// the kernel's.
+fn read_record<T: Default>(fd: RawFd) -> IoResult<T> {
+    let mut result = T::default();
+    let size = size_of::<T>();
+    let ret = unsafe { libc::read(fd, &mut result as *mut _ as *mut libc::c_void, size) };
+    if ret < 0 {
+        Err(IoError::last_os_error())
+    } else if ret as usize != size {
+        Err(IoError::new(ErrorKind::UnexpectedEof, GpioError::ShortRead(ret as usize, size)))
+    } else {
+        Ok(result)
+    }
+}
+
+/// Stop watching the line at `offset` on the GPIO chip open on `fd`.
+pub(crate) fn unwatch_line_info(fd: RawFd, offset: u32) -> IoResult<()> {
+    let mut offset = offset;
+    let ret = unsafe { libc::ioctl(fd, GPIO_GET_LINEINFO_UNWATCH_IOCTL, &mut offset as *mut _) };
+    if ret != 0 {
+        Err(IoError::last_os_error())
+    } else {
+        Ok(())
+    }
+}
+
 /// Struct `gpiochip_info` from `/usr/include/linux/gpio.h`.
 #[repr(C)]
 #[derive(Default)]
@@ -86,6 +188,19 @@ impl RawGpioV2LineInfo {
             Ok(result)
         }
     }
+
+    pub(crate) fn watch_line_info(fd: RawFd, offset: u32) -> IoResult<Self> {
+        let mut result = Self {
+            offset,
+            ..Default::default()
+        };
+        let ret = unsafe { libc::ioctl(fd, GPIO_V2_GET_LINEINFO_WATCH_IOCTL, &mut result as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(result)
+        }
+    }
 }
 
 /// Struct `gpio_v2_line_attribute` from `/usr/include/linux/gpio.h`.
@@ -113,5 +228,230 @@ impl Default for RawGpioV2LineAttrValue {
     }
 }
 
+/// Struct `gpio_v2_line_config_attribute` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+#[derive(Default)]
+pub(crate) struct RawGpioV2LineConfigAttr {
+    pub(crate) attr: RawGpioV2LineAttr,
+    pub(crate) mask: u64,
+}
+
+/// Struct `gpio_v2_line_config` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+#[derive(Default)]
+pub(crate) struct RawGpioV2LineConfig {
+    pub(crate) flags: u64,
+    pub(crate) num_attrs: u32,
+    pub(crate) padding: [u32; 5],
+    pub(crate) attrs: [RawGpioV2LineConfigAttr; GPIO_V2_LINE_NUM_ATTRS_MAX],
+}
+
+impl RawGpioV2LineConfig {
+    /// Apply this configuration to the line request open on `fd`.
+    pub(crate) fn set_config(&mut self, fd: RawFd) -> IoResult<()> {
+        let ret = unsafe { libc::ioctl(fd, GPIO_V2_LINE_SET_CONFIG_IOCTL, self as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(())
+        }
+    }
+}
+
+/// Struct `gpio_v2_line_request` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+pub(crate) struct RawGpioV2LineRequest {
+    pub(crate) offsets: [u32; GPIO_V2_LINES_MAX],
+    pub(crate) consumer: [u8; GPIO_MAX_NAME_SIZE],
+    pub(crate) config: RawGpioV2LineConfig,
+    pub(crate) num_lines: u32,
+    pub(crate) event_buffer_size: u32,
+    pub(crate) padding: [u32; 5],
+    pub(crate) fd: i32,
+}
+
+impl Default for RawGpioV2LineRequest {
+    fn default() -> Self {
+        Self {
+            offsets: [0; GPIO_V2_LINES_MAX],
+            consumer: [0; GPIO_MAX_NAME_SIZE],
+            config: RawGpioV2LineConfig::default(),
+            num_lines: 0,
+            event_buffer_size: 0,
+            padding: [0; 5],
+            fd: -1,
+        }
+    }
+}
+
+impl RawGpioV2LineRequest {
+    /// Request the lines described by this structure from the GPIO chip, returning the file descriptor for the
+    /// line request.
+    pub(crate) fn get_line(&mut self, fd: RawFd) -> IoResult<RawFd> {
+        let ret = unsafe { libc::ioctl(fd, GPIO_V2_GET_LINE_IOCTL, self as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(self.fd)
+        }
+    }
+}
+
+/// Struct `gpio_v2_line_values` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+#[derive(Default)]
+pub(crate) struct RawGpioV2LineValues {
+    pub(crate) bits: u64,
+    pub(crate) mask: u64,
+}
+
+impl RawGpioV2LineValues {
+    /// Read the values of the lines selected by `mask` from the line request open on `fd`.
+    pub(crate) fn get_values(fd: RawFd, mask: u64) -> IoResult<Self> {
+        let mut result = Self {
+            bits: 0,
+            mask,
+        };
+        let ret = unsafe { libc::ioctl(fd, GPIO_V2_LINE_GET_VALUES_IOCTL, &mut result as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(result)
+        }
+    }
+
+    /// Write these values to the line request open on `fd`.
+    pub(crate) fn set_values(&mut self, fd: RawFd) -> IoResult<()> {
+        let ret = unsafe { libc::ioctl(fd, GPIO_V2_LINE_SET_VALUES_IOCTL, self as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(())
+        }
+    }
+}
+
+/// Struct `gpio_v2_line_event` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+#[derive(Default)]
+pub(crate) struct RawGpioV2LineEvent {
+    pub(crate) timestamp_ns: u64,
+    pub(crate) id: u32,
+    pub(crate) offset: u32,
+    pub(crate) seqno: u32,
+    pub(crate) line_seqno: u32,
+    pub(crate) padding: [u32; 6],
+}
+
+impl RawGpioV2LineEvent {
+    /// Read the next event from the line request open on `fd`, blocking if none is pending.
+    pub(crate) fn read(fd: RawFd) -> IoResult<Self> {
+        read_record(fd)
+    }
+
+    /// Read as many whole events as fit into `buf` from the line request open on `fd`, blocking if none is pending.
+    /// Returns the number of bytes read.
+    pub(crate) fn read_raw(fd: RawFd, buf: &mut [u8]) -> IoResult<usize> {
+        let len = buf.len() - buf.len() % size_of::<Self>();
+        let ret = unsafe { libc::read(fd, buf.as_mut_ptr() as *mut libc::c_void, len) };
+        if ret < 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(ret as usize)
+        }
+    }
+}
+
+/// Struct `gpio_v2_line_info_changed` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+#[derive(Default)]
+pub(crate) struct RawGpioV2LineInfoChanged {
+    pub(crate) info: RawGpioV2LineInfo,
+    pub(crate) timestamp_ns: u64,
+    pub(crate) event_type: u32,
+    pub(crate) padding: [u32; 5],
+}
+
+impl RawGpioV2LineInfoChanged {
+    /// Read the next line change record from the GPIO chip open on `fd`, blocking if none is pending.
+    pub(crate) fn read(fd: RawFd) -> IoResult<Self> {
+        read_record(fd)
+    }
+}
+
+/// Struct `gpiohandle_request` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+pub(crate) struct RawGpioHandleRequest {
+    pub(crate) lineoffsets: [u32; GPIOHANDLES_MAX],
+    pub(crate) flags: u32,
+    pub(crate) default_values: [u8; GPIOHANDLES_MAX],
+    pub(crate) consumer_label: [u8; GPIO_MAX_NAME_SIZE],
+    pub(crate) lines: u32,
+    pub(crate) fd: i32,
+}
+
+impl Default for RawGpioHandleRequest {
+    fn default() -> Self {
+        Self {
+            lineoffsets: [0; GPIOHANDLES_MAX],
+            flags: 0,
+            default_values: [0; GPIOHANDLES_MAX],
+            consumer_label: [0; GPIO_MAX_NAME_SIZE],
+            lines: 0,
+            fd: -1,
+        }
+    }
+}
+
+impl RawGpioHandleRequest {
+    /// Request the lines described by this structure from the GPIO chip, returning the file descriptor for the
+    /// line handle.
+    pub(crate) fn get_line_handle(&mut self, fd: RawFd) -> IoResult<RawFd> {
+        let ret = unsafe { libc::ioctl(fd, GPIO_GET_LINEHANDLE_IOCTL, self as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(self.fd)
+        }
+    }
+}
+
+/// Struct `gpiohandle_data` from `/usr/include/linux/gpio.h`.
+#[repr(C)]
+pub(crate) struct RawGpioHandleData {
+    pub(crate) values: [u8; GPIOHANDLES_MAX],
+}
+
+impl Default for RawGpioHandleData {
+    fn default() -> Self {
+        Self {
+            values: [0; GPIOHANDLES_MAX],
+        }
+    }
+}
+
+impl RawGpioHandleData {
+    /// Read the values of all lines of the line handle open on `fd`.
+    pub(crate) fn get_values(fd: RawFd) -> IoResult<Self> {
+        let mut result = Self::default();
+        let ret = unsafe { libc::ioctl(fd, GPIOHANDLE_GET_LINE_VALUES_IOCTL, &mut result as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(result)
+        }
+    }
+
+    /// Write these values to all lines of the line handle open on `fd`.
+    pub(crate) fn set_values(&mut self, fd: RawFd) -> IoResult<()> {
+        let ret = unsafe { libc::ioctl(fd, GPIOHANDLE_SET_LINE_VALUES_IOCTL, self as *mut _) };
+        if ret != 0 {
+            Err(IoError::last_os_error())
+        } else {
+            Ok(())
+        }
+    }
+}
+
 #[cfg(test)]
 mod ccompat_tests;
@@ -1,18 +1,54 @@
 //! This is an automatically generated file; do not edit.
-//! Generated by gen_ccompat_tests.c on Jun 24 2024 14:45:07
+//! Generated by gen_ccompat_tests.c on Oct 14 2026 17:26:48
 use std::mem::{offset_of, size_of};
 
 #[test]
 fn test_gpio_ioctl_ccompat() {
     assert_eq!(super::GPIO_GET_CHIPINFO_IOCTL, 0x8044b401);
+    assert_eq!(super::GPIO_GET_LINEHANDLE_IOCTL, 0xc16cb403);
+    assert_eq!(super::GPIOHANDLE_GET_LINE_VALUES_IOCTL, 0xc040b408);
+    assert_eq!(super::GPIOHANDLE_SET_LINE_VALUES_IOCTL, 0xc040b409);
     assert_eq!(super::GPIO_GET_LINEINFO_UNWATCH_IOCTL, 0xc004b40c);
     assert_eq!(super::GPIO_V2_GET_LINEINFO_IOCTL, 0xc100b405);
+    assert_eq!(super::GPIO_V2_GET_LINEINFO_WATCH_IOCTL, 0xc100b406);
+    assert_eq!(super::GPIO_V2_GET_LINE_IOCTL, 0xc250b407);
+    assert_eq!(super::GPIO_V2_LINE_SET_CONFIG_IOCTL, 0xc110b40d);
+    assert_eq!(super::GPIO_V2_LINE_GET_VALUES_IOCTL, 0xc010b40e);
+    assert_eq!(super::GPIO_V2_LINE_SET_VALUES_IOCTL, 0xc010b40f);
     assert_eq!(super::GPIO_V2_LINE_ATTR_ID_FLAGS, 0x1);
     assert_eq!(super::GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES, 0x2);
     assert_eq!(super::GPIO_V2_LINE_ATTR_ID_DEBOUNCE, 0x3);
+    assert_eq!(super::GPIOHANDLES_MAX, 64);
+    assert_eq!(super::GPIOHANDLE_REQUEST_INPUT, 0x1);
+    assert_eq!(super::GPIOHANDLE_REQUEST_OUTPUT, 0x2);
+    assert_eq!(super::GPIOHANDLE_REQUEST_ACTIVE_LOW, 0x4);
+    assert_eq!(super::GPIOHANDLE_REQUEST_OPEN_DRAIN, 0x8);
+    assert_eq!(super::GPIOHANDLE_REQUEST_OPEN_SOURCE, 0x10);
+    assert_eq!(super::GPIOHANDLE_REQUEST_BIAS_PULL_UP, 0x20);
+    assert_eq!(super::GPIOHANDLE_REQUEST_BIAS_PULL_DOWN, 0x40);
+    assert_eq!(super::GPIOHANDLE_REQUEST_BIAS_DISABLE, 0x80);
+    assert_eq!(super::GPIO_V2_LINE_EVENT_RISING_EDGE, 0x1);
+    assert_eq!(super::GPIO_V2_LINE_EVENT_FALLING_EDGE, 0x2);
+    assert_eq!(super::GPIO_V2_LINE_CHANGED_REQUESTED, 0x1);
+    assert_eq!(super::GPIO_V2_LINE_CHANGED_RELEASED, 0x2);
+    assert_eq!(super::GPIO_V2_LINE_CHANGED_CONFIG, 0x3);
     assert_eq!(size_of::<super::RawGpioChipInfo>(), 68);
     assert_eq!(size_of::<super::RawGpioV2LineAttr>(), 16);
     assert_eq!(size_of::<super::RawGpioV2LineInfo>(), 256);
+    assert_eq!(size_of::<super::RawGpioV2LineConfigAttr>(), 24);
+    assert_eq!(size_of::<super::RawGpioV2LineConfig>(), 272);
+    assert_eq!(size_of::<super::RawGpioV2LineRequest>(), 592);
+    assert_eq!(size_of::<super::RawGpioV2LineValues>(), 16);
+    assert_eq!(size_of::<super::RawGpioV2LineEvent>(), 48);
+    assert_eq!(size_of::<super::RawGpioV2LineInfoChanged>(), 288);
+    assert_eq!(size_of::<super::RawGpioHandleRequest>(), 364);
+    assert_eq!(size_of::<super::RawGpioHandleData>(), 64);
+    assert_eq!(offset_of!(super::RawGpioHandleRequest, lineoffsets), 0);
+    assert_eq!(offset_of!(super::RawGpioHandleRequest, flags), 256);
+    assert_eq!(offset_of!(super::RawGpioHandleRequest, default_values), 260);
+    assert_eq!(offset_of!(super::RawGpioHandleRequest, consumer_label), 324);
+    assert_eq!(offset_of!(super::RawGpioHandleRequest, lines), 356);
+    assert_eq!(offset_of!(super::RawGpioHandleRequest, fd), 360);
     assert_eq!(offset_of!(super::RawGpioV2LineAttr, id), 0);
     assert_eq!(offset_of!(super::RawGpioV2LineAttr, padding), 4);
     assert_eq!(offset_of!(super::RawGpioV2LineAttr, data) + offset_of!(super::RawGpioV2LineAttrValue, flags), 8);
@@ -25,4 +61,29 @@ fn test_gpio_ioctl_ccompat() {
     assert_eq!(offset_of!(super::RawGpioV2LineInfo, flags), 72);
     assert_eq!(offset_of!(super::RawGpioV2LineInfo, attrs), 80);
     assert_eq!(offset_of!(super::RawGpioV2LineInfo, padding), 240);
+    assert_eq!(offset_of!(super::RawGpioV2LineConfigAttr, attr), 0);
+    assert_eq!(offset_of!(super::RawGpioV2LineConfigAttr, mask), 16);
+    assert_eq!(offset_of!(super::RawGpioV2LineConfig, flags), 0);
+    assert_eq!(offset_of!(super::RawGpioV2LineConfig, num_attrs), 8);
+    assert_eq!(offset_of!(super::RawGpioV2LineConfig, padding), 12);
+    assert_eq!(offset_of!(super::RawGpioV2LineConfig, attrs), 32);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, offsets), 0);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, consumer), 256);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, config), 288);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, num_lines), 560);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, event_buffer_size), 564);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, padding), 568);
+    assert_eq!(offset_of!(super::RawGpioV2LineRequest, fd), 588);
+    assert_eq!(offset_of!(super::RawGpioV2LineValues, bits), 0);
+    assert_eq!(offset_of!(super::RawGpioV2LineValues, mask), 8);
+    assert_eq!(offset_of!(super::RawGpioV2LineEvent, timestamp_ns), 0);
+    assert_eq!(offset_of!(super::RawGpioV2LineEvent, id), 8);
+    assert_eq!(offset_of!(super::RawGpioV2LineEvent, offset), 12);
+    assert_eq!(offset_of!(super::RawGpioV2LineEvent, seqno), 16);
+    assert_eq!(offset_of!(super::RawGpioV2LineEvent, line_seqno), 20);
+    assert_eq!(offset_of!(super::RawGpioV2LineEvent, padding), 24);
+    assert_eq!(offset_of!(super::RawGpioV2LineInfoChanged, info), 0);
+    assert_eq!(offset_of!(super::RawGpioV2LineInfoChanged, timestamp_ns), 256);
+    assert_eq!(offset_of!(super::RawGpioV2LineInfoChanged, event_type), 264);
+    assert_eq!(offset_of!(super::RawGpioV2LineInfoChanged, padding), 268);
 }
\ No newline at end of file
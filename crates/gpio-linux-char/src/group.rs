@@ -0,0 +1,96 @@
+//! Groups of line requests that are released together.
+
+use {
+    crate::{Gpio, GpioLineConfig, GpioLineRequest},
+    std::io::Result as IoResult,
+};
+
+/// A set of line requests made from one GPIO chip, released together.
+///
+/// This is for programs that hold several independent requests (e.g. buttons as inputs and LEDs as outputs) and want
+/// to release them all in one place, such as at shutdown of a long-running daemon. Create one with
+/// [`Gpio::request_group`]. Dropping the group releases any requests it still holds.
+#[derive(Debug)]
+pub struct GpioRequestGroup<'a> {
+    gpio: &'a Gpio,
+    requests: Vec<GpioLineRequest>,
+}
+
+impl<'a> GpioRequestGroup<'a> {
+    /// Create an empty group for requests from `gpio`.
+    pub(crate) fn new(gpio: &'a Gpio) -> Self {
+        Self {
+            gpio,
+            requests: Vec::new(),
+        }
+    }
+
+    /// Request lines as with [`Gpio::request_lines`] and add the request to the group, returning a reference to it.
+    ///
+    /// # Errors
+    /// Errors are the same as for [`Gpio::request_lines`]; on error, the group is unchanged.
+    pub fn request_lines(&mut self, offsets: &[usize], config: &GpioLineConfig) -> IoResult<&GpioLineRequest> {
+        let request = self.gpio.request_lines(offsets, config)?;
+        self.requests.push(request);
+        Ok(self.requests.last().unwrap())
+    }
+
+    /// Returns the requests in the group, in the order they were made.
+    pub fn requests(&self) -> &[GpioLineRequest] {
+        &self.requests
+    }
+
+    /// Returns the number of requests in the group.
+    pub fn len(&self) -> usize {
+        self.requests.len()
+    }
+
+    /// Indicates whether the group holds no requests.
+    pub fn is_empty(&self) -> bool {
+        self.requests.is_empty()
+    }
+
+    /// Release every request in the group, leaving it empty.
+    ///
+    /// All requests are released even if some fail to close.
+    ///
+    /// # Errors
+    /// If closing any request fails, the first error is returned, as for [`GpioLineRequest::close`].
+    pub fn close_all(&mut self) -> IoResult<()> {
+        let mut result = Ok(());
+        for request in self.requests.drain(..) {
+            let closed = request.close();
+            if result.is_ok() {
+                result = closed;
+            }
+        }
+        result
+    }
+}
+
+impl Gpio {
+    /// Create an empty [`GpioRequestGroup`] for making line requests from this chip that are released together.
+    pub fn request_group(&self) -> GpioRequestGroup<'_> {
+        GpioRequestGroup::new(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {super::*, crate::backend::fake::fake_gpio};
+
+    #[test]
+    fn test_request_group_close_all() {
+        let gpio = fake_gpio();
+        let mut group = gpio.request_group();
+        group.request_lines(&[0], &GpioLineConfig::default()).unwrap();
+        group.request_lines(&[1, 2], &GpioLineConfig::default()).unwrap();
+        assert!(group.request_lines(&[2], &GpioLineConfig::default()).is_err());
+        assert_eq!(group.len(), 2);
+
+        group.close_all().unwrap();
+        assert!(group.is_empty());
+        assert!(!gpio.get_line_info(1).unwrap().flags.is_used());
+        gpio.request_lines(&[0, 1, 2], &GpioLineConfig::default()).unwrap();
+    }
+}
@@ -3,23 +3,51 @@
 #![warn(missing_docs)]
 
 use {
+    backend::{GpioBackend, IoctlBackend},
+    cancel::wait_readable,
     log::warn,
     std::{
         error::Error,
         fmt::{Display, Formatter, Result as FmtResult},
         fs::File,
-        io::{Error as IoError, Result as IoResult},
+        io::{Error as IoError, Result as IoResult, Write},
+        iter::FusedIterator,
         ops::{BitAnd, BitAndAssign, BitOr, BitOrAssign, BitXor, BitXorAssign, Not},
         os::{
-            fd::{IntoRawFd, RawFd},
+            fd::{AsFd, AsRawFd, BorrowedFd, IntoRawFd, RawFd},
             unix::fs::FileTypeExt,
         },
         path::{Path, PathBuf},
+        sync::{
+            Arc, OnceLock,
+            mpsc::{Receiver, sync_channel},
+        },
+        thread::Builder,
         time::Duration,
     },
 };
 
+mod backend;
+mod cancel;
+mod debounce;
+mod event;
 pub(crate) mod gpio_ioctl;
+mod group;
+mod line_request;
+mod pi;
+mod spi;
+mod values;
+
+pub use {
+    cancel::CancelToken,
+    event::{
+        GpioEventClock, GpioLineChangeKind, GpioLineEvent, GpioLineEventKind, GpioLineInfoChanged, GpioTimeConversion,
+    },
+    group::GpioRequestGroup,
+    line_request::{GpioLineConfig, GpioLineDirection, GpioLineRequest},
+    spi::{BitBangSpi, SpiMode},
+    values::GpioLineValues,
+};
 
 /// Maximum number of lines per chip.
 pub const MAX_GPIO_LINES_PER_CHIP: usize = gpio_ioctl::GPIO_V2_LINES_MAX;
@@ -28,6 +56,12 @@ pub const MAX_GPIO_LINES_PER_CHIP: usize = gpio_ioctl::GPIO_V2_LINES_MAX;
 #[derive(Debug)]
 pub struct Gpio {
     fd: RawFd,
+    path: PathBuf,
+    backend: Arc<dyn GpioBackend>,
+    supports_v2: OnceLock<bool>,
+
+    /// The number of lines on the chip, cached from the first successful chip info ioctl.
+    num_lines: OnceLock<usize>,
 }
 
 /// Indicates whether a string is composed entirely of ASCII digits.
@@ -45,6 +79,41 @@ pub(crate) fn cstr_to_string(buf: &[u8]) -> String {
     String::from_utf8_lossy(&buf[..len]).to_string()
 }
 
+/// Returns a function that wraps an OS error from operation `op` on `target` in a [`GpioError::Os`], keeping the
+/// error kind.
+pub(crate) fn os_error(op: &'static str, target: impl Display) -> impl FnOnce(IoError) -> IoError {
+    move |error| {
+        IoError::new(
+            error.kind(),
+            GpioError::Os {
+                op,
+                target: target.to_string(),
+                error,
+            },
+        )
+    }
+}
+
+/// Set or clear `O_NONBLOCK` on a file descriptor.
+pub(crate) fn set_fd_nonblocking(fd: RawFd, nonblocking: bool) -> IoResult<()> {
+    let flags = unsafe { libc::fcntl(fd, libc::F_GETFL) };
+    if flags < 0 {
+        return Err(IoError::last_os_error());
+    }
+
+    let flags = if nonblocking {
+        flags | libc::O_NONBLOCK
+    } else {
+        flags & !libc::O_NONBLOCK
+    };
+
+    if unsafe { libc::fcntl(fd, libc::F_SETFL, flags) } < 0 {
+        return Err(IoError::last_os_error());
+    }
+
+    Ok(())
+}
+
 impl Gpio {
     /// Convert a string describing a GPIO chip into a path, or return an error.
     pub fn parse_chip_descriptor(desc: &str) -> IoResult<PathBuf> {
@@ -69,15 +138,62 @@ impl Gpio {
     ///
     /// If the GPIO character device is not a character device, an [`IoError`][std::io::Error] is returned with a kind of
     /// [`Other`][std::io::ErrorKind::Other] wrapping a [`GpioError::NotCharDev`].
+    ///
+    /// If the device is a character device but not a GPIO chip, an [`IoError`][std::io::Error] is returned with a kind
+    /// of [`Other`][std::io::ErrorKind::Other] wrapping a [`GpioError::NotGpioChip`].
     pub fn open(path: impl AsRef<Path>) -> IoResult<Self> {
+        let path = path.as_ref();
         let fd = File::options().read(true).write(true).open(path)?;
         if !fd.metadata()?.file_type().is_char_device() {
-            Err(IoError::other(GpioError::NotCharDev))
-        } else {
-            Ok(Self {
-                fd: fd.into_raw_fd(),
-            })
+            return Err(IoError::other(GpioError::NotCharDev));
+        }
+
+        let gpio = Self {
+            fd: fd.into_raw_fd(),
+            path: path.to_path_buf(),
+            backend: Arc::new(IoctlBackend),
+            supports_v2: OnceLock::new(),
+            num_lines: OnceLock::new(),
+        };
+
+        // Make sure this is really a GPIO chip; other character devices reject the ioctl with ENOTTY. The chip info
+        // ioctl is common to both versions of the uAPI, so this succeeds on kernels without v2. On failure, dropping
+        // `gpio` closes the descriptor.
+        match gpio.get_chip_info() {
+            Ok(_) => Ok(gpio),
+            Err(e) if GpioError::errno(&e) == Some(libc::ENOTTY) => Err(IoError::other(GpioError::NotGpioChip)),
+            Err(e) => Err(e),
+        }
+    }
+
+    /// Open the first GPIO chip whose label matches `label` exactly.
+    ///
+    /// This is useful on systems where the chip number of a given GPIO bank varies (e.g. between Raspberry Pi
+    /// models). Chips that cannot be opened or interrogated are skipped (with an error message logged).
+    ///
+    /// # Errors
+    /// If the `/dev` directory cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    ///
+    /// If no chip has the given label, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`NotFound`][std::io::ErrorKind::NotFound] wrapping a [`GpioError::ChipNotFound`].
+    pub fn open_by_label(label: &str) -> IoResult<Self> {
+        for path in Self::list_chips()? {
+            let gpio = match Self::open(&path) {
+                Ok(gpio) => gpio,
+                Err(e) => {
+                    warn!("Failed to open {}: {}", path.to_string_lossy(), e);
+                    continue;
+                }
+            };
+
+            match gpio.get_chip_info() {
+                Ok(info) if info.label == label => return Ok(gpio),
+                Ok(_) => (),
+                Err(e) => warn!("Failed to get chip info for {}: {}", path.to_string_lossy(), e),
+            }
         }
+
+        Err(IoError::new(std::io::ErrorKind::NotFound, GpioError::ChipNotFound(label.to_string())))
     }
 
     /// List available GPIO chips.
@@ -121,22 +237,586 @@ impl Gpio {
         Ok(devices)
     }
 
+    /// Get information about every available GPIO chip, in the order returned by [`list_chips`][Self::list_chips].
+    ///
+    /// Each chip is opened just long enough to read its information, so this gives a quick inventory without
+    /// managing file descriptors. Chips that cannot be opened (typically for lack of permission) or queried are
+    /// skipped, with a warning logged.
+    ///
+    /// # Errors
+    /// If the `/dev` directory cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn enumerate_all() -> IoResult<Vec<(PathBuf, GpioChipInfo)>> {
+        let mut chips = vec![];
+        for path in Self::list_chips()? {
+            match Self::open(&path).and_then(|gpio| gpio.get_chip_info()) {
+                Ok(info) => chips.push((path, info)),
+                Err(e) => warn!("Skipping {}: {}", path.to_string_lossy(), e),
+            }
+        }
+
+        Ok(chips)
+    }
+
+    /// Create a fake chip with the given label and line names, simulated in memory instead of issuing ioctls, for
+    /// testing code that drives GPIO lines without hardware.
+    ///
+    /// Lines can be requested, configured, set, and read back, and changes to watched lines are reported, as on a
+    /// real chip. Edge events are never generated, and reading changes when none are pending fails with
+    /// [`WouldBlock`][std::io::ErrorKind::WouldBlock] instead of blocking. This is only available with the `fake`
+    /// feature, which is meant for dev-dependencies.
+    ///
+    /// # Panics
+    /// Panics if the `eventfd` standing in for the chip's file descriptor cannot be created.
+    #[cfg(any(test, feature = "fake"))]
+    pub fn fake(label: &str, line_names: &[&str]) -> Self {
+        Self::with_backend(Arc::new(backend::fake::FakeChip::new(label, line_names)))
+    }
+
+    /// Create a chip whose operations are handled by `backend` instead of the kernel.
+    ///
+    /// The chip's file descriptor is an `eventfd` that never becomes readable, so it can be polled and closed.
+    ///
+    /// # Panics
+    /// Panics if the `eventfd` cannot be created.
+    #[cfg(any(test, feature = "fake"))]
+    pub(crate) fn with_backend(backend: Arc<dyn GpioBackend>) -> Self {
+        let fd = unsafe { libc::eventfd(0, libc::EFD_CLOEXEC) };
+        assert!(fd >= 0, "Failed to create an eventfd for a fake GPIO chip: {}", IoError::last_os_error());
+
+        Self {
+            fd,
+            path: PathBuf::from("/dev/gpiochip-fake"),
+            backend,
+            supports_v2: OnceLock::new(),
+            num_lines: OnceLock::new(),
+        }
+    }
+
+    /// Returns the path this GPIO chip was opened from.
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Returns the backend handling this chip's operations.
+    pub(crate) fn backend(&self) -> &Arc<dyn GpioBackend> {
+        &self.backend
+    }
+
     /// Get information about this GPIO chip.
+    ///
+    /// # Errors
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
     pub fn get_chip_info(&self) -> IoResult<GpioChipInfo> {
-        let raw = gpio_ioctl::RawGpioChipInfo::default();
-        let raw = raw.get_chip_info(self.fd)?;
-        Ok(raw.into())
+        let raw = self.backend.get_chip_info(self.fd).map_err(os_error("get chip info", self.path.display()))?;
+        let info = GpioChipInfo::from(raw);
+        let _ = self.num_lines.set(info.lines);
+        Ok(info)
+    }
+
+    /// Returns the number of lines on this chip.
+    ///
+    /// The line count of a chip never changes, so it is cached: this issues the chip info ioctl only if no chip
+    /// information has been read yet. (Opening a chip reads it, so this normally issues no ioctls at all.)
+    ///
+    /// # Errors
+    /// If the chip information has to be read and cannot be, the error is returned as for
+    /// [`get_chip_info`][Self::get_chip_info].
+    pub fn num_lines(&self) -> IoResult<usize> {
+        match self.num_lines.get() {
+            Some(&lines) => Ok(lines),
+            None => Ok(self.get_chip_info()?.lines),
+        }
+    }
+
+    /// Indicates whether the kernel supports version 2 of the GPIO character device uAPI (Linux 5.10 and later).
+    ///
+    /// The first call probes the kernel by getting information about line 0 with the v2 ioctl; kernels without v2
+    /// reject it with `ENOTTY`. The result is cached for later calls. Any other outcome, including other errors
+    /// (such as for a chip with no lines), is taken to mean v2 is supported.
+    pub fn supports_v2(&self) -> bool {
+        *self.supports_v2.get_or_init(|| match self.backend.get_line_info(self.fd, 0) {
+            Err(e) => e.raw_os_error() != Some(libc::ENOTTY),
+            Ok(_) => true,
+        })
     }
 
     /// Get information about a GPIO line.
+    ///
+    /// # Errors
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
     pub fn get_line_info(&self, line: usize) -> IoResult<GpioLineInfo> {
-        let Ok(line) = line.try_into() else {
+        let Ok(line_u32) = line.try_into() else {
+            return Err(IoError::new(std::io::ErrorKind::InvalidInput, "Invalid GPIO line number"));
+        };
+
+        let raw =
+            self.backend.get_line_info(self.fd, line_u32).map_err(os_error("get line info", self.line_target(line)))?;
+        Ok(raw.into())
+    }
+
+    /// Indicates whether a GPIO line is in use, returning its consumer label if so.
+    ///
+    /// A line is in use if it is requested by a process or claimed by the kernel (e.g. by a device tree overlay);
+    /// lines claimed by the kernel may have an empty consumer label. This is based on the
+    /// [`Used`][GpioLineFlag::Used] flag, and is useful for telling which program is holding a line: line
+    /// requests cannot be released from outside of the process holding them.
+    ///
+    /// # Errors
+    /// If the line information cannot be read, an [`IoError`][std::io::Error] is returned as for
+    /// [`get_line_info`][Self::get_line_info].
+    pub fn line_is_used(&self, line: usize) -> IoResult<Option<String>> {
+        let info = self.get_line_info(line)?;
+        Ok(info.flags.contains(GpioLineFlag::Used).then_some(info.consumer))
+    }
+
+    /// Describes a line on this chip for error messages.
+    fn line_target(&self, line: usize) -> String {
+        format!("{} line {line}", self.path.display())
+    }
+
+    /// Write the chip information and a table of all of its lines to `w`, in the format used by `gpioinfo`.
+    ///
+    /// This is meant for diagnostics such as bug reports. Each line is listed with its name, consumer, and flags,
+    /// followed by any attributes on separate lines. A line whose information cannot be read is listed with the
+    /// error instead, and the remaining lines are still written.
+    ///
+    /// # Errors
+    /// If the chip information cannot be read, the error is returned as for
+    /// [`get_chip_info`][Self::get_chip_info]. If writing to `w` fails, the underlying [`IoError`][std::io::Error] is
+    /// returned. If any line's information cannot be read, the whole table is still written, and then an
+    /// [`IoError`][std::io::Error] naming the failed lines is returned with the kind of the first failure.
+    pub fn dump(&self, mut w: impl Write) -> IoResult<()> {
+        let chip_info = self.get_chip_info()?;
+        writeln!(w, "Chip: {} {chip_info}", self.path.display())?;
+        writeln!(w, "    Line   Offset Name                 Consumer             Flags")?;
+        let mut failed = vec![];
+        let mut kind = None;
+        for line in 0..chip_info.lines {
+            match self.get_line_info(line) {
+                Ok(info) => {
+                    writeln!(
+                        w,
+                        "    {:>6} {:>6} {:<20} {:<20} {}",
+                        line, info.offset, info.name, info.consumer, info.flags
+                    )?;
+                    for attr in &info.attrs {
+                        writeln!(w, "{:60}{attr}", "")?;
+                    }
+                }
+                Err(e) => {
+                    writeln!(w, "    {line:>6} Error: {e}")?;
+                    kind.get_or_insert(e.kind());
+                    failed.push(line.to_string());
+                }
+            }
+        }
+
+        match kind {
+            None => Ok(()),
+            Some(kind) => Err(IoError::new(
+                kind,
+                format!("Failed to read GPIO line info on {}: lines {}", self.path.display(), failed.join(", ")),
+            )),
+        }
+    }
+
+    /// Get information about all lines on this chip, in offset order.
+    ///
+    /// # Errors
+    /// If the chip information or any line's information cannot be read, a [`ListLinesError`] is returned containing
+    /// the lines read before the failure along with the underlying [`IoError`][std::io::Error].
+    pub fn list_lines(&self) -> Result<Vec<GpioLineInfo>, ListLinesError> {
+        let mut lines = vec![];
+        let num_lines = match self.num_lines() {
+            Ok(num_lines) => num_lines,
+            Err(error) => {
+                return Err(ListLinesError {
+                    lines,
+                    error,
+                });
+            }
+        };
+
+        lines.reserve(num_lines);
+        for line in 0..num_lines {
+            match self.get_line_info(line) {
+                Ok(info) => lines.push(info),
+                Err(error) => {
+                    return Err(ListLinesError {
+                        lines,
+                        error,
+                    });
+                }
+            }
+        }
+
+        Ok(lines)
+    }
+
+    /// Returns an iterator over information about each line on this chip, in offset order.
+    ///
+    /// Unlike [`list_lines`][Self::list_lines], each line's information is read only when the iterator reaches it,
+    /// so stopping early (e.g. with `break` or [`find`][Iterator::find]) skips reading the remaining lines. The offset
+    /// of each line is in its [`offset`][GpioLineInfo::offset] field.
+    ///
+    /// If the chip information or a line's information cannot be read, the error is yielded in place of the line
+    /// and the iteration ends.
+    pub fn lines(&self) -> GpioLines<'_> {
+        GpioLines {
+            gpio: self,
+            next: 0,
+            num_lines: None,
+        }
+    }
+
+    /// Find the offset of the line with the given name.
+    ///
+    /// Line names are compared exactly. If multiple lines share a name, the lowest offset is returned.
+    ///
+    /// # Errors
+    /// If no line has the given name, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`NotFound`][std::io::ErrorKind::NotFound] wrapping a [`GpioError::LineNotFound`].
+    ///
+    /// If the chip or line information cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn find_line_by_name(&self, name: &str) -> IoResult<usize> {
+        for line in 0..self.num_lines()? {
+            if self.get_line_info(line)?.name == name {
+                return Ok(line);
+            }
+        }
+
+        Err(IoError::new(std::io::ErrorKind::NotFound, GpioError::LineNotFound(name.to_string())))
+    }
+
+    /// Get information about all lines whose names start with `prefix`, in offset order.
+    ///
+    /// If no line matches, an empty list is returned.
+    ///
+    /// # Errors
+    /// If the chip or line information cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn find_lines_by_prefix(&self, prefix: &str) -> IoResult<Vec<GpioLineInfo>> {
+        let mut lines = self.list_lines()?;
+        lines.retain(|line| line.name.starts_with(prefix));
+        Ok(lines)
+    }
+
+    /// Get information about a GPIO line and start watching it for changes.
+    ///
+    /// Once a line is watched, changes to it (being requested, released, or reconfigured by any process) can be
+    /// read with [`read_line_info_changed`][Self::read_line_info_changed].
+    ///
+    /// # Errors
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`]. In particular, if the line is already being watched on this chip, the kind is
+    /// [`ResourceBusy`][std::io::ErrorKind::ResourceBusy] and the OS error is `EBUSY`.
+    pub fn watch_line_info(&self, line: usize) -> IoResult<GpioLineInfo> {
+        let Ok(line_u32) = line.try_into() else {
             return Err(IoError::new(std::io::ErrorKind::InvalidInput, "Invalid GPIO line number"));
         };
 
-        let raw = gpio_ioctl::RawGpioV2LineInfo::get_line_info(self.fd, line)?;
+        let raw = self
+            .backend
+            .watch_line_info(self.fd, line_u32)
+            .map_err(os_error("watch line info", self.line_target(line)))?;
         Ok(raw.into())
     }
+
+    /// Stop watching a GPIO line for changes.
+    ///
+    /// # Errors
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn unwatch_line_info(&self, line: usize) -> IoResult<()> {
+        let Ok(line_u32) = line.try_into() else {
+            return Err(IoError::new(std::io::ErrorKind::InvalidInput, "Invalid GPIO line number"));
+        };
+
+        self.backend.unwatch_line_info(self.fd, line_u32).map_err(os_error("unwatch line info", self.line_target(line)))
+    }
+
+    /// Start watching every line on the chip for changes, e.g. to monitor the chip for contention.
+    ///
+    /// Afterwards, [`read_line_info_changed`][Self::read_line_info_changed] reports changes to any line. Lines that
+    /// are already being watched on this chip (which the kernel rejects with `EBUSY`) are skipped.
+    ///
+    /// # Errors
+    /// If the chip information cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    ///
+    /// If watching a line fails for any other reason, the lines watched by this call are unwatched and the error is
+    /// returned as for [`watch_line_info`][Self::watch_line_info].
+    pub fn watch_all_lines(&self) -> IoResult<()> {
+        let mut watched = vec![];
+        for line in 0..self.num_lines()? {
+            match self.watch_line_info(line) {
+                Ok(_) => watched.push(line),
+                Err(e) if GpioError::errno(&e) == Some(libc::EBUSY) => (),
+                Err(e) => {
+                    for &line in &watched {
+                        let _ = self.unwatch_line_info(line);
+                    }
+                    return Err(e);
+                }
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Stop watching every line on the chip for changes, undoing [`watch_all_lines`][Self::watch_all_lines].
+    ///
+    /// Lines that are not being watched (which the kernel rejects with `EBUSY`) are skipped.
+    ///
+    /// # Errors
+    /// If the chip information cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    ///
+    /// If unwatching a line fails for any other reason, the remaining lines are still unwatched and the first error is
+    /// returned as for [`unwatch_line_info`][Self::unwatch_line_info].
+    pub fn unwatch_all_lines(&self) -> IoResult<()> {
+        let mut result = Ok(());
+        for line in 0..self.num_lines()? {
+            match self.unwatch_line_info(line) {
+                Ok(()) => (),
+                Err(e) if GpioError::errno(&e) == Some(libc::EBUSY) => (),
+                Err(e) => {
+                    if result.is_ok() {
+                        result = Err(e);
+                    }
+                }
+            }
+        }
+
+        result
+    }
+
+    /// Read the next change to a watched line, blocking until one is available.
+    ///
+    /// # Errors
+    /// If the read fails, the underlying [`IoError`][std::io::Error] is returned.
+    ///
+    /// If the kernel returns less than a full record, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`UnexpectedEof`][std::io::ErrorKind::UnexpectedEof] wrapping a [`GpioError::ShortRead`].
+    pub fn read_line_info_changed(&self) -> IoResult<GpioLineInfoChanged> {
+        self.backend.read_line_info_changed(self.fd)?.try_into()
+    }
+
+    /// Wait for the next change to a watched line, returning early if `cancel` is cancelled.
+    ///
+    /// If `cancel` has already been cancelled, this returns immediately without reading a change. If a change is
+    /// pending at the same time the token is cancelled, the change is left unread.
+    ///
+    /// # Errors
+    /// If `cancel` is cancelled, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`Other`][std::io::ErrorKind::Other] wrapping a [`GpioError::Cancelled`].
+    ///
+    /// Otherwise, errors are the same as for [`read_line_info_changed`][Self::read_line_info_changed].
+    pub fn wait_line_info_changed(&self, cancel: &CancelToken) -> IoResult<GpioLineInfoChanged> {
+        wait_readable(self.fd, cancel)?;
+        self.read_line_info_changed()
+    }
+
+    /// Watch the lines at `offsets` and stream changes to them from a background thread.
+    ///
+    /// Changes to all watched lines on a chip are read from the chip's single file descriptor, so one thread reads
+    /// them all in the order the kernel reports them; use the `offset` of each change's `info` to tell the lines
+    /// apart. Changes to lines watched separately with [`watch_line_info`][Self::watch_line_info] are delivered as
+    /// well, and reading changes with [`read_line_info_changed`][Self::read_line_info_changed] while the stream is
+    /// running would take them from the stream.
+    ///
+    /// Changes are delivered in order on the returned channel. If reading fails, the error is delivered as the final
+    /// item. The channel is closed when `cancel` is cancelled or after an error, and the lines are unwatched. As
+    /// with [`GpioLineRequest::events`], the channel holds up to `buffer` changes before the reader thread blocks and
+    /// the kernel's buffer takes over, and dropping the receiver also stops the thread.
+    ///
+    /// # Errors
+    /// If any line cannot be watched, the lines already watched are unwatched and the error is returned as for
+    /// [`watch_line_info`][Self::watch_line_info]. If the file descriptor cannot be duplicated or the thread cannot
+    /// be spawned, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn watch_line_info_events(
+        &self,
+        cancel: &CancelToken,
+        offsets: &[usize],
+        buffer: usize,
+    ) -> IoResult<Receiver<IoResult<GpioLineInfoChanged>>> {
+        for (i, &offset) in offsets.iter().enumerate() {
+            if let Err(e) = self.watch_line_info(offset) {
+                for &watched in &offsets[..i] {
+                    let _ = self.unwatch_line_info(watched);
+                }
+                return Err(e);
+            }
+        }
+
+        let fd = match self.as_fd().try_clone_to_owned() {
+            Ok(fd) => fd,
+            Err(e) => {
+                for &watched in offsets {
+                    let _ = self.unwatch_line_info(watched);
+                }
+                return Err(e);
+            }
+        };
+        let thread_offsets = offsets.to_vec();
+        let backend = self.backend.clone();
+        let cancel = cancel.clone();
+        let (sender, receiver) = sync_channel(buffer);
+
+        let spawned = Builder::new().name("gpio-line-info".to_string()).spawn(move || {
+            loop {
+                let result = wait_readable(fd.as_raw_fd(), &cancel)
+                    .and_then(|_| backend.read_line_info_changed(fd.as_raw_fd())?.try_into());
+
+                match result {
+                    Ok(change) => {
+                        if sender.send(Ok(change)).is_err() {
+                            break;
+                        }
+                    }
+                    Err(_) if cancel.is_cancelled() => break,
+                    Err(e) => {
+                        let _ = sender.send(Err(e));
+                        break;
+                    }
+                }
+            }
+
+            for offset in thread_offsets {
+                if let Ok(offset) = offset.try_into() {
+                    let _ = backend.unwatch_line_info(fd.as_raw_fd(), offset);
+                }
+            }
+        });
+
+        if let Err(e) = spawned {
+            for &watched in offsets {
+                let _ = self.unwatch_line_info(watched);
+            }
+            return Err(e);
+        }
+
+        Ok(receiver)
+    }
+
+    /// Request a set of lines for input or output.
+    ///
+    /// On kernels without the v2 uAPI (see [`supports_v2`][Self::supports_v2]), the lines are requested with the v1
+    /// uAPI instead, and the returned request uses v1 ioctls throughout.
+    ///
+    /// # Arguments
+    /// * `offsets`: The chip offsets of the lines to request. At most [`MAX_GPIO_LINES_PER_CHIP`] lines may be
+    ///   requested at once.
+    /// * `config`: The configuration to apply to the requested lines.
+    ///
+    /// # Errors
+    /// If no lines or more than [`MAX_GPIO_LINES_PER_CHIP`] lines are specified, an [`IoError`][std::io::Error] is
+    /// returned with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a
+    /// [`GpioError::NoLines`] or [`GpioError::TooManyLines`].
+    ///
+    /// If `config` refers to a line index beyond the requested lines or needs more attributes than the kernel
+    /// supports, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`] or
+    /// [`GpioError::TooManyAttributes`].
+    ///
+    /// If the kernel lacks the v2 uAPI and `config` uses a feature the v1 uAPI does not have (debounce, edge
+    /// detection, event clock selection, or per-line flags), an [`IoError`][std::io::Error] is returned with a kind
+    /// of [`Unsupported`][std::io::ErrorKind::Unsupported] wrapping a [`GpioError::UnsupportedV1`].
+    ///
+    /// If the request ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned
+    /// wrapping a [`GpioError::Os`].
+    pub fn request_lines(&self, offsets: &[usize], config: &GpioLineConfig) -> IoResult<GpioLineRequest> {
+        GpioLineRequest::new(self, offsets, config)
+    }
+
+    /// Request lines by name rather than by offset, e.g. `["GPIO17", "GPIO27"]`.
+    ///
+    /// Offsets can differ between boards that share line names (such as Raspberry Pi models), so this is more
+    /// portable than [`request_lines`][Self::request_lines]. Names are resolved as with
+    /// [`find_line_by_name`][Self::find_line_by_name], reading the chip's line information once for all of them; the
+    /// lines are then requested in the order given, so per-line settings in `config` are indexed by position in
+    /// `names`. The request's [`names`][GpioLineRequest::names] are the names given here, so its values can be read
+    /// back with [`read_by_name`][GpioLineRequest::read_by_name].
+    ///
+    /// # Errors
+    /// If a name does not match any line, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`NotFound`][std::io::ErrorKind::NotFound] wrapping a [`GpioError::LineNotFound`] with the first such name.
+    ///
+    /// If the line information cannot be read, the underlying [`IoError`][std::io::Error] is returned. Otherwise,
+    /// errors are returned as for [`request_lines`][Self::request_lines].
+    pub fn request_lines_by_name(&self, names: &[&str], config: &GpioLineConfig) -> IoResult<GpioLineRequest> {
+        let lines = self.list_lines()?;
+        let mut offsets = Vec::with_capacity(names.len());
+        for &name in names {
+            let Some(line) = lines.iter().position(|info| info.name == name) else {
+                return Err(IoError::new(std::io::ErrorKind::NotFound, GpioError::LineNotFound(name.to_string())));
+            };
+            offsets.push(line);
+        }
+
+        let mut request = self.request_lines(&offsets, config)?;
+        request.set_names(names);
+        Ok(request)
+    }
+
+    /// Request `count` consecutive lines starting at chip offset `start`.
+    ///
+    /// This is equivalent to calling [`request_lines`][Self::request_lines] with the offsets `start..start + count`,
+    /// so index `n` in the request is chip offset `start + n`.
+    ///
+    /// # Errors
+    /// If `count` is zero or more than [`MAX_GPIO_LINES_PER_CHIP`], an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::NoLines`] or
+    /// [`GpioError::TooManyLines`].
+    ///
+    /// If the range extends past the last line of the chip, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineRangeOutOfRange`].
+    ///
+    /// Otherwise, errors are returned as for [`request_lines`][Self::request_lines].
+    pub fn request_range(&self, start: usize, count: usize, config: &GpioLineConfig) -> IoResult<GpioLineRequest> {
+        if count == 0 {
+            return Err(IoError::new(std::io::ErrorKind::InvalidInput, GpioError::NoLines));
+        }
+
+        if count > MAX_GPIO_LINES_PER_CHIP {
+            return Err(IoError::new(std::io::ErrorKind::InvalidInput, GpioError::TooManyLines(count)));
+        }
+
+        let lines = self.num_lines()?;
+        if start.checked_add(count).map_or(true, |end| end > lines) {
+            return Err(IoError::new(
+                std::io::ErrorKind::InvalidInput,
+                GpioError::LineRangeOutOfRange(start, count, lines),
+            ));
+        }
+
+        let offsets: Vec<usize> = (start..start + count).collect();
+        self.request_lines(&offsets, config)
+    }
+
+    /// Set or clear non-blocking mode on the chip's file descriptor.
+    ///
+    /// This is intended for callers that poll the descriptor (see [`AsRawFd`]) from their own event loop. Mixing
+    /// this with the blocking methods of this type, such as [`read_line_info_changed`][Self::read_line_info_changed],
+    /// is unsupported.
+    ///
+    /// # Errors
+    /// If the file descriptor flags cannot be read or changed, the underlying [`IoError`][std::io::Error] is
+    /// returned.
+    pub fn set_nonblocking(&self, nonblocking: bool) -> IoResult<()> {
+        set_fd_nonblocking(self.fd, nonblocking)
+    }
+}
+
+impl AsRawFd for Gpio {
+    fn as_raw_fd(&self) -> RawFd {
+        self.fd
+    }
+}
+
+impl AsFd for Gpio {
+    fn as_fd(&self) -> BorrowedFd<'_> {
+        unsafe { BorrowedFd::borrow_raw(self.fd) }
+    }
 }
 
 impl Drop for Gpio {
@@ -170,6 +850,15 @@ impl From<gpio_ioctl::RawGpioChipInfo> for GpioChipInfo {
     }
 }
 
+/// Formats the chip information as `name="gpiochip0" label="pinctrl-bcm2835" lines=54`.
+///
+/// The name and label are quoted and escaped so embedded special characters are visible.
+impl Display for GpioChipInfo {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        write!(f, "name={:?} label={:?} lines={}", self.name, self.label, self.lines)
+    }
+}
+
 /// GPIO line information.
 #[derive(Clone, Debug)]
 pub struct GpioLineInfo {
@@ -228,10 +917,89 @@ impl From<gpio_ioctl::RawGpioV2LineInfo> for GpioLineInfo {
     }
 }
 
+impl GpioLineInfo {
+    /// Returns the line's debounce period, if it has a [`DebouncePeriod`][GpioLineAttr::DebouncePeriod] attribute.
+    /// The kernel reports microsecond resolution.
+    pub fn debounce_period(&self) -> Option<Duration> {
+        self.attrs.iter().find_map(|attr| match attr {
+            GpioLineAttr::DebouncePeriod(period) => Some(*period),
+            _ => None,
+        })
+    }
+
+    /// Returns the output values bitmap of the line's [`Values`][GpioLineAttr::Values] attribute, if it has one.
+    pub fn output_values(&self) -> Option<u64> {
+        self.attrs.iter().find_map(|attr| match attr {
+            GpioLineAttr::Values(values) => Some(*values),
+            _ => None,
+        })
+    }
+
+    /// Returns the flags in effect for the line: those of its [`Flags`][GpioLineAttr::Flags] attribute, which
+    /// overrides the line's flags, if it has one, or [`flags`][Self::flags] otherwise.
+    pub fn effective_flags(&self) -> GpioLineFlags {
+        self.attrs
+            .iter()
+            .find_map(|attr| match attr {
+                GpioLineAttr::Flags(flags) => Some(*flags),
+                _ => None,
+            })
+            .unwrap_or(self.flags)
+    }
+}
+
 /// Flags associated with a GPIO line.
-#[derive(Clone, Copy, Debug, Default)]
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
 pub struct GpioLineFlags(u64);
 
+impl GpioLineFlags {
+    /// Both [`EdgeRising`][GpioLineFlag::EdgeRising] and [`EdgeFalling`][GpioLineFlag::EdgeFalling], for detecting
+    /// every edge. Which edge fired is still reported by each event's [`kind`][GpioLineEvent::kind].
+    pub const EDGE_BOTH: Self = Self(GpioLineFlag::EdgeRising as u64 | GpioLineFlag::EdgeFalling as u64);
+
+    /// Indicates whether `flag` is set.
+    #[inline(always)]
+    pub fn contains(&self, flag: GpioLineFlag) -> bool {
+        self.0 & flag as u64 != 0
+    }
+
+    /// Create a set of flags from the raw `GPIO_V2_LINE_FLAG_*` bitmap.
+    #[inline(always)]
+    pub fn from_bits(bits: u64) -> Self {
+        Self(bits)
+    }
+
+    /// Returns the raw `GPIO_V2_LINE_FLAG_*` bitmap.
+    #[inline(always)]
+    pub fn bits(&self) -> u64 {
+        self.0
+    }
+
+    /// Indicates whether the line is configured as an input.
+    #[inline(always)]
+    pub fn is_input(&self) -> bool {
+        self.contains(GpioLineFlag::Input)
+    }
+
+    /// Indicates whether the line is configured as an output.
+    #[inline(always)]
+    pub fn is_output(&self) -> bool {
+        self.contains(GpioLineFlag::Output)
+    }
+
+    /// Indicates whether the line is in use by the kernel or another process.
+    #[inline(always)]
+    pub fn is_used(&self) -> bool {
+        self.contains(GpioLineFlag::Used)
+    }
+
+    /// Indicates whether the line is active low.
+    #[inline(always)]
+    pub fn is_active_low(&self) -> bool {
+        self.contains(GpioLineFlag::ActiveLow)
+    }
+}
+
 impl BitAnd for GpioLineFlags {
     type Output = Self;
 
@@ -289,15 +1057,26 @@ impl Not for GpioLineFlags {
     }
 }
 
+/// Formats the flags as their names joined by ` | `, e.g. `Used | Input | EdgeBoth`, or `None` if no flags are set.
+/// [`EdgeRising`][GpioLineFlag::EdgeRising] and [`EdgeFalling`][GpioLineFlag::EdgeFalling] together are shown as
+/// `EdgeBoth`.
 impl Display for GpioLineFlags {
     fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
         if self.0 == 0 {
             f.write_str("None")
         } else {
+            // Both edge flags together are shown as EdgeBoth, in place of EdgeRising.
+            let edge_both = self.0 & Self::EDGE_BOTH.0 == Self::EDGE_BOTH.0;
             let mut parts = vec![];
             for flag in GpioLineFlag::all() {
-                if self.0 & (*flag as u64) != 0 {
-                    parts.push(flag.to_string());
+                if self.0 & (*flag as u64) == 0 {
+                    continue;
+                }
+
+                match flag {
+                    GpioLineFlag::EdgeRising if edge_both => parts.push("EdgeBoth".to_string()),
+                    GpioLineFlag::EdgeFalling if edge_both => (),
+                    _ => parts.push(flag.to_string()),
                 }
             }
 
@@ -459,19 +1238,519 @@ impl Display for GpioLineAttr {
     }
 }
 
+/// Error returned by [`Gpio::list_lines`] when a line's information cannot be read.
+#[derive(Debug)]
+pub struct ListLinesError {
+    /// Information about the lines read before the failure, in offset order.
+    pub lines: Vec<GpioLineInfo>,
+
+    /// The error that stopped the listing.
+    pub error: IoError,
+}
+
+impl Display for ListLinesError {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        write!(f, "Failed to read GPIO line {}: {}", self.lines.len(), self.error)
+    }
+}
+
+impl Error for ListLinesError {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        Some(&self.error)
+    }
+}
+
+impl From<ListLinesError> for IoError {
+    fn from(e: ListLinesError) -> Self {
+        e.error
+    }
+}
+
+/// Iterator over information about the lines of a chip, returned by [`Gpio::lines`].
+#[derive(Debug)]
+pub struct GpioLines<'a> {
+    gpio: &'a Gpio,
+
+    /// The offset of the next line to read.
+    next: usize,
+
+    /// The number of lines on the chip, read on the first call to `next`, or 0 once an error has been yielded.
+    num_lines: Option<usize>,
+}
+
+impl Iterator for GpioLines<'_> {
+    type Item = IoResult<GpioLineInfo>;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        let num_lines = match self.num_lines {
+            Some(num_lines) => num_lines,
+            None => match self.gpio.num_lines() {
+                Ok(num_lines) => *self.num_lines.insert(num_lines),
+                Err(e) => {
+                    self.num_lines = Some(0);
+                    return Some(Err(e));
+                }
+            },
+        };
+
+        if self.next >= num_lines {
+            return None;
+        }
+
+        let result = self.gpio.get_line_info(self.next);
+        self.next += 1;
+        if result.is_err() {
+            self.num_lines = Some(0);
+        }
+        Some(result)
+    }
+}
+
+impl FusedIterator for GpioLines<'_> {}
+
 /// Errors returned by this driver.
 #[derive(Debug)]
 pub enum GpioError {
     /// The underlying file is not a character device.
     NotCharDev,
+
+    /// A line request did not specify any lines.
+    NoLines,
+
+    /// A line request specified more than [`MAX_GPIO_LINES_PER_CHIP`] lines.
+    TooManyLines(usize),
+
+    /// A line mask selected lines beyond those requested.
+    InvalidLineMask(u64),
+
+    /// A line index was not less than the number of requested lines.
+    LineIndexOutOfRange(usize),
+
+    /// A read returned fewer bytes (the first value) than the size of the expected record (the second value).
+    ShortRead(usize, usize),
+
+    /// A buffer of the given size (the first value) was too small to hold a record of the second value's size.
+    BufferTooSmall(usize, usize),
+
+    /// The kernel reported an event with an unknown id.
+    UnknownEventId(u32),
+
+    /// The operation was cancelled via a [`CancelToken`].
+    Cancelled,
+
+    /// A wait timed out.
+    TimedOut,
+
+    /// The kernel dropped the given number of events because they were not read quickly enough.
+    EventsDropped(u32),
+
+    /// No line with the given name exists on the chip.
+    LineNotFound(String),
+
+    /// No GPIO chip with the given label exists.
+    ChipNotFound(String),
+
+    /// A line configuration required more attributes than the kernel supports.
+    TooManyAttributes(usize),
+
+    /// A line configuration was invalid for the given reason.
+    InvalidLineConfig(&'static str),
+
+    /// The underlying character device is not a GPIO chip.
+    NotGpioChip,
+
+    /// A range of lines (starting offset and count) extended past the number of lines on the chip (the third value).
+    LineRangeOutOfRange(usize, usize, usize),
+
+    /// A line configuration asked for a feature (described by the value) that the kernel's v1 uAPI lacks.
+    UnsupportedV1(&'static str),
+
+    /// An operation on a GPIO chip or line failed with an OS error.
+    Os {
+        /// The operation that failed, e.g. `"get line info"`.
+        op: &'static str,
+
+        /// The chip path and, where applicable, the lines the operation was applied to.
+        target: String,
+
+        /// The underlying OS error.
+        error: IoError,
+    },
+}
+
+impl GpioError {
+    /// Returns the OS error code (errno) of an error returned by this crate, if any.
+    ///
+    /// This looks through a wrapped [`GpioError::Os`], so it can be used to match specific codes such as `EBUSY`
+    /// regardless of whether the error carries context.
+    pub fn errno(error: &IoError) -> Option<i32> {
+        match error.get_ref().and_then(|e| e.downcast_ref::<GpioError>()) {
+            Some(GpioError::Os {
+                error,
+                ..
+            }) => error.raw_os_error(),
+            _ => error.raw_os_error(),
+        }
+    }
 }
 
 impl Display for GpioError {
     fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
         match self {
             Self::NotCharDev => write!(f, "GPIO device is not a character device"),
+            Self::NoLines => write!(f, "No GPIO lines specified"),
+            Self::TooManyLines(n) => {
+                write!(f, "Too many GPIO lines requested: {n} (maximum is {MAX_GPIO_LINES_PER_CHIP})")
+            }
+            Self::InvalidLineMask(mask) => write!(f, "GPIO line mask selects unrequested lines: {mask:#x}"),
+            Self::LineIndexOutOfRange(index) => write!(f, "GPIO line index out of range: {index}"),
+            Self::ShortRead(actual, expected) => {
+                write!(f, "Short read from GPIO device: got {actual} bytes, expected {expected}")
+            }
+            Self::BufferTooSmall(actual, expected) => {
+                write!(f, "Buffer too small for GPIO record: {actual} bytes, need at least {expected}")
+            }
+            Self::UnknownEventId(id) => write!(f, "Unknown GPIO line event ID: {id}"),
+            Self::Cancelled => write!(f, "Operation cancelled"),
+            Self::TimedOut => write!(f, "Operation timed out"),
+            Self::EventsDropped(n) => write!(f, "GPIO line events dropped: {n}"),
+            Self::LineNotFound(name) => write!(f, "GPIO line not found: {name:?}"),
+            Self::ChipNotFound(label) => write!(f, "GPIO chip not found: {label:?}"),
+            Self::TooManyAttributes(n) => write!(
+                f,
+                "GPIO line configuration needs too many attributes: {n} (maximum is {})",
+                gpio_ioctl::GPIO_V2_LINE_NUM_ATTRS_MAX
+            ),
+            Self::InvalidLineConfig(reason) => write!(f, "Invalid GPIO line configuration: {reason}"),
+            Self::NotGpioChip => write!(f, "Device is not a GPIO character device"),
+            Self::LineRangeOutOfRange(start, count, lines) => {
+                write!(f, "GPIO line range out of range: {count} lines from {start} (chip has {lines} lines)")
+            }
+            Self::UnsupportedV1(feature) => write!(f, "Not supported by the GPIO v1 uAPI: {feature}"),
+            Self::Os {
+                op,
+                target,
+                error,
+            } => write!(f, "Failed to {op} on {target}: {error}"),
+        }
+    }
+}
+
+impl Error for GpioError {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        match self {
+            Self::Os {
+                error,
+                ..
+            } => Some(error),
+            _ => None,
         }
     }
 }
 
-impl Error for GpioError {}
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        backend::fake::{FakeChip, fake_gpio},
+        pretty_assertions::assert_eq,
+        std::io::ErrorKind,
+    };
+
+    #[test]
+    fn test_flag_predicates() {
+        let flags = GpioLineFlag::Used | GpioLineFlag::Output | GpioLineFlag::ActiveLow.into();
+        assert!(flags.is_used());
+        assert!(flags.is_output());
+        assert!(flags.is_active_low());
+        assert!(!flags.is_input());
+
+        let flags = (GpioLineFlags::from_bits(flags.bits()) ^ GpioLineFlag::Output.into()) | GpioLineFlag::Input.into();
+        assert!(flags.is_input());
+        assert!(!flags.is_output());
+        assert!(flags.is_used());
+
+        let flags = GpioLineFlags::default();
+        assert!(!flags.is_input() && !flags.is_output() && !flags.is_used() && !flags.is_active_low());
+        assert_eq!(flags.bits(), 0);
+        assert_eq!(flags.to_string(), "None");
+    }
+
+    #[test]
+    fn test_edge_both() {
+        let flags = GpioLineFlag::Input | GpioLineFlag::EdgeRising;
+        assert_eq!(flags.to_string(), "Input | EdgeRising");
+        let flags = flags | GpioLineFlag::EdgeFalling.into();
+        assert_eq!(flags, GpioLineFlags::from(GpioLineFlag::Input) | GpioLineFlags::EDGE_BOTH);
+        assert_eq!(flags.to_string(), "Input | EdgeBoth");
+
+        // The event id, not the request flags, says which edge fired.
+        for (id, kind) in [
+            (gpio_ioctl::GPIO_V2_LINE_EVENT_RISING_EDGE, GpioLineEventKind::RisingEdge),
+            (gpio_ioctl::GPIO_V2_LINE_EVENT_FALLING_EDGE, GpioLineEventKind::FallingEdge),
+        ] {
+            let raw = gpio_ioctl::RawGpioV2LineEvent {
+                id,
+                ..Default::default()
+            };
+            assert_eq!(GpioLineEvent::from_raw(raw, GpioEventClock::Monotonic).unwrap().kind, kind);
+        }
+    }
+
+    #[test]
+    fn test_line_info_attrs() {
+        let mut info = GpioLineInfo {
+            name: "GPIO17".to_string(),
+            consumer: String::new(),
+            offset: 17,
+            flags: GpioLineFlag::Input.into(),
+            attrs: Vec::new(),
+        };
+        assert_eq!(info.debounce_period(), None);
+        assert_eq!(info.output_values(), None);
+        assert_eq!(info.effective_flags(), info.flags);
+
+        info.attrs = vec![
+            GpioLineAttr::DebouncePeriod(Duration::from_micros(5000)),
+            GpioLineAttr::Values(0b101),
+            GpioLineAttr::Flags(GpioLineFlag::Output | GpioLineFlag::ActiveLow),
+        ];
+        assert_eq!(info.debounce_period(), Some(Duration::from_millis(5)));
+        assert_eq!(info.output_values(), Some(0b101));
+        assert_eq!(info.effective_flags(), GpioLineFlag::Output | GpioLineFlag::ActiveLow);
+
+        // Decoding a raw line info keeps only the attributes the kernel reported.
+        let mut raw = gpio_ioctl::RawGpioV2LineInfo {
+            num_attrs: 1,
+            ..Default::default()
+        };
+        raw.attrs[0].id = gpio_ioctl::GPIO_V2_LINE_ATTR_ID_DEBOUNCE;
+        raw.attrs[0].data.debounce_period_us = 250;
+        let info = GpioLineInfo::from(raw);
+        assert_eq!(info.debounce_period(), Some(Duration::from_micros(250)));
+        assert_eq!(info.output_values(), None);
+    }
+
+    #[test]
+    fn test_lines() {
+        let gpio = fake_gpio();
+        let names: Vec<String> = gpio.lines().map(|info| info.unwrap().name).collect();
+        assert_eq!(names, ["GPIO0", "GPIO1", "GPIO2", "GPIO3", "LED"]);
+
+        let led = gpio.lines().find(|info| info.as_ref().is_ok_and(|info| info.name == "LED"));
+        assert_eq!(led.unwrap().unwrap().offset, 4);
+
+        let offsets: Vec<usize> = gpio.lines().take(2).map(|info| info.unwrap().offset).collect();
+        assert_eq!(offsets, [0, 1]);
+    }
+
+    #[test]
+    fn test_request_lines_marks_lines_used() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_consumer("test").with_direction(GpioLineDirection::Output);
+        let request = gpio.request_lines(&[1, 3], &config).unwrap();
+        assert_eq!(request.offsets(), &[1, 3]);
+
+        let info = gpio.get_line_info(3).unwrap();
+        assert_eq!(info.consumer, "test");
+        assert!(info.flags.contains(GpioLineFlag::Used));
+        assert!(info.flags.contains(GpioLineFlag::Output));
+        assert!(!gpio.get_line_info(2).unwrap().flags.contains(GpioLineFlag::Used));
+
+        assert_eq!(gpio.line_is_used(1).unwrap().as_deref(), Some("test"));
+        assert_eq!(gpio.line_is_used(2).unwrap(), None);
+
+        drop(request);
+        let info = gpio.get_line_info(3).unwrap();
+        assert_eq!(info.consumer, "");
+        assert!(!info.flags.contains(GpioLineFlag::Used));
+    }
+
+    #[test]
+    fn test_bias_reported() {
+        let gpio = fake_gpio();
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::BiasPullUp);
+        let _request = gpio.request_lines(&[0], &config).unwrap();
+
+        let flags = gpio.get_line_info(0).unwrap().flags;
+        assert!(flags.contains(GpioLineFlag::Input));
+        assert!(flags.contains(GpioLineFlag::BiasPullUp));
+        assert!(!flags.contains(GpioLineFlag::BiasPullDown));
+    }
+
+    #[test]
+    fn test_dump() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_consumer("dump").with_direction(GpioLineDirection::Output);
+        let _request = gpio.request_lines(&[4], &config).unwrap();
+
+        let mut out = vec![];
+        gpio.dump(&mut out).unwrap();
+        let out = String::from_utf8(out).unwrap();
+        let lines: Vec<_> = out.lines().collect();
+        assert_eq!(lines.len(), 7);
+        assert_eq!(lines[0], r#"Chip: /dev/gpiochip-fake name="gpiochip-fake" label="fake" lines=5"#);
+        assert_eq!(lines[6], "         4      4 LED                  dump                 Used | Output");
+    }
+
+    #[test]
+    fn test_dump_unreadable_lines() {
+        let chip = Arc::new(FakeChip::new("fake", &["GPIO0", "GPIO1", "GPIO2", "GPIO3"]));
+        chip.fail_line_info(1, libc::EACCES);
+        chip.fail_line_info(3, libc::EIO);
+        let gpio = Gpio::with_backend(chip);
+
+        // The whole table is written before the failed lines are reported.
+        let mut out = vec![];
+        let e = gpio.dump(&mut out).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::PermissionDenied);
+        assert_eq!(e.to_string(), "Failed to read GPIO line info on /dev/gpiochip-fake: lines 1, 3");
+
+        let out = String::from_utf8(out).unwrap();
+        let lines: Vec<_> = out.lines().collect();
+        assert_eq!(lines.len(), 6);
+        assert!(lines[3].starts_with("         1 Error: "));
+        assert!(lines[4].starts_with("         2      2 GPIO2"));
+        assert!(lines[5].starts_with("         3 Error: "));
+    }
+
+    #[test]
+    fn test_request_busy_line() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Input);
+        let _request = gpio.request_lines(&[0, 1], &config).unwrap();
+
+        let e = gpio.request_lines(&[1, 2], &config).unwrap_err();
+        assert_eq!(e.kind(), IoError::from_raw_os_error(libc::EBUSY).kind());
+        assert_eq!(crate::GpioError::errno(&e), Some(libc::EBUSY));
+    }
+
+    #[test]
+    fn test_v1_fallback() {
+        let gpio = Gpio::with_backend(Arc::new(FakeChip::new("fake", &["GPIO0", "GPIO1", "GPIO2"]).v1_only()));
+        assert!(!gpio.supports_v2());
+
+        let config = GpioLineConfig::default()
+            .with_consumer("v1")
+            .with_direction(GpioLineDirection::Output)
+            .with_flags(GpioLineFlag::ActiveLow)
+            .with_output_value(1, true);
+        let request = gpio.request_lines(&[2, 0], &config).unwrap();
+        assert_eq!(request.get_values(0b11).unwrap(), 0b10);
+
+        request.set_values(0b01, 0b01).unwrap();
+        assert_eq!(request.get_values(0b11).unwrap(), 0b11);
+        request.set(1, false).unwrap();
+        assert_eq!(request.read().unwrap().bits(), 0b01);
+
+        let e = gpio.request_lines(&[0, 1], &config).unwrap_err();
+        assert_eq!(GpioError::errno(&e), Some(libc::EBUSY));
+        drop(request);
+
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Input)
+            .with_debounce(0, Duration::from_millis(5));
+        let e = gpio.request_lines(&[0], &config).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::Unsupported);
+
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::EdgeRising);
+        let mut request = gpio.request_lines(&[0], &GpioLineConfig::default()).unwrap();
+        assert_eq!(request.set_config(&config).unwrap_err().kind(), ErrorKind::Unsupported);
+        drop(request);
+        assert_eq!(gpio.request_lines(&[0], &config).unwrap_err().kind(), ErrorKind::Unsupported);
+    }
+
+    #[test]
+    fn test_num_lines() {
+        let gpio = fake_gpio();
+        assert_eq!(gpio.num_lines().unwrap(), gpio.get_chip_info().unwrap().lines);
+        assert!(gpio.request_range(1, gpio.num_lines().unwrap(), &GpioLineConfig::default()).is_err());
+    }
+
+    #[test]
+    fn test_request_lines_by_name() {
+        let gpio = fake_gpio();
+        let request = gpio.request_lines_by_name(&["LED", "GPIO1"], &GpioLineConfig::default()).unwrap();
+        assert_eq!(request.offsets(), [4, 1]);
+        assert_eq!(request.names(), ["LED", "GPIO1"]);
+        drop(request);
+        assert_eq!(gpio.request_lines(&[4], &GpioLineConfig::default()).unwrap().names(), [""]);
+
+        let e = gpio.request_lines_by_name(&["GPIO1", "GPIO9"], &GpioLineConfig::default()).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::NotFound);
+        assert_eq!(e.to_string(), "GPIO line not found: \"GPIO9\"");
+        assert!(!gpio.get_line_info(1).unwrap().flags.is_used());
+    }
+
+    #[test]
+    fn test_watch_line_info() {
+        let gpio = fake_gpio();
+        assert_eq!(gpio.watch_line_info(1).unwrap().name, "GPIO1");
+        assert_eq!(GpioError::errno(&gpio.watch_line_info(1).unwrap_err()), Some(libc::EBUSY));
+
+        let config = GpioLineConfig::default().with_consumer("watched").with_direction(GpioLineDirection::Output);
+        let mut request = gpio.request_lines(&[1, 2], &config).unwrap();
+        request.set_config(&config.clone().with_direction(GpioLineDirection::Input)).unwrap();
+        drop(request);
+
+        let changes: Vec<_> = (0..3).map(|_| gpio.read_line_info_changed().unwrap()).collect();
+        let kinds: Vec<_> = changes.iter().map(|change| change.kind).collect();
+        assert_eq!(kinds, [GpioLineChangeKind::Requested, GpioLineChangeKind::Config, GpioLineChangeKind::Released]);
+        assert!(changes.iter().all(|change| change.info.offset == 1));
+        assert_eq!(changes[0].info.consumer, "watched");
+
+        gpio.unwatch_line_info(1).unwrap();
+        assert_eq!(GpioError::errno(&gpio.unwatch_line_info(1).unwrap_err()), Some(libc::EBUSY));
+        gpio.request_lines(&[1], &config).unwrap();
+        assert_eq!(gpio.read_line_info_changed().unwrap_err().kind(), ErrorKind::WouldBlock);
+    }
+
+    #[test]
+    fn test_watch_all_lines() {
+        let chip = Arc::new(FakeChip::new("fake", &["GPIO0", "GPIO1", "GPIO2", "GPIO3"]));
+        let gpio = Gpio::with_backend(chip.clone());
+
+        // A line already watched is skipped rather than failing the call.
+        gpio.watch_line_info(2).unwrap();
+        gpio.watch_all_lines().unwrap();
+        assert!((0..4).all(|offset| chip.is_watched(offset)));
+    }
+
+    #[test]
+    fn test_watch_all_lines_rolls_back() {
+        let chip = Arc::new(FakeChip::new("fake", &["GPIO0", "GPIO1", "GPIO2", "GPIO3"]));
+        let gpio = Gpio::with_backend(chip.clone());
+        gpio.watch_line_info(1).unwrap();
+        chip.fail_watch(2, libc::EIO);
+
+        let e = gpio.watch_all_lines().unwrap_err();
+        assert_eq!(GpioError::errno(&e), Some(libc::EIO));
+
+        // Only the lines watched by the failed call are unwatched.
+        assert!(!chip.is_watched(0));
+        assert!(chip.is_watched(1));
+        assert!(!chip.is_watched(3));
+    }
+
+    #[test]
+    fn test_unwatch_all_lines() {
+        let chip = Arc::new(FakeChip::new("fake", &["GPIO0", "GPIO1", "GPIO2", "GPIO3"]));
+        let gpio = Gpio::with_backend(chip.clone());
+        gpio.watch_all_lines().unwrap();
+        gpio.unwatch_line_info(3).unwrap();
+        chip.fail_watch(1, libc::EIO);
+
+        // Line 3 is no longer watched, which is skipped; the failure on line 1 does not stop line 2 being unwatched.
+        let e = gpio.unwatch_all_lines().unwrap_err();
+        assert_eq!(GpioError::errno(&e), Some(libc::EIO));
+        assert!(!chip.is_watched(0));
+        assert!(chip.is_watched(1));
+        assert!(!chip.is_watched(2));
+
+        chip.fail_watch(0, libc::EPERM);
+        let e = gpio.unwatch_all_lines().unwrap_err();
+        assert_eq!(GpioError::errno(&e), Some(libc::EPERM));
+    }
+}
@@ -0,0 +1,1723 @@
+//! Line requests: lines held by this process for input or output.
+
+use {
+    crate::{
+        CancelToken, Gpio, GpioError, GpioEventClock, GpioLineEvent, GpioLineFlag, GpioLineFlags, GpioLineValues,
+        backend::GpioBackend,
+        cancel::{poll_readable, wait_readable},
+        gpio_ioctl, os_error, set_fd_nonblocking,
+    },
+    log::error,
+    std::{
+        collections::{BTreeMap, HashMap},
+        io::{Error as IoError, ErrorKind, Read, Result as IoResult},
+        mem::size_of,
+        os::fd::{AsFd, AsRawFd, BorrowedFd, OwnedFd, RawFd},
+        path::Path,
+        sync::{
+            Arc, Mutex, MutexGuard, PoisonError,
+            atomic::{AtomicU64, Ordering},
+            mpsc::{Receiver, sync_channel},
+        },
+        thread::{Builder, JoinHandle},
+        time::{Duration, Instant},
+    },
+};
+
+/// The direction to configure requested lines for.
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
+pub enum GpioLineDirection {
+    /// Leave the direction of the lines unchanged.
+    #[default]
+    AsIs,
+
+    /// Configure the lines as inputs.
+    Input,
+
+    /// Configure the lines as outputs.
+    Output,
+}
+
+/// Configuration for a set of requested lines.
+///
+/// Per-line settings are keyed by the index of the line within the request (the position of its offset in the slice
+/// passed to [`Gpio::request_lines`][crate::Gpio::request_lines]), not by chip offset.
+///
+/// This can be built up from [`Default`] with the `with_*` methods:
+/// ```no_run
+/// # use {gpio_linux_char::*, std::time::Duration};
+/// let config = GpioLineConfig::default()
+///     .with_consumer("buttons")
+///     .with_direction(GpioLineDirection::Input)
+///     .with_debounce(0, Duration::from_millis(5));
+/// ```
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct GpioLineConfig {
+    /// The consumer label to attach to the lines. This shows up in the line information of the lines while they are
+    /// requested.
+    ///
+    /// If empty, the file name of the running program is used. Labels longer than the kernel's limit of 31 bytes are
+    /// truncated at a character boundary; the applied label is available from [`GpioLineRequest::consumer`].
+    pub consumer: String,
+
+    /// The direction of the lines.
+    pub direction: GpioLineDirection,
+
+    /// Additional flags (bias, drive, edge detection, etc.) applied to all lines.
+    ///
+    /// At most one of the bias flags ([`BiasPullUp`][GpioLineFlag::BiasPullUp],
+    /// [`BiasPullDown`][GpioLineFlag::BiasPullDown], and [`BiasDisabled`][GpioLineFlag::BiasDisabled]) may be set, and
+    /// only if `direction` is not [`AsIs`][GpioLineDirection::AsIs]. [`OpenDrain`][GpioLineFlag::OpenDrain] and
+    /// [`OpenSource`][GpioLineFlag::OpenSource] are mutually exclusive and require `direction` to be
+    /// [`Output`][GpioLineDirection::Output]; either may be combined with a bias.
+    ///
+    /// The [`Input`][GpioLineFlag::Input] and [`Output`][GpioLineFlag::Output] flags are controlled by `direction`
+    /// and should not be set here.
+    pub flags: GpioLineFlags,
+
+    /// Additional flags for individual lines, keyed by line index. These are combined with `flags` for the given
+    /// lines, e.g. to make only some of the lines [`ActiveLow`][GpioLineFlag::ActiveLow].
+    pub line_flags: HashMap<usize, GpioLineFlags>,
+
+    /// The clock used to timestamp edge events.
+    ///
+    /// This is equivalent to setting [`EventClockRealtime`][GpioLineFlag::EventClockRealtime] or
+    /// [`EventClockHte`][GpioLineFlag::EventClockHte] in `flags`.
+    pub event_clock: GpioEventClock,
+
+    /// Values of output lines, keyed by line index. `true` is active. Output lines not listed here are inactive.
+    ///
+    /// The values are part of the request itself, so the lines are driven to them as they become outputs, without
+    /// a window in which they are at some other level. They cannot be given if `direction` is
+    /// [`Input`][GpioLineDirection::Input].
+    pub output_values: HashMap<usize, bool>,
+
+    /// Debounce periods, keyed by line index. The kernel has microsecond resolution; periods are rounded down.
+    ///
+    /// Debouncing applies to inputs only, so this must be empty if `direction` is
+    /// [`Output`][GpioLineDirection::Output]. When the lines are read back with
+    /// [`Gpio::get_line_info`][crate::Gpio::get_line_info], debounced lines report a
+    /// [`DebouncePeriod`][crate::GpioLineAttr::DebouncePeriod] attribute.
+    pub debounce: HashMap<usize, Duration>,
+}
+
+impl GpioLineConfig {
+    /// Set the consumer label.
+    pub fn with_consumer(mut self, consumer: impl Into<String>) -> Self {
+        self.consumer = consumer.into();
+        self
+    }
+
+    /// Set the direction of the lines.
+    pub fn with_direction(mut self, direction: GpioLineDirection) -> Self {
+        self.direction = direction;
+        self
+    }
+
+    /// Add flags applied to all lines.
+    pub fn with_flags(mut self, flags: impl Into<GpioLineFlags>) -> Self {
+        self.flags |= flags.into();
+        self
+    }
+
+    /// Add flags for the line at `index`, on top of the flags applied to all lines.
+    pub fn with_line_flags(mut self, index: usize, flags: impl Into<GpioLineFlags>) -> Self {
+        *self.line_flags.entry(index).or_default() |= flags.into();
+        self
+    }
+
+    /// Set the clock used to timestamp edge events.
+    pub fn with_event_clock(mut self, event_clock: GpioEventClock) -> Self {
+        self.event_clock = event_clock;
+        self
+    }
+
+    /// Set the value of the output line at `index`.
+    pub fn with_output_value(mut self, index: usize, value: bool) -> Self {
+        self.output_values.insert(index, value);
+        self
+    }
+
+    /// Set the values of the output lines in `values`' mask, e.g. as returned by [`GpioLineRequest::read`].
+    pub fn with_output_values(mut self, values: GpioLineValues) -> Self {
+        for index in 0..u64::BITS as usize {
+            if values.mask() & (1 << index) != 0 {
+                self.output_values.insert(index, values.get(index));
+            }
+        }
+        self
+    }
+
+    /// Set the debounce period of the line at `index`.
+    pub fn with_debounce(mut self, index: usize, period: Duration) -> Self {
+        self.debounce.insert(index, period);
+        self
+    }
+
+    /// Convert this configuration into the kernel representation for a request of `num_lines` lines.
+    ///
+    /// Per-line settings are packed into attributes, each applying to the lines selected by a mask: one for each
+    /// distinct set of per-line flags, one for all output values, and one for each distinct debounce period. The
+    /// kernel allows at most [`GPIO_V2_LINE_NUM_ATTRS_MAX`][gpio_ioctl::GPIO_V2_LINE_NUM_ATTRS_MAX] attributes.
+    pub(crate) fn to_raw(&self, num_lines: usize) -> IoResult<gpio_ioctl::RawGpioV2LineConfig> {
+        let mut raw = gpio_ioctl::RawGpioV2LineConfig::default();
+        let mut attrs = vec![];
+        let mut flags = self.flags;
+
+        match self.direction {
+            GpioLineDirection::AsIs => (),
+            GpioLineDirection::Input => flags |= GpioLineFlag::Input.into(),
+            GpioLineDirection::Output => flags |= GpioLineFlag::Output.into(),
+        }
+
+        match self.event_clock {
+            GpioEventClock::Monotonic => (),
+            GpioEventClock::Realtime => flags |= GpioLineFlag::EventClockRealtime.into(),
+            GpioEventClock::Hte => flags |= GpioLineFlag::EventClockHte.into(),
+        }
+
+        validate_flags(flags)?;
+        raw.flags = flags.0;
+
+        // Group lines sharing the same combined flags into a single attribute.
+        let mut flag_masks = BTreeMap::new();
+        for (&index, line_flags) in &self.line_flags {
+            check_index(index, num_lines)?;
+            let line_flags = flags | *line_flags;
+            validate_flags(line_flags)?;
+            *flag_masks.entry(line_flags.0).or_insert(0u64) |= 1 << index;
+        }
+
+        for (line_flags, mask) in flag_masks {
+            let mut attr = gpio_ioctl::RawGpioV2LineConfigAttr {
+                mask,
+                ..Default::default()
+            };
+            attr.attr.id = gpio_ioctl::GPIO_V2_LINE_ATTR_ID_FLAGS;
+            attr.attr.data.flags = line_flags;
+            attrs.push(attr);
+        }
+
+        if !self.output_values.is_empty() && self.direction == GpioLineDirection::Input {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("output values cannot be applied to input lines"),
+            ));
+        }
+
+        if !self.output_values.is_empty() {
+            let mut mask = 0;
+            let mut values = 0;
+            for (&index, &value) in &self.output_values {
+                check_index(index, num_lines)?;
+                mask |= 1 << index;
+                values |= (value as u64) << index;
+            }
+
+            let mut attr = gpio_ioctl::RawGpioV2LineConfigAttr {
+                mask,
+                ..Default::default()
+            };
+            attr.attr.id = gpio_ioctl::GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES;
+            attr.attr.data.values = values;
+            attrs.push(attr);
+        }
+
+        if !self.debounce.is_empty() && self.direction == GpioLineDirection::Output {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("debounce cannot be applied to output lines"),
+            ));
+        }
+
+        // Group lines sharing a debounce period into a single attribute.
+        let mut debounce_masks = BTreeMap::new();
+        for (&index, period) in &self.debounce {
+            check_index(index, num_lines)?;
+            let Ok(period_us) = u32::try_from(period.as_micros()) else {
+                return Err(IoError::new(
+                    ErrorKind::InvalidInput,
+                    GpioError::InvalidLineConfig("debounce period is too long"),
+                ));
+            };
+            *debounce_masks.entry(period_us).or_insert(0u64) |= 1 << index;
+        }
+
+        for (period_us, mask) in debounce_masks {
+            let mut attr = gpio_ioctl::RawGpioV2LineConfigAttr {
+                mask,
+                ..Default::default()
+            };
+            attr.attr.id = gpio_ioctl::GPIO_V2_LINE_ATTR_ID_DEBOUNCE;
+            attr.attr.data.debounce_period_us = period_us;
+            attrs.push(attr);
+        }
+
+        if attrs.len() > gpio_ioctl::GPIO_V2_LINE_NUM_ATTRS_MAX {
+            return Err(IoError::new(ErrorKind::InvalidInput, GpioError::TooManyAttributes(attrs.len())));
+        }
+
+        raw.num_attrs = attrs.len() as u32;
+        for (dst, src) in raw.attrs.iter_mut().zip(attrs) {
+            *dst = src;
+        }
+
+        Ok(raw)
+    }
+
+    /// Convert this configuration into the flags and default values of a v1 line handle request for `num_lines`
+    /// lines.
+    pub(crate) fn to_raw_v1(&self, request: &mut gpio_ioctl::RawGpioHandleRequest, num_lines: usize) -> IoResult<()> {
+        // Validate as for v2 first, so errors common to both are reported the same way.
+        let raw = self.to_raw(num_lines)?;
+        let unsupported = |feature| Err(IoError::new(ErrorKind::Unsupported, GpioError::UnsupportedV1(feature)));
+
+        if !self.line_flags.is_empty() {
+            return unsupported("per-line flags");
+        }
+
+        if !self.debounce.is_empty() {
+            return unsupported("debounce");
+        }
+
+        let flags = GpioLineFlags(raw.flags);
+        if flags.contains(GpioLineFlag::EdgeRising) || flags.contains(GpioLineFlag::EdgeFalling) {
+            return unsupported("edge detection");
+        }
+
+        if flags.contains(GpioLineFlag::EventClockRealtime) || flags.contains(GpioLineFlag::EventClockHte) {
+            return unsupported("event clock selection");
+        }
+
+        request.flags = [
+            (GpioLineFlag::Input, gpio_ioctl::GPIOHANDLE_REQUEST_INPUT),
+            (GpioLineFlag::Output, gpio_ioctl::GPIOHANDLE_REQUEST_OUTPUT),
+            (GpioLineFlag::ActiveLow, gpio_ioctl::GPIOHANDLE_REQUEST_ACTIVE_LOW),
+            (GpioLineFlag::OpenDrain, gpio_ioctl::GPIOHANDLE_REQUEST_OPEN_DRAIN),
+            (GpioLineFlag::OpenSource, gpio_ioctl::GPIOHANDLE_REQUEST_OPEN_SOURCE),
+            (GpioLineFlag::BiasPullUp, gpio_ioctl::GPIOHANDLE_REQUEST_BIAS_PULL_UP),
+            (GpioLineFlag::BiasPullDown, gpio_ioctl::GPIOHANDLE_REQUEST_BIAS_PULL_DOWN),
+            (GpioLineFlag::BiasDisabled, gpio_ioctl::GPIOHANDLE_REQUEST_BIAS_DISABLE),
+        ]
+        .into_iter()
+        .filter(|&(flag, _)| flags.contains(flag))
+        .fold(0, |acc, (_, v1)| acc | v1);
+
+        for (&index, &value) in &self.output_values {
+            request.default_values[index] = value as u8;
+        }
+
+        Ok(())
+    }
+
+    /// Returns the event clock selected by this configuration, via either `event_clock` or `flags`.
+    pub(crate) fn effective_event_clock(&self) -> GpioEventClock {
+        if self.flags.0 & GpioLineFlag::EventClockRealtime as u64 != 0 {
+            GpioEventClock::Realtime
+        } else if self.flags.0 & GpioLineFlag::EventClockHte as u64 != 0 {
+            GpioEventClock::Hte
+        } else {
+            self.event_clock
+        }
+    }
+}
+
+/// Reject combinations of flags that the kernel would reject with `EINVAL`, with a more descriptive error.
+fn validate_flags(flags: GpioLineFlags) -> IoResult<()> {
+    let invalid = |reason| Err(IoError::new(ErrorKind::InvalidInput, GpioError::InvalidLineConfig(reason)));
+
+    if flags.contains(GpioLineFlag::EventClockRealtime) && flags.contains(GpioLineFlag::EventClockHte) {
+        return invalid("only one event clock may be selected");
+    }
+
+    let biases = [GpioLineFlag::BiasPullUp, GpioLineFlag::BiasPullDown, GpioLineFlag::BiasDisabled];
+    let num_biases = biases.iter().filter(|&&bias| flags.contains(bias)).count();
+    if num_biases > 1 {
+        return invalid("only one bias may be selected");
+    }
+
+    if num_biases > 0 && !flags.contains(GpioLineFlag::Input) && !flags.contains(GpioLineFlag::Output) {
+        return invalid("bias requires the line direction to be set");
+    }
+
+    // Bias and drive are independent; open-drain with a pull-up is the usual arrangement for a shared bus.
+    let open_drain = flags.contains(GpioLineFlag::OpenDrain);
+    let open_source = flags.contains(GpioLineFlag::OpenSource);
+    if open_drain && open_source {
+        return invalid("only one of open-drain and open-source may be selected");
+    }
+
+    if (open_drain || open_source) && !flags.contains(GpioLineFlag::Output) {
+        return invalid("open-drain and open-source apply to output lines only");
+    }
+
+    Ok(())
+}
+
+/// Verify that `index` refers to one of `num_lines` requested lines.
+fn check_index(index: usize, num_lines: usize) -> IoResult<()> {
+    if index >= num_lines {
+        Err(IoError::new(ErrorKind::InvalidInput, GpioError::LineIndexOutOfRange(index)))
+    } else {
+        Ok(())
+    }
+}
+
+/// Returns a bitmap with the lowest `num_lines` bits set.
+pub(crate) fn line_mask(num_lines: usize) -> u64 {
+    if num_lines >= u64::BITS as usize {
+        u64::MAX
+    } else {
+        (1 << num_lines) - 1
+    }
+}
+
+/// Copy a Rust string into a fixed-size C string buffer, truncating it if necessary so that it is always
+/// NUL-terminated.
+///
+/// Truncation happens at a character boundary so the buffer always holds valid UTF-8. Returns the part of `s` that
+/// was copied.
+pub(crate) fn string_to_cstr<'a>(s: &'a str, buf: &mut [u8]) -> &'a str {
+    let mut len = s.len().min(buf.len() - 1);
+    while !s.is_char_boundary(len) {
+        len -= 1;
+    }
+
+    buf[..len].copy_from_slice(&s.as_bytes()[..len]);
+    buf[len..].fill(0);
+    &s[..len]
+}
+
+/// Returns the default consumer label: the file name of the running program.
+fn default_consumer() -> String {
+    std::env::args_os()
+        .next()
+        .as_deref()
+        .and_then(|arg0| Path::new(arg0).file_name())
+        .map(|name| name.to_string_lossy().into_owned())
+        .unwrap_or_default()
+}
+
+/// Clamp a PWM duty cycle to 0.0..=1.0, treating NaN as 0.0.
+fn clamp_duty(duty: f64) -> f64 {
+    if duty.is_nan() {
+        0.0
+    } else {
+        duty.clamp(0.0, 1.0)
+    }
+}
+
+/// Sets a single line of a request from a background thread, through the thread's own duplicate of the request's
+/// file descriptor.
+struct LineWriter {
+    backend: Arc<dyn GpioBackend>,
+    fd: OwnedFd,
+    values_lock: Arc<Mutex<()>>,
+    mask: u64,
+}
+
+impl LineWriter {
+    /// Create a writer for the line at `mask` of `request`.
+    fn new(request: &GpioLineRequest, mask: u64) -> IoResult<Self> {
+        Ok(Self {
+            backend: request.backend.clone(),
+            fd: unsafe { BorrowedFd::borrow_raw(request.fd) }.try_clone_to_owned()?,
+            values_lock: request.values_lock.clone(),
+            mask,
+        })
+    }
+
+    /// Make the line active or inactive.
+    fn set(&self, active: bool) -> IoResult<()> {
+        let mut raw = gpio_ioctl::RawGpioV2LineValues {
+            bits: if active {
+                self.mask
+            } else {
+                0
+            },
+            mask: self.mask,
+        };
+        let _lock = self.values_lock.lock().unwrap_or_else(PoisonError::into_inner);
+        self.backend.set_values(self.fd.as_raw_fd(), &mut raw)
+    }
+}
+
+/// Blink the line of `writer` until `cycles` cycles have elapsed (if given) or `cancel` is cancelled, then leave it
+/// inactive.
+fn blink_loop(
+    writer: &LineWriter,
+    on_time: Duration,
+    off_time: Duration,
+    cycles: Option<u32>,
+    cancel: &CancelToken,
+) -> IoResult<()> {
+    let mut remaining = cycles;
+    while remaining != Some(0) && !cancel.is_cancelled() {
+        writer.set(true)?;
+        if cancel.wait_timeout(on_time) {
+            break;
+        }
+
+        writer.set(false)?;
+        remaining = remaining.map(|n| n - 1);
+        if remaining != Some(0) && cancel.wait_timeout(off_time) {
+            break;
+        }
+    }
+
+    writer.set(false)
+}
+
+/// Toggle the line of `writer` until `cancel` is cancelled, then leave it inactive.
+///
+/// Edges are scheduled against absolute deadlines so that timing errors do not accumulate over periods.
+fn pwm_loop(writer: &LineWriter, period: Duration, duty: &AtomicU64, cancel: &CancelToken) -> IoResult<()> {
+    let wait_until = |deadline: Instant| cancel.wait_timeout(deadline.saturating_duration_since(Instant::now()));
+
+    let mut period_start = Instant::now();
+    loop {
+        let on_time = period.mul_f64(f64::from_bits(duty.load(Ordering::Relaxed)));
+        if !on_time.is_zero() {
+            writer.set(true)?;
+            if wait_until(period_start + on_time) {
+                break;
+            }
+        }
+
+        if on_time < period {
+            writer.set(false)?;
+        }
+
+        period_start += period;
+        if wait_until(period_start) {
+            break;
+        }
+    }
+
+    writer.set(false)
+}
+
+/// A set of lines requested from a GPIO chip.
+///
+/// The lines are held until this is dropped; this is independent of the lifetime of the [`Gpio`][crate::Gpio] the
+/// lines were requested from.
+///
+/// A request can be shared between threads, e.g. in an [`Arc`]. Writes to line values are serialized by an internal
+/// lock, including those made by [`toggle`][Self::toggle], which reads and writes back a line without another
+/// thread's write slipping in between, and by [PWM][Self::pwm] and [blink][Self::blink] threads. Reconfiguring the
+/// lines with [`set_config`][Self::set_config] needs exclusive access, so it cannot race with anything. The lock is
+/// held only for the duration of the ioctls.
+#[derive(Debug)]
+pub struct GpioLineRequest {
+    fd: RawFd,
+    offsets: Vec<usize>,
+    config: GpioLineConfig,
+
+    /// The names the lines were requested by, or empty names for lines requested by offset.
+    names: Vec<String>,
+
+    /// Describes the chip and lines for error messages.
+    target: String,
+
+    /// The backend of the chip the lines were requested from.
+    backend: Arc<dyn GpioBackend>,
+
+    /// Whether the lines were requested with the v1 uAPI, which needs different ioctls for everything.
+    v1: bool,
+
+    /// Held while setting line values, so that read-modify-write sequences (toggling a line, or setting some lines
+    /// of a v1 handle) are not interleaved with other writes. Shared with PWM and blink threads.
+    values_lock: Arc<Mutex<()>>,
+
+    /// Duty cycles (as `f64` bits) of lines driven by software PWM, keyed by line index.
+    pwm_duties: Mutex<HashMap<usize, Arc<AtomicU64>>>,
+
+    /// Tracks event sequence numbers when dropped event detection is enabled.
+    dropped_events: Mutex<Option<DropTracker>>,
+}
+
+/// Detects gaps in the sequence numbers of successive events on each line.
+#[derive(Debug, Default)]
+pub(crate) struct DropTracker {
+    /// The per-line sequence number of the last event read on each line, keyed by chip offset.
+    last_line_seqnos: HashMap<usize, u32>,
+
+    /// An event that followed a gap, to be returned by the next read after the gap is reported.
+    pending: Option<GpioLineEvent>,
+}
+
+impl DropTracker {
+    /// Record `event`, returning the number of events missed on its line before it if there is a gap.
+    pub(crate) fn check(&mut self, event: &GpioLineEvent) -> Option<u32> {
+        let last = self.last_line_seqnos.insert(event.offset, event.line_seqno);
+        let missed = last.map_or(0, |last| event.line_seqno.wrapping_sub(last).wrapping_sub(1));
+        (missed != 0).then_some(missed)
+    }
+}
+
+impl GpioLineRequest {
+    /// The size, in bytes, of each raw edge event record returned by the request's [`Read`] implementation.
+    pub const EVENT_RECORD_SIZE: usize = size_of::<gpio_ioctl::RawGpioV2LineEvent>();
+
+    /// Request lines from a GPIO chip.
+    pub(crate) fn new(gpio: &Gpio, offsets: &[usize], config: &GpioLineConfig) -> IoResult<Self> {
+        if offsets.is_empty() {
+            return Err(IoError::new(ErrorKind::InvalidInput, GpioError::NoLines));
+        }
+
+        if offsets.len() > gpio_ioctl::GPIO_V2_LINES_MAX {
+            return Err(IoError::new(ErrorKind::InvalidInput, GpioError::TooManyLines(offsets.len())));
+        }
+
+        let mut raw_offsets = Vec::with_capacity(offsets.len());
+        for &offset in offsets {
+            let Ok(offset) = offset.try_into() else {
+                return Err(IoError::new(ErrorKind::InvalidInput, "Invalid GPIO line number"));
+            };
+            raw_offsets.push(offset);
+        }
+
+        let consumer = if config.consumer.is_empty() {
+            default_consumer()
+        } else {
+            config.consumer.clone()
+        };
+
+        let target = format!("{} lines {offsets:?}", gpio.path().display());
+        let backend = gpio.backend().clone();
+        let v1 = !gpio.supports_v2();
+        let (fd, consumer) = if v1 {
+            let mut raw = gpio_ioctl::RawGpioHandleRequest::default();
+            raw.lineoffsets[..offsets.len()].copy_from_slice(&raw_offsets);
+            let consumer = string_to_cstr(&consumer, &mut raw.consumer_label).to_string();
+            config.to_raw_v1(&mut raw, offsets.len())?;
+            raw.lines = offsets.len() as u32;
+            let fd = backend.get_line_handle(gpio.as_raw_fd(), &mut raw).map_err(os_error("request lines", &target))?;
+            (fd, consumer)
+        } else {
+            let mut raw = gpio_ioctl::RawGpioV2LineRequest::default();
+            raw.offsets[..offsets.len()].copy_from_slice(&raw_offsets);
+            let consumer = string_to_cstr(&consumer, &mut raw.consumer).to_string();
+            raw.config = config.to_raw(offsets.len())?;
+            raw.num_lines = offsets.len() as u32;
+            let fd = backend.get_line(gpio.as_raw_fd(), &mut raw).map_err(os_error("request lines", &target))?;
+            (fd, consumer)
+        };
+
+        Ok(Self {
+            fd,
+            offsets: offsets.to_vec(),
+            names: vec![String::new(); offsets.len()],
+            config: GpioLineConfig {
+                consumer,
+                ..config.clone()
+            },
+            target,
+            backend,
+            v1,
+            values_lock: Arc::new(Mutex::new(())),
+            pwm_duties: Mutex::new(HashMap::new()),
+            dropped_events: Mutex::new(None),
+        })
+    }
+
+    /// Release the lines, reporting any error from closing the request's file descriptor.
+    ///
+    /// Dropping the request also releases the lines, but ignores errors.
+    ///
+    /// # Errors
+    /// If closing the file descriptor fails, the underlying [`IoError`][std::io::Error] is returned wrapped in a
+    /// [`GpioError::Os`]. The lines are released regardless.
+    pub fn close(mut self) -> IoResult<()> {
+        let fd = self.fd;
+        self.fd = -1;
+        self.backend.release(fd).map_err(os_error("release lines", &self.target))
+    }
+
+    /// Returns the chip offsets of the requested lines, in the order they were requested.
+    pub fn offsets(&self) -> &[usize] {
+        &self.offsets
+    }
+
+    /// Returns the names of the requested lines, in the order they were requested.
+    ///
+    /// These are the names given to [`request_lines_by_name`][Gpio::request_lines_by_name]; lines requested by
+    /// offset have empty names, so looking them up does not cost an ioctl per line on every request.
+    pub fn names(&self) -> &[String] {
+        &self.names
+    }
+
+    /// Record the names the lines were requested by, in the order they were requested.
+    pub(crate) fn set_names(&mut self, names: &[&str]) {
+        self.names = names.iter().map(|name| name.to_string()).collect();
+    }
+
+    /// Returns the consumer label applied to the lines.
+    ///
+    /// This is the label from the configuration, or the program name if that was empty, truncated to fit the
+    /// kernel's limit of 31 bytes.
+    pub fn consumer(&self) -> &str {
+        &self.config.consumer
+    }
+
+    /// Returns the configuration currently applied to the lines: the one they were requested with, or the last one
+    /// applied with [`set_config`][Self::set_config].
+    ///
+    /// The [`consumer`][GpioLineConfig::with_consumer] is the label actually applied, as returned by
+    /// [`consumer`][Self::consumer]. Configurations can be compared, so a caller can skip reconfiguring lines that
+    /// already have the desired configuration.
+    pub fn config(&self) -> &GpioLineConfig {
+        &self.config
+    }
+
+    /// Returns the index within this request of the line at chip offset `offset`, or `None` if that line is not part
+    /// of this request.
+    ///
+    /// This is the inverse of [`offset_at`][Self::offset_at], and is useful for mapping the chip offset reported by
+    /// [`GpioLineEvent`] back to the bit index used by [`get_values`][Self::get_values].
+    pub fn index_of(&self, offset: usize) -> Option<usize> {
+        self.offsets.iter().position(|&o| o == offset)
+    }
+
+    /// Returns the chip offset of the line at `index` within this request, or `None` if `index` is out of range.
+    pub fn offset_at(&self, index: usize) -> Option<usize> {
+        self.offsets.get(index).copied()
+    }
+
+    /// Returns the number of requested lines.
+    pub fn num_lines(&self) -> usize {
+        self.offsets.len()
+    }
+
+    /// Reconfigure the requested lines without releasing them.
+    ///
+    /// The set of requested lines cannot be changed; the new configuration applies to the same offsets, and bitmaps
+    /// in `config` use the same indexing as the original request. The consumer label cannot be changed either and is
+    /// ignored.
+    ///
+    /// # Errors
+    /// If the configuration is invalid or the ioctl fails, an [`IoError`][std::io::Error] is returned (as with
+    /// [`Gpio::request_lines`][crate::Gpio::request_lines]) and the previous configuration remains in effect.
+    ///
+    /// If the lines were requested with the v1 uAPI, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`Unsupported`][std::io::ErrorKind::Unsupported] wrapping a [`GpioError::UnsupportedV1`].
+    pub fn set_config(&mut self, config: &GpioLineConfig) -> IoResult<()> {
+        if self.v1 {
+            return Err(IoError::new(ErrorKind::Unsupported, GpioError::UnsupportedV1("reconfiguring lines")));
+        }
+
+        let mut raw = config.to_raw(self.offsets.len())?;
+        self.backend.set_config(self.fd, &mut raw).map_err(os_error("set line config", &self.target))?;
+        self.config = GpioLineConfig {
+            consumer: self.config.consumer.clone(),
+            ..config.clone()
+        };
+        Ok(())
+    }
+
+    /// Read the next edge event on the requested lines, blocking until one is available.
+    ///
+    /// The lines must have been requested with [`EdgeRising`][GpioLineFlag::EdgeRising] and/or
+    /// [`EdgeFalling`][GpioLineFlag::EdgeFalling] set; otherwise, no events are ever generated and this blocks
+    /// forever.
+    ///
+    /// # Errors
+    /// If the read fails, the underlying [`IoError`][std::io::Error] is returned.
+    ///
+    /// If the kernel returns less than a full event, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`UnexpectedEof`][std::io::ErrorKind::UnexpectedEof] wrapping a [`GpioError::ShortRead`].
+    ///
+    /// If dropped event detection is enabled (see [`detect_dropped_events`][Self::detect_dropped_events]) and events
+    /// were dropped before this one, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`Other`][std::io::ErrorKind::Other] wrapping a [`GpioError::EventsDropped`]; the event itself is returned by
+    /// the next call.
+    pub fn read_event(&self) -> IoResult<GpioLineEvent> {
+        let pending = self.dropped_events().as_mut().and_then(|tracker| tracker.pending.take());
+        if let Some(event) = pending {
+            return Ok(event);
+        }
+
+        // The tracker is not locked while blocked in the read, so detection can be changed meanwhile.
+        let raw = gpio_ioctl::RawGpioV2LineEvent::read(self.fd)?;
+        let event = GpioLineEvent::from_raw(raw, self.config.effective_event_clock())?;
+        if let Some(tracker) = self.dropped_events().as_mut() {
+            if let Some(missed) = tracker.check(&event) {
+                tracker.pending = Some(event);
+                return Err(IoError::other(GpioError::EventsDropped(missed)));
+            }
+        }
+
+        Ok(event)
+    }
+
+    /// Enable or disable detection of events dropped by the kernel.
+    ///
+    /// The kernel buffers events until they are read; when its buffer overflows, the oldest events are discarded and
+    /// the sequence numbers of later events jump. With detection enabled, [`read_event`][Self::read_event] (and the
+    /// methods built on it, [`wait_event`][Self::wait_event] and [`read_event_timeout`][Self::read_event_timeout])
+    /// compare each event's per-line sequence number against that of the previous event on the same line and report
+    /// a gap as an error, with the number of events the line missed, so code that counts edges (e.g. from a rotary
+    /// encoder) can resynchronize instead of silently miscounting. Events streamed by [`events`][Self::events] are
+    /// not checked.
+    ///
+    /// A gap only shows up with the next event on the line that missed events, so drops on a line that then stays
+    /// quiet are not reported.
+    ///
+    /// Enabling detection starts tracking afresh from the next event read; disabling it discards any event held back
+    /// after a reported gap. This can be called while another thread is blocked reading an event.
+    pub fn detect_dropped_events(&self, enable: bool) {
+        *self.dropped_events() = enable.then(DropTracker::default);
+    }
+
+    /// Lock the dropped event tracker.
+    fn dropped_events(&self) -> MutexGuard<'_, Option<DropTracker>> {
+        self.dropped_events.lock().unwrap_or_else(PoisonError::into_inner)
+    }
+
+    /// Wait for the next edge event on the requested lines, returning early if `cancel` is cancelled.
+    ///
+    /// If `cancel` has already been cancelled, this returns immediately without reading an event. If an event is
+    /// pending at the same time the token is cancelled, the event is left unread.
+    ///
+    /// # Errors
+    /// If `cancel` is cancelled, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`Other`][std::io::ErrorKind::Other] wrapping a [`GpioError::Cancelled`].
+    ///
+    /// Otherwise, errors are the same as for [`read_event`][Self::read_event].
+    pub fn wait_event(&self, cancel: &CancelToken) -> IoResult<GpioLineEvent> {
+        wait_readable(self.fd, cancel)?;
+        self.read_event()
+    }
+
+    /// Wait up to `timeout` for the next edge event on the requested lines.
+    ///
+    /// A zero `timeout` checks for a pending event without blocking. This is a simpler alternative to
+    /// [`wait_event`][Self::wait_event] when there is no need to cancel the wait from another thread.
+    ///
+    /// # Errors
+    /// If no event arrives within `timeout`, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`TimedOut`][std::io::ErrorKind::TimedOut] wrapping a [`GpioError::TimedOut`].
+    ///
+    /// If polling the file descriptor fails, the underlying [`IoError`][std::io::Error] is returned. Otherwise,
+    /// errors are the same as for [`read_event`][Self::read_event].
+    pub fn read_event_timeout(&self, timeout: Duration) -> IoResult<GpioLineEvent> {
+        if !poll_readable(self.fd, timeout)? {
+            return Err(IoError::new(ErrorKind::TimedOut, GpioError::TimedOut));
+        }
+
+        self.read_event()
+    }
+
+    /// Block until the line at `index` is at `level` (`true` for active), returning early if `cancel` is cancelled.
+    ///
+    /// If the line is already at `level`, this returns immediately. Otherwise, if the line was requested with edge
+    /// detection for the edge that leads to `level` ([`EdgeRising`][GpioLineFlag::EdgeRising] for active,
+    /// [`EdgeFalling`][GpioLineFlag::EdgeFalling] for inactive), this waits for edge events and reads the line again
+    /// after each one; events on any of the requested lines are consumed, so this should not be mixed with other
+    /// readers of events. Without such edge detection, or with the v1 uAPI, the line is read every
+    /// `poll_interval` instead.
+    ///
+    /// # Errors
+    /// If `index` is not less than the number of requested lines, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`].
+    ///
+    /// If `cancel` is cancelled before the line reaches `level`, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`Other`][std::io::ErrorKind::Other] wrapping a [`GpioError::Cancelled`].
+    ///
+    /// Otherwise, errors reading the line are the same as for [`get`][Self::get], and errors waiting for events the
+    /// same as for [`wait_event`][Self::wait_event], except that dropped events are not reported.
+    pub fn wait_for_level(
+        &self,
+        cancel: &CancelToken,
+        index: usize,
+        level: bool,
+        poll_interval: Duration,
+    ) -> IoResult<()> {
+        let edge = if level {
+            GpioLineFlag::EdgeRising
+        } else {
+            GpioLineFlag::EdgeFalling
+        };
+        let mut flags = self.config.flags;
+        if let Some(&line_flags) = self.config.line_flags.get(&index) {
+            flags |= line_flags;
+        }
+        let use_events = !self.v1 && flags.contains(edge);
+
+        // Edge detection is enabled for as long as the lines are requested, so an edge after this read is queued
+        // rather than missed.
+        while self.get(index)? != level {
+            if use_events {
+                match self.wait_event(cancel) {
+                    Ok(_) => (),
+                    Err(e)
+                        if matches!(
+                            e.get_ref().and_then(|e| e.downcast_ref::<GpioError>()),
+                            Some(GpioError::EventsDropped(_))
+                        ) => {}
+                    Err(e) => return Err(e),
+                }
+            } else if cancel.wait_timeout(poll_interval) {
+                return Err(IoError::other(GpioError::Cancelled));
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Set or clear non-blocking mode on the request's file descriptor.
+    ///
+    /// This is intended for callers that poll the descriptor (see [`AsRawFd`]) from their own event loop and then
+    /// call [`read_event`][Self::read_event], which fails with [`WouldBlock`][std::io::ErrorKind::WouldBlock] when no
+    /// event is pending in non-blocking mode. Mixing this with [`wait_event`][Self::wait_event] or
+    /// [`events`][Self::events] is unsupported.
+    ///
+    /// # Errors
+    /// If the file descriptor flags cannot be read or changed, the underlying [`IoError`][std::io::Error] is
+    /// returned.
+    pub fn set_nonblocking(&self, nonblocking: bool) -> IoResult<()> {
+        set_fd_nonblocking(self.fd, nonblocking)
+    }
+
+    /// Stream edge events on the requested lines from a background thread.
+    ///
+    /// Events are delivered in order on the returned channel. If reading fails, the error is delivered as the
+    /// final item. The channel is closed when `cancel` is cancelled or after an error.
+    ///
+    /// The channel holds up to `buffer` events. If the consumer falls behind and the channel is full, the reader
+    /// thread blocks (no events are dropped by the stream itself); events then accumulate in the kernel's buffer,
+    /// which drops the oldest events when it overflows. Gaps can be detected with the events' sequence numbers. A
+    /// `buffer` of 0 hands each event directly to the consumer. Dropping the receiver also stops the thread.
+    ///
+    /// The reader thread uses its own duplicate of the request's file descriptor, so the lines remain requested
+    /// until both this request and the thread are done.
+    ///
+    /// # Errors
+    /// If the file descriptor cannot be duplicated or the thread cannot be spawned, the underlying
+    /// [`IoError`][std::io::Error] is returned.
+    pub fn events(&self, cancel: &CancelToken, buffer: usize) -> IoResult<Receiver<IoResult<GpioLineEvent>>> {
+        let fd = unsafe { BorrowedFd::borrow_raw(self.fd) }.try_clone_to_owned()?;
+        let clock = self.config.effective_event_clock();
+        let cancel = cancel.clone();
+        let (sender, receiver) = sync_channel(buffer);
+
+        Builder::new().name("gpio-events".to_string()).spawn(move || {
+            loop {
+                let result = wait_readable(fd.as_raw_fd(), &cancel).and_then(|_| {
+                    let raw = gpio_ioctl::RawGpioV2LineEvent::read(fd.as_raw_fd())?;
+                    GpioLineEvent::from_raw(raw, clock)
+                });
+
+                match result {
+                    Ok(event) => {
+                        if sender.send(Ok(event)).is_err() {
+                            break;
+                        }
+                    }
+                    Err(_) if cancel.is_cancelled() => break,
+                    Err(e) => {
+                        let _ = sender.send(Err(e));
+                        break;
+                    }
+                }
+            }
+        })?;
+
+        Ok(receiver)
+    }
+
+    /// Read the values of requested lines.
+    ///
+    /// Bit `n` of `mask` selects the `n`th requested line -- that is, the line at `offsets()[n]` -- and **not** the
+    /// line at chip offset `n`. For example, if lines 17, 27, and 22 were requested (in that order), a mask of `0b100`
+    /// selects line 22.
+    ///
+    /// The returned bitmap uses the same indexing; bits not selected by `mask` are zero. A set bit indicates the
+    /// line is active (which is physically low for active-low lines).
+    ///
+    /// # Errors
+    /// If `mask` selects a line beyond the number of requested lines, an [`IoError`][std::io::Error] is returned
+    /// with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::InvalidLineMask`].
+    ///
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn get_values(&self, mask: u64) -> IoResult<u64> {
+        self.check_mask(mask)?;
+        if self.v1 {
+            return Ok(self.get_handle_values()? & mask);
+        }
+
+        let raw = self.backend.get_values(self.fd, mask).map_err(os_error("get line values", &self.target))?;
+        Ok(raw.bits & mask)
+    }
+
+    /// Read the values of all requested lines, keyed by line name (see [`names`][Self::names]).
+    ///
+    /// Lines without a name, which includes every line of a request made by offset, are left out. If several
+    /// requested lines share a name, the value of the last of them is returned.
+    ///
+    /// # Errors
+    /// Errors are the same as for [`read`][Self::read].
+    pub fn read_by_name(&self) -> IoResult<HashMap<String, bool>> {
+        let bits = self.get_values(line_mask(self.offsets.len()))?;
+        Ok(self
+            .names
+            .iter()
+            .enumerate()
+            .filter(|(_, name)| !name.is_empty())
+            .map(|(i, name)| (name.clone(), bits >> i & 1 != 0))
+            .collect())
+    }
+
+    /// Read the values of all requested lines.
+    ///
+    /// # Errors
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn read(&self) -> IoResult<GpioLineValues> {
+        let mask = line_mask(self.offsets.len());
+        Ok(GpioLineValues::new(mask, self.get_values(mask)?))
+    }
+
+    /// Set the values of requested lines.
+    ///
+    /// Bit `n` of `mask` selects the `n`th requested line -- that is, the line at `offsets()[n]` -- and **not** the
+    /// line at chip offset `n`. The corresponding bit of `bits` gives the value to set: 1 for active, 0 for inactive.
+    /// Lines not selected by `mask` are left unchanged. With the v1 uAPI, which can only set all lines together, this
+    /// is done by reading the lines first, so setting some but not all lines is not atomic on older kernels.
+    ///
+    /// All selected lines are set by a single ioctl, so on chips whose drivers can set multiple lines at once (such
+    /// as the Raspberry Pi's), they change at the same instant. This is also much faster than setting the lines one
+    /// at a time with [`set`][Self::set].
+    ///
+    /// # Errors
+    /// If `mask` selects a line beyond the number of requested lines, an [`IoError`][std::io::Error] is returned
+    /// with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::InvalidLineMask`].
+    ///
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn set_values(&self, mask: u64, bits: u64) -> IoResult<()> {
+        self.check_mask(mask)?;
+        let _lock = self.values_lock.lock().unwrap_or_else(PoisonError::into_inner);
+        self.set_values_locked(mask, bits)
+    }
+
+    /// Make a sequence of writes to the requested lines, each given as the `mask` and `bits` of a
+    /// [`set_values`][Self::set_values] call, in order.
+    ///
+    /// This is intended for bit-banging precomputed waveforms, such as clocking data into shift registers, where the
+    /// overhead of each call matters: the masks are validated together before any write is made, and the write lock
+    /// is taken once, so other writes through this request wait until the whole sequence is done. Each write is still
+    /// a separate ioctl.
+    ///
+    /// # Errors
+    /// If any mask selects a line beyond the number of requested lines, an [`IoError`][std::io::Error] is returned
+    /// with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::InvalidLineMask`],
+    /// and no writes are made.
+    ///
+    /// If an ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`]; the writes before it have been made, and the rest are not.
+    pub fn set_values_sequence(&self, writes: &[(u64, u64)]) -> IoResult<()> {
+        self.check_mask(writes.iter().fold(0, |all, &(mask, _)| all | mask))?;
+        let _lock = self.values_lock.lock().unwrap_or_else(PoisonError::into_inner);
+        for &(mask, bits) in writes {
+            self.set_values_locked(mask, bits)?;
+        }
+        Ok(())
+    }
+
+    /// Set the values of the lines selected by `mask`, which has been validated, with `values_lock` held.
+    fn set_values_locked(&self, mask: u64, bits: u64) -> IoResult<()> {
+        if self.v1 {
+            // v1 handles set every line at once, so lines outside the mask have to be written back as read.
+            let all = line_mask(self.offsets.len());
+            let current = if mask == all {
+                0
+            } else {
+                self.get_handle_values()?
+            };
+            let bits = (current & !mask) | (bits & mask);
+            let mut raw = gpio_ioctl::RawGpioHandleData::default();
+            for (i, value) in raw.values[..self.offsets.len()].iter_mut().enumerate() {
+                *value = (bits >> i & 1) as u8;
+            }
+            return self
+                .backend
+                .set_handle_values(self.fd, &mut raw)
+                .map_err(os_error("set line values", &self.target));
+        }
+
+        let mut raw = gpio_ioctl::RawGpioV2LineValues {
+            bits: bits & mask,
+            mask,
+        };
+        self.backend.set_values(self.fd, &mut raw).map_err(os_error("set line values", &self.target))
+    }
+
+    /// Read the value of a single requested line.
+    ///
+    /// `index` is the position of the line within the offsets passed to
+    /// [`Gpio::request_lines`][crate::Gpio::request_lines], not its chip offset. Returns `true` if the line is active.
+    ///
+    /// # Errors
+    /// If `index` is not less than the number of requested lines, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`].
+    ///
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn get(&self, index: usize) -> IoResult<bool> {
+        let mask = self.index_mask(index)?;
+        Ok(self.get_values(mask)? != 0)
+    }
+
+    /// Set the value of a single requested line.
+    ///
+    /// `index` is the position of the line within the offsets passed to
+    /// [`Gpio::request_lines`][crate::Gpio::request_lines], not its chip offset. A value of `true` makes the line
+    /// active.
+    ///
+    /// # Errors
+    /// If `index` is not less than the number of requested lines, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`].
+    ///
+    /// If the ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn set(&self, index: usize, value: bool) -> IoResult<()> {
+        let mask = self.index_mask(index)?;
+        self.set_values(mask, (value as u64) << index)
+    }
+
+    /// Invert the value of the output line at `index`.
+    ///
+    /// The kernel reports the driven value of output lines, so this reads the line and writes back the inverse. Other
+    /// writes through this request wait for both to complete, but writes by other processes (or by the kernel) can
+    /// still come in between.
+    ///
+    /// # Errors
+    /// If `index` is not less than the number of requested lines, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`].
+    ///
+    /// If the lines were not requested with [`Output`][GpioLineDirection::Output] direction (including
+    /// [`AsIs`][GpioLineDirection::AsIs], since the actual direction is unknown), an [`IoError`][std::io::Error] is
+    /// returned with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a
+    /// [`GpioError::InvalidLineConfig`]; toggling an input would have no effect.
+    ///
+    /// If an ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`].
+    pub fn toggle(&self, index: usize) -> IoResult<()> {
+        let mask = self.index_mask(index)?;
+
+        if self.config.direction != GpioLineDirection::Output {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("toggle requires lines requested as outputs"),
+            ));
+        }
+
+        let _lock = self.values_lock.lock().unwrap_or_else(PoisonError::into_inner);
+        let bits = self.get_values(mask)?;
+        self.set_values_locked(mask, !bits)
+    }
+
+    /// Drive the output line at `index` with software PWM from a background thread until `cancel` is cancelled.
+    ///
+    /// The line is toggled to approximate a square wave of `frequency` Hz that is active for the fraction `duty` of
+    /// each period; `duty` is clamped to 0.0..=1.0, and NaN is treated as 0.0. The duty cycle can be changed while
+    /// running with [`set_duty`][Self::set_duty]. When cancelled, the line is left inactive.
+    ///
+    /// This is software PWM: edges are timed by the scheduler, so expect jitter of tens of microseconds or more
+    /// under load. It is adequate for dimming an LED at a few hundred Hz, but not for driving servos or anything
+    /// else sensitive to pulse width.
+    ///
+    /// # Errors
+    /// If `index` is not less than the number of requested lines, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`].
+    ///
+    /// If the lines were not requested as outputs or `frequency` is not positive and finite, an
+    /// [`IoError`][std::io::Error] is returned with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput]
+    /// wrapping a [`GpioError::InvalidLineConfig`].
+    ///
+    /// If PWM is already running on the line, an [`IoError`][std::io::Error] is returned with the same kind as the OS
+    /// error `EBUSY` ([`ResourceBusy`][std::io::ErrorKind::ResourceBusy]).
+    ///
+    /// If the lines were requested with the v1 uAPI, which cannot set one line without rewriting the others, an
+    /// [`IoError`][std::io::Error] is returned with a kind of [`Unsupported`][std::io::ErrorKind::Unsupported]
+    /// wrapping a [`GpioError::UnsupportedV1`].
+    ///
+    /// If the file descriptor cannot be duplicated or the thread cannot be spawned, the underlying
+    /// [`IoError`][std::io::Error] is returned. Errors setting the line once running are logged and stop the thread.
+    pub fn pwm(&self, cancel: &CancelToken, index: usize, frequency: f64, duty: f64) -> IoResult<()> {
+        let mask = self.index_mask(index)?;
+
+        if self.v1 {
+            return Err(IoError::new(ErrorKind::Unsupported, GpioError::UnsupportedV1("software PWM")));
+        }
+
+        if self.config.direction != GpioLineDirection::Output {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("PWM requires lines requested as outputs"),
+            ));
+        }
+
+        if !(frequency.is_finite() && frequency > 0.0) {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("PWM frequency must be positive"),
+            ));
+        }
+
+        let mut duties = self.pwm_duties.lock().unwrap();
+        if duties.get(&index).is_some_and(|duty| Arc::strong_count(duty) > 1) {
+            return Err(IoError::new(
+                IoError::from_raw_os_error(libc::EBUSY).kind(),
+                "PWM is already running on this GPIO line",
+            ));
+        }
+
+        let writer = LineWriter::new(self, mask)?;
+        let period = Duration::from_secs_f64(1.0 / frequency);
+        let shared_duty = Arc::new(AtomicU64::new(clamp_duty(duty).to_bits()));
+        let thread_duty = shared_duty.clone();
+        let cancel = cancel.clone();
+
+        Builder::new().name("gpio-pwm".to_string()).spawn(move || {
+            if let Err(e) = pwm_loop(&writer, period, &thread_duty, &cancel) {
+                error!("Software PWM failed: {e}");
+            }
+        })?;
+
+        duties.insert(index, shared_duty);
+        Ok(())
+    }
+
+    /// Blink the output line at `index` from a background thread until `cancel` is cancelled.
+    ///
+    /// The line is made active for `on_time`, then inactive for `off_time`, repeatedly. When cancelled, the line is
+    /// left inactive. The returned handle can be joined to wait for the thread to finish after cancelling.
+    ///
+    /// # Errors
+    /// Errors are the same as for [`pwm`][Self::pwm], except that blinking a line already running PWM or blinking is
+    /// not detected.
+    pub fn blink(
+        &self,
+        cancel: &CancelToken,
+        index: usize,
+        on_time: Duration,
+        off_time: Duration,
+    ) -> IoResult<JoinHandle<()>> {
+        self.spawn_blink(cancel, index, on_time, off_time, None)
+    }
+
+    /// Blink the output line at `index` from a background thread for `cycles` cycles, or until `cancel` is cancelled.
+    ///
+    /// This is like [`blink`][Self::blink], but stops after the line has been active `cycles` times, leaving it
+    /// inactive. Join the returned handle to wait for the pattern to finish.
+    ///
+    /// # Errors
+    /// Errors are the same as for [`blink`][Self::blink].
+    pub fn blink_n(
+        &self,
+        cancel: &CancelToken,
+        index: usize,
+        on_time: Duration,
+        off_time: Duration,
+        cycles: u32,
+    ) -> IoResult<JoinHandle<()>> {
+        self.spawn_blink(cancel, index, on_time, off_time, Some(cycles))
+    }
+
+    /// Start a thread blinking the line at `index`, for the given number of cycles or indefinitely.
+    fn spawn_blink(
+        &self,
+        cancel: &CancelToken,
+        index: usize,
+        on_time: Duration,
+        off_time: Duration,
+        cycles: Option<u32>,
+    ) -> IoResult<JoinHandle<()>> {
+        let mask = self.index_mask(index)?;
+
+        if self.v1 {
+            return Err(IoError::new(ErrorKind::Unsupported, GpioError::UnsupportedV1("blinking a line")));
+        }
+
+        if self.config.direction != GpioLineDirection::Output {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("blinking requires lines requested as outputs"),
+            ));
+        }
+
+        let writer = LineWriter::new(self, mask)?;
+        let cancel = cancel.clone();
+
+        let handle = Builder::new().name("gpio-blink".to_string()).spawn(move || {
+            if let Err(e) = blink_loop(&writer, on_time, off_time, cycles, &cancel) {
+                error!("Blinking GPIO line failed: {e}");
+            }
+        })?;
+
+        Ok(handle)
+    }
+
+    /// Change the duty cycle of the line at `index`, which must be running software PWM via [`pwm`][Self::pwm].
+    ///
+    /// The new duty cycle takes effect at the start of the next period.
+    ///
+    /// # Errors
+    /// If PWM is not running on the line, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`NotFound`][std::io::ErrorKind::NotFound].
+    pub fn set_duty(&self, index: usize, duty: f64) -> IoResult<()> {
+        match self.pwm_duties.lock().unwrap().get(&index) {
+            Some(shared_duty) if Arc::strong_count(shared_duty) > 1 => {
+                shared_duty.store(clamp_duty(duty).to_bits(), Ordering::Relaxed);
+                Ok(())
+            }
+            _ => Err(IoError::new(ErrorKind::NotFound, "PWM is not running on this GPIO line")),
+        }
+    }
+
+    /// Returns the mask selecting the requested line at `index`.
+    fn index_mask(&self, index: usize) -> IoResult<u64> {
+        check_index(index, self.offsets.len())?;
+        Ok(1 << index)
+    }
+
+    /// Verify that `mask` only selects requested lines.
+    fn check_mask(&self, mask: u64) -> IoResult<()> {
+        if mask & !line_mask(self.offsets.len()) != 0 {
+            Err(IoError::new(ErrorKind::InvalidInput, GpioError::InvalidLineMask(mask)))
+        } else {
+            Ok(())
+        }
+    }
+
+    /// Read all lines of a v1 line handle as a bitmap.
+    fn get_handle_values(&self) -> IoResult<u64> {
+        let raw = self.backend.get_handle_values(self.fd).map_err(os_error("get line values", &self.target))?;
+        Ok(raw.values[..self.offsets.len()]
+            .iter()
+            .enumerate()
+            .fold(0, |bits, (i, &value)| bits | ((value != 0) as u64) << i))
+    }
+}
+
+/// Reads raw edge events, for callers that decode them themselves.
+///
+/// Each read returns as many whole events as fit into the buffer, blocking until at least one is pending. Events are
+/// the kernel's `struct gpio_v2_line_event` records of [`EVENT_RECORD_SIZE`][GpioLineRequest::EVENT_RECORD_SIZE]
+/// (48) bytes each, in native byte order (little-endian on the Raspberry Pi):
+///
+/// | Bytes | Field | Meaning |
+/// |-------|-------|---------|
+/// | 0..8 | `timestamp_ns` | The event time in nanoseconds, from the request's [`GpioEventClock`]. |
+/// | 8..12 | `id` | 1 for a rising edge, 2 for a falling edge. |
+/// | 12..16 | `offset` | The chip offset of the line. |
+/// | 16..20 | `seqno` | The sequence number of the event among all lines of the request. |
+/// | 20..24 | `line_seqno` | The sequence number of the event on this line. |
+/// | 24..48 | padding | Reserved; zero. |
+///
+/// A buffer's trailing bytes that cannot hold a whole record are left untouched, so with a buffered reader, use a
+/// capacity that is a multiple of the record size. The inherent [`read`][GpioLineRequest::read] method, which reads
+/// line values, takes precedence in method calls; call this as `Read::read(&mut request, buf)` or pass the request
+/// to [`BufReader`][std::io::BufReader] or [`copy`][std::io::copy].
+///
+/// # Errors
+/// If `buf` is smaller than one record, an [`IoError`][std::io::Error] is returned with a kind of
+/// [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::BufferTooSmall`]. Otherwise, the
+/// underlying [`IoError`][std::io::Error] from the read is returned.
+impl Read for &GpioLineRequest {
+    fn read(&mut self, buf: &mut [u8]) -> IoResult<usize> {
+        if buf.len() < GpioLineRequest::EVENT_RECORD_SIZE {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::BufferTooSmall(buf.len(), GpioLineRequest::EVENT_RECORD_SIZE),
+            ));
+        }
+
+        gpio_ioctl::RawGpioV2LineEvent::read_raw(self.fd, buf)
+    }
+}
+
+/// Reads raw edge events; see the implementation for `&GpioLineRequest`.
+impl Read for GpioLineRequest {
+    fn read(&mut self, buf: &mut [u8]) -> IoResult<usize> {
+        Read::read(&mut &*self, buf)
+    }
+}
+
+impl AsRawFd for GpioLineRequest {
+    fn as_raw_fd(&self) -> RawFd {
+        self.fd
+    }
+}
+
+impl AsFd for GpioLineRequest {
+    fn as_fd(&self) -> BorrowedFd<'_> {
+        unsafe { BorrowedFd::borrow_raw(self.fd) }
+    }
+}
+
+impl Drop for GpioLineRequest {
+    fn drop(&mut self) {
+        if self.fd >= 0 {
+            let _ = self.backend.release(self.fd);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        crate::backend::fake::{FakeChip, fake_gpio},
+        pretty_assertions::assert_eq,
+        std::{env, time::Instant},
+    };
+
+    fn event(offset: usize, seqno: u32, line_seqno: u32) -> GpioLineEvent {
+        GpioLineEvent {
+            timestamp: Duration::ZERO,
+            clock: GpioEventClock::Monotonic,
+            kind: crate::GpioLineEventKind::RisingEdge,
+            offset,
+            seqno,
+            line_seqno,
+            time: std::time::UNIX_EPOCH,
+            time_conversion: crate::GpioTimeConversion::MonotonicOffset,
+        }
+    }
+
+    #[test]
+    fn test_drop_tracker() {
+        let mut tracker = DropTracker::default();
+        assert_eq!(tracker.check(&event(0, 5, 5)), None);
+        assert_eq!(tracker.check(&event(0, 6, 6)), None);
+
+        // Events on other lines advance the request-wide sequence number, but only per-line gaps are drops.
+        assert_eq!(tracker.check(&event(3, 7, 1)), None);
+        assert_eq!(tracker.check(&event(0, 8, 7)), None);
+        assert_eq!(tracker.check(&event(0, 12, 10)), Some(2));
+        assert_eq!(tracker.check(&event(3, 13, 3)), Some(1));
+        assert_eq!(tracker.check(&event(3, 14, 4)), None);
+
+        tracker.last_line_seqnos.insert(0, u32::MAX);
+        assert_eq!(tracker.check(&event(0, 15, 0)), None);
+    }
+
+    #[test]
+    fn test_debounce_attrs() {
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Input)
+            .with_debounce(0, Duration::from_millis(5))
+            .with_debounce(2, Duration::from_millis(5))
+            .with_debounce(3, Duration::from_micros(1500));
+        let raw = config.to_raw(4).unwrap();
+
+        assert_eq!(raw.num_attrs, 2);
+        assert_eq!(raw.attrs[0].attr.id, gpio_ioctl::GPIO_V2_LINE_ATTR_ID_DEBOUNCE);
+        assert_eq!(unsafe { raw.attrs[0].attr.data.debounce_period_us }, 1500);
+        assert_eq!(raw.attrs[0].mask, 0b1000);
+        assert_eq!(raw.attrs[1].attr.id, gpio_ioctl::GPIO_V2_LINE_ATTR_ID_DEBOUNCE);
+        assert_eq!(unsafe { raw.attrs[1].attr.data.debounce_period_us }, 5000);
+        assert_eq!(raw.attrs[1].mask, 0b0101);
+    }
+
+    #[test]
+    fn test_debounce_rejected_on_output() {
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Output)
+            .with_debounce(0, Duration::from_millis(5));
+        assert!(config.to_raw(1).is_err());
+    }
+
+    #[test]
+    fn test_conflicting_bias_rejected() {
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Input)
+            .with_flags(GpioLineFlag::BiasPullUp | GpioLineFlag::BiasPullDown);
+        assert!(config.to_raw(1).is_err());
+
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Input)
+            .with_flags(GpioLineFlag::BiasPullUp)
+            .with_line_flags(0, GpioLineFlag::BiasDisabled);
+        assert!(config.to_raw(1).is_err());
+
+        let config = GpioLineConfig::default().with_flags(GpioLineFlag::BiasPullUp);
+        assert!(config.to_raw(1).is_err());
+
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::BiasPullUp);
+        assert!(config.to_raw(1).is_ok());
+    }
+
+    #[test]
+    fn test_drive_flags_validated() {
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Output)
+            .with_flags(GpioLineFlag::OpenDrain | GpioLineFlag::BiasPullUp);
+        assert!(config.to_raw(1).is_ok());
+
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Output)
+            .with_flags(GpioLineFlag::OpenDrain | GpioLineFlag::OpenSource);
+        assert!(config.to_raw(1).is_err());
+
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::OpenDrain);
+        assert!(config.to_raw(1).is_err());
+
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Input)
+            .with_line_flags(0, GpioLineFlag::OpenSource);
+        assert!(config.to_raw(1).is_err());
+    }
+
+    #[test]
+    fn test_consumer_truncated_at_char_boundary() {
+        let mut buf = [0xffu8; gpio_ioctl::GPIO_MAX_NAME_SIZE];
+
+        // 30 ASCII bytes followed by a two-byte character that would straddle the 31-byte limit.
+        let label = format!("{}é", "x".repeat(30));
+        assert_eq!(string_to_cstr(&label, &mut buf), "x".repeat(30));
+        assert_eq!(buf[30], 0);
+        assert_eq!(buf[31], 0);
+
+        assert_eq!(string_to_cstr("short", &mut buf), "short");
+        assert_eq!(&buf[..6], b"short\0");
+    }
+
+    /// Compare setting six lines one at a time with setting them together with one call to `set_values`.
+    ///
+    /// By default this uses the fake chip, which measures only the driver's own overhead. To measure real ioctls,
+    /// set `GPIO_BENCH_CHIP` to a chip and `GPIO_BENCH_LINES` to six comma-separated offsets that are safe to drive:
+    /// `GPIO_BENCH_CHIP=0 GPIO_BENCH_LINES=5,6,12,13,16,19 cargo test --release -p gpio-linux-char -- --ignored
+    /// --nocapture bench_set_values`.
+    #[test]
+    #[ignore]
+    fn bench_set_values() {
+        const ITERATIONS: u32 = 10_000;
+
+        let (gpio, offsets): (Gpio, Vec<usize>) = match env::var("GPIO_BENCH_CHIP") {
+            Ok(chip) => {
+                let lines = env::var("GPIO_BENCH_LINES").expect("GPIO_BENCH_LINES must be set with GPIO_BENCH_CHIP");
+                let offsets = lines.split(',').map(|offset| offset.trim().parse().unwrap()).collect();
+                (Gpio::open(Gpio::parse_chip_descriptor(&chip).unwrap()).unwrap(), offsets)
+            }
+            Err(_) => {
+                let fake = FakeChip::new("fake", &["R1", "G1", "B1", "R2", "G2", "B2"]);
+                (Gpio::with_backend(Arc::new(fake)), (0..6).collect())
+            }
+        };
+        assert_eq!(offsets.len(), 6);
+
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output);
+        let request = gpio.request_lines(&offsets, &config).unwrap();
+
+        let start = Instant::now();
+        for i in 0..ITERATIONS {
+            for index in 0..6 {
+                request.set(index, (i as usize + index) % 2 == 0).unwrap();
+            }
+        }
+        let individual = start.elapsed() / ITERATIONS;
+
+        let start = Instant::now();
+        for i in 0..ITERATIONS {
+            let bits = if i % 2 == 0 {
+                0b010101
+            } else {
+                0b101010
+            };
+            request.set_values(0b111111, bits).unwrap();
+        }
+        let batched = start.elapsed() / ITERATIONS;
+
+        println!("6 x set: {individual:?}, 1 x set_values: {batched:?}");
+    }
+
+    #[test]
+    fn test_set_and_get_values() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output).with_output_value(2, true);
+        let request = gpio.request_lines(&[4, 0, 2], &config).unwrap();
+        assert_eq!(request.get_values(0b111).unwrap(), 0b100);
+
+        request.set_values(0b011, 0b001).unwrap();
+        assert_eq!(request.get_values(0b111).unwrap(), 0b101);
+        assert_eq!(request.get_values(0b010).unwrap(), 0b000);
+
+        request.set(1, true).unwrap();
+        assert!(request.get(1).unwrap());
+        assert_eq!(request.read().unwrap().bits(), 0b111);
+
+        request.toggle(0).unwrap();
+        assert!(!request.get(0).unwrap());
+    }
+
+    #[test]
+    fn test_output_values_applied_at_request() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default()
+            .with_direction(GpioLineDirection::Output)
+            .with_output_values(GpioLineValues::new(0b101, 0b001))
+            .with_output_value(1, true);
+        let request = gpio.request_lines(&[0, 1, 2, 3], &config).unwrap();
+        assert_eq!(request.get_values(0b1111).unwrap(), 0b0011);
+        drop(request);
+
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_output_value(0, true);
+        let e = gpio.request_lines(&[0], &config).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::InvalidInput);
+    }
+
+    #[test]
+    fn test_read_event_timeout() {
+        let gpio = fake_gpio();
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::EdgeRising);
+        let request = gpio.request_lines(&[0], &config).unwrap();
+
+        // The fake never generates events, so both polling and waiting time out.
+        assert_eq!(request.read_event_timeout(Duration::ZERO).unwrap_err().kind(), ErrorKind::TimedOut);
+        let start = Instant::now();
+        assert_eq!(request.read_event_timeout(Duration::from_millis(20)).unwrap_err().kind(), ErrorKind::TimedOut);
+        assert!(start.elapsed() >= Duration::from_millis(20));
+    }
+
+    #[test]
+    fn test_detect_dropped_events_while_reading() {
+        let gpio = fake_gpio();
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::EdgeRising);
+        let request = gpio.request_lines(&[0], &config).unwrap();
+        request.detect_dropped_events(true);
+
+        let request = &request;
+        std::thread::scope(|scope| {
+            let reader = scope.spawn(|| request.read_event());
+            std::thread::sleep(Duration::from_millis(20));
+
+            let (sender, receiver) = std::sync::mpsc::channel();
+            scope.spawn(move || {
+                request.detect_dropped_events(false);
+                sender.send(()).unwrap();
+            });
+            let toggled = receiver.recv_timeout(Duration::from_secs(1));
+
+            // The fake's line request is an eventfd, so signalling it wakes the reader with a short record.
+            let one = 1u64;
+            assert_eq!(unsafe { libc::write(request.as_raw_fd(), (&one as *const u64).cast(), 8) }, 8);
+            assert!(toggled.is_ok(), "detect_dropped_events blocked behind read_event");
+            assert_eq!(reader.join().unwrap().unwrap_err().kind(), ErrorKind::UnexpectedEof);
+        });
+    }
+
+    #[test]
+    fn test_read_raw_events_short_buffer() {
+        let gpio = fake_gpio();
+        let config =
+            GpioLineConfig::default().with_direction(GpioLineDirection::Input).with_flags(GpioLineFlag::EdgeRising);
+        let mut request = gpio.request_lines(&[0], &config).unwrap();
+
+        let mut buf = [0; GpioLineRequest::EVENT_RECORD_SIZE - 1];
+        let e = Read::read(&mut request, &mut buf).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::InvalidInput);
+        assert!(matches!(e.get_ref().unwrap().downcast_ref::<GpioError>(), Some(GpioError::BufferTooSmall(47, 48))));
+    }
+
+    #[test]
+    fn test_values_mask_validated() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output);
+        let request = gpio.request_lines(&[0, 1], &config).unwrap();
+
+        let e = request.set_values(0b100, 0b100).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::InvalidInput);
+        assert!(request.get(2).is_err());
+    }
+
+    #[test]
+    fn test_blink_validated() {
+        let gpio = fake_gpio();
+        let cancel = CancelToken::new().unwrap();
+        let on = Duration::from_millis(1);
+
+        let request = gpio.request_lines(&[0], &GpioLineConfig::default()).unwrap();
+        assert_eq!(request.blink(&cancel, 0, on, on).unwrap_err().kind(), ErrorKind::InvalidInput);
+        drop(request);
+
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output);
+        let request = gpio.request_lines(&[0], &config).unwrap();
+        assert_eq!(request.blink_n(&cancel, 1, on, on, 3).unwrap_err().kind(), ErrorKind::InvalidInput);
+    }
+
+    #[test]
+    fn test_config_tracks_set_config() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_consumer("leds").with_direction(GpioLineDirection::Output);
+        let mut request = gpio.request_lines(&[0, 1], &config).unwrap();
+        assert_eq!(request.config(), &config);
+
+        let new_config = GpioLineConfig::default()
+            .with_consumer("ignored")
+            .with_direction(GpioLineDirection::Input)
+            .with_debounce(1, Duration::from_millis(5));
+        request.set_config(&new_config).unwrap();
+        assert_eq!(request.config(), &new_config.with_consumer("leds"));
+    }
+
+    #[test]
+    fn test_read_by_name() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output).with_output_value(1, true);
+        let request = gpio.request_lines_by_name(&["GPIO2", "GPIO0"], &config).unwrap();
+        assert_eq!(request.names(), ["GPIO2", "GPIO0"]);
+
+        let values = request.read_by_name().unwrap();
+        assert_eq!(values.len(), 2);
+        assert!(!values["GPIO2"]);
+        assert!(values["GPIO0"]);
+    }
+
+    #[test]
+    fn test_wait_for_level() {
+        let gpio = fake_gpio();
+        let cancel = CancelToken::new().unwrap();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output).with_output_value(0, true);
+        let request = gpio.request_lines(&[0, 1], &config).unwrap();
+        let interval = Duration::from_millis(1);
+
+        // A line already at the level returns at once.
+        request.wait_for_level(&cancel, 0, true, interval).unwrap();
+
+        std::thread::scope(|scope| {
+            scope.spawn(|| {
+                std::thread::sleep(Duration::from_millis(20));
+                request.set(1, true).unwrap();
+            });
+            request.wait_for_level(&cancel, 1, true, interval).unwrap();
+        });
+
+        cancel.cancel();
+        let e = request.wait_for_level(&cancel, 0, false, interval).unwrap_err();
+        assert!(matches!(e.get_ref().unwrap().downcast_ref::<GpioError>(), Some(GpioError::Cancelled)));
+        assert!(request.wait_for_level(&cancel, 2, true, interval).is_err());
+    }
+
+    #[test]
+    fn test_set_values_sequence() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output);
+        let request = gpio.request_lines(&[0, 1], &config).unwrap();
+
+        let e = request.set_values_sequence(&[(0b01, 0b01), (0b100, 0)]).unwrap_err();
+        assert_eq!(e.kind(), ErrorKind::InvalidInput);
+        assert_eq!(request.get_values(0b11).unwrap(), 0);
+
+        request.set_values_sequence(&[(0b11, 0b11), (0b01, 0), (0b10, 0b10)]).unwrap();
+        assert_eq!(request.get_values(0b11).unwrap(), 0b10);
+    }
+}
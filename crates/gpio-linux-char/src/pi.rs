@@ -0,0 +1,114 @@
+//! Finding the GPIO chip for the 40-pin header of a Raspberry Pi.
+
+use {
+    crate::Gpio,
+    log::warn,
+    std::{fs::read, io::Result as IoResult, path::PathBuf},
+};
+
+/// The path of the device tree model string.
+const DEVICE_TREE_MODEL: &str = "/proc/device-tree/model";
+
+/// The path of the CPU information, which has a `Model` line on Raspberry Pi kernels.
+const CPUINFO: &str = "/proc/cpuinfo";
+
+/// The chip used when the header chip cannot be determined.
+const FALLBACK_CHIP: &str = "/dev/gpiochip0";
+
+impl Gpio {
+    /// Returns the path of the GPIO chip driving the 40-pin header of the Raspberry Pi this is running on, to pass
+    /// to [`open`][Self::open].
+    ///
+    /// The board model is read from `/proc/device-tree/model`, or from the `Model` line of `/proc/cpuinfo` if the
+    /// device tree is not available, and mapped to the label of its header chip: `pinctrl-rp1` on the Pi 5 family,
+    /// `pinctrl-bcm2711` on the Pi 4 family, and `pinctrl-bcm2835` on earlier models. The chip is then found by
+    /// label, as its number varies between kernels; e.g. the RP1 chip of a Pi 5 is `gpiochip4` on older kernels and
+    /// `gpiochip0` on newer ones.
+    ///
+    /// If the model cannot be read or is not a known Raspberry Pi, or no chip has the expected label, a warning is
+    /// logged and `/dev/gpiochip0` is returned.
+    ///
+    /// # Errors
+    /// If the `/dev` directory cannot be read, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn detect_pi_chip() -> IoResult<PathBuf> {
+        let Some(model) = read_model() else {
+            warn!("Unable to read the board model; using {FALLBACK_CHIP}");
+            return Ok(PathBuf::from(FALLBACK_CHIP));
+        };
+
+        let Some(label) = header_chip_label(&model) else {
+            warn!("Unknown board model {model:?}; using {FALLBACK_CHIP}");
+            return Ok(PathBuf::from(FALLBACK_CHIP));
+        };
+
+        for (path, info) in Self::enumerate_all()? {
+            if info.label == label {
+                return Ok(path);
+            }
+        }
+
+        warn!("No GPIO chip labelled {label:?} found for {model:?}; using {FALLBACK_CHIP}");
+        Ok(PathBuf::from(FALLBACK_CHIP))
+    }
+}
+
+/// Returns the board model from the device tree or, failing that, `/proc/cpuinfo`.
+fn read_model() -> Option<String> {
+    if let Ok(model) = read(DEVICE_TREE_MODEL) {
+        let model = String::from_utf8_lossy(&model);
+        let model = model.trim_end_matches('\0').trim();
+        if !model.is_empty() {
+            return Some(model.to_string());
+        }
+    }
+
+    let cpuinfo = read(CPUINFO).ok()?;
+    cpuinfo_model(&String::from_utf8_lossy(&cpuinfo))
+}
+
+/// Returns the value of the `Model` line of `cpuinfo`, if any.
+fn cpuinfo_model(cpuinfo: &str) -> Option<String> {
+    cpuinfo.lines().find_map(|line| {
+        let (key, value) = line.split_once(':')?;
+        (key.trim() == "Model").then(|| value.trim().to_string())
+    })
+}
+
+/// Returns the label of the GPIO chip driving the 40-pin header of the Raspberry Pi `model`, or `None` if it is not
+/// a Raspberry Pi.
+fn header_chip_label(model: &str) -> Option<&'static str> {
+    let board = model.strip_prefix("Raspberry Pi ")?;
+    let board = board.strip_prefix("Compute Module ").unwrap_or(board);
+    match board.chars().next() {
+        Some('5') => Some("pinctrl-rp1"),
+        Some('4') => Some("pinctrl-bcm2711"),
+        _ => Some("pinctrl-bcm2835"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {super::*, pretty_assertions::assert_eq};
+
+    #[test]
+    fn test_header_chip_label() {
+        assert_eq!(header_chip_label("Raspberry Pi 5 Model B Rev 1.0"), Some("pinctrl-rp1"));
+        assert_eq!(header_chip_label("Raspberry Pi 500 Rev 1.0"), Some("pinctrl-rp1"));
+        assert_eq!(header_chip_label("Raspberry Pi Compute Module 5 Rev 1.0"), Some("pinctrl-rp1"));
+        assert_eq!(header_chip_label("Raspberry Pi 4 Model B Rev 1.4"), Some("pinctrl-bcm2711"));
+        assert_eq!(header_chip_label("Raspberry Pi 400 Rev 1.0"), Some("pinctrl-bcm2711"));
+        assert_eq!(header_chip_label("Raspberry Pi Compute Module 4 Rev 1.0"), Some("pinctrl-bcm2711"));
+        assert_eq!(header_chip_label("Raspberry Pi 3 Model B Plus Rev 1.3"), Some("pinctrl-bcm2835"));
+        assert_eq!(header_chip_label("Raspberry Pi Zero 2 W Rev 1.0"), Some("pinctrl-bcm2835"));
+        assert_eq!(header_chip_label("Raspberry Pi Model B Rev 2"), Some("pinctrl-bcm2835"));
+        assert_eq!(header_chip_label("Pine64 RockPro64 v2.1"), None);
+    }
+
+    #[test]
+    fn test_cpuinfo_model() {
+        let cpuinfo = "processor\t: 0\nmodel name\t: ARMv7 Processor rev 4 (v7l)\n\nHardware\t: BCM2835\n\
+                       Revision\t: a02082\nModel\t\t: Raspberry Pi 3 Model B Rev 1.2\n";
+        assert_eq!(cpuinfo_model(cpuinfo).as_deref(), Some("Raspberry Pi 3 Model B Rev 1.2"));
+        assert_eq!(cpuinfo_model("processor\t: 0\n"), None);
+    }
+}
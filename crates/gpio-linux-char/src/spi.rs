@@ -0,0 +1,234 @@
+//! Bit-banged SPI over lines of a line request.
+
+use {
+    crate::{GpioError, GpioLineRequest},
+    std::{
+        fmt::{Display, Formatter, Result as FmtResult},
+        io::{Error as IoError, ErrorKind, Result as IoResult},
+        thread::sleep,
+        time::Duration,
+    },
+};
+
+/// The clock polarity and phase of an SPI bus.
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
+pub enum SpiMode {
+    /// CPOL=0, CPHA=0: the clock idles inactive and data is sampled on the rising edge.
+    #[default]
+    Mode0,
+
+    /// CPOL=0, CPHA=1: the clock idles inactive and data is sampled on the falling edge.
+    Mode1,
+
+    /// CPOL=1, CPHA=0: the clock idles active and data is sampled on the falling edge.
+    Mode2,
+
+    /// CPOL=1, CPHA=1: the clock idles active and data is sampled on the rising edge.
+    Mode3,
+}
+
+impl SpiMode {
+    /// Returns the clock polarity: `true` if the clock idles active.
+    pub fn cpol(self) -> bool {
+        matches!(self, Self::Mode2 | Self::Mode3)
+    }
+
+    /// Returns the clock phase: `true` if data is sampled on the trailing edge of each clock pulse.
+    pub fn cpha(self) -> bool {
+        matches!(self, Self::Mode1 | Self::Mode3)
+    }
+}
+
+impl Display for SpiMode {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::Mode0 => f.write_str("Mode0"),
+            Self::Mode1 => f.write_str("Mode1"),
+            Self::Mode2 => f.write_str("Mode2"),
+            Self::Mode3 => f.write_str("Mode3"),
+        }
+    }
+}
+
+/// A software SPI controller driving the clock and data lines of a [`GpioLineRequest`].
+///
+/// Bytes are clocked MSB-first. Chip select, if needed, is left to the caller. The clock and MOSI lines must be
+/// outputs and the MISO line, if any, an input; for a single request this means requesting the lines with a
+/// direction of [`AsIs`][crate::GpioLineDirection::AsIs] and per-line [`Input`][crate::GpioLineFlag::Input] and
+/// [`Output`][crate::GpioLineFlag::Output] flags.
+#[derive(Debug)]
+pub struct BitBangSpi<'a> {
+    request: &'a GpioLineRequest,
+    clk: usize,
+    mosi: usize,
+    miso: Option<usize>,
+    mode: SpiMode,
+    half_period: Duration,
+}
+
+impl<'a> BitBangSpi<'a> {
+    /// Create a controller using the lines at `clk`, `mosi`, and optionally `miso` within `request`, in
+    /// [`Mode0`][SpiMode::Mode0] with no delay between clock edges.
+    ///
+    /// The clock is not driven to its idle level until the first transfer.
+    ///
+    /// # Errors
+    /// If an index is not less than the number of requested lines, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::LineIndexOutOfRange`].
+    ///
+    /// If the same line is used more than once, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidInput`][std::io::ErrorKind::InvalidInput] wrapping a [`GpioError::InvalidLineConfig`].
+    pub fn new(request: &'a GpioLineRequest, clk: usize, mosi: usize, miso: Option<usize>) -> IoResult<Self> {
+        for index in [Some(clk), Some(mosi), miso].into_iter().flatten() {
+            if index >= request.num_lines() {
+                return Err(IoError::new(ErrorKind::InvalidInput, GpioError::LineIndexOutOfRange(index)));
+            }
+        }
+
+        if clk == mosi || miso == Some(clk) || miso == Some(mosi) {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                GpioError::InvalidLineConfig("SPI clock and data lines must be distinct"),
+            ));
+        }
+
+        Ok(Self {
+            request,
+            clk,
+            mosi,
+            miso,
+            mode: SpiMode::default(),
+            half_period: Duration::ZERO,
+        })
+    }
+
+    /// Set the clock polarity and phase.
+    pub fn with_mode(mut self, mode: SpiMode) -> Self {
+        self.mode = mode;
+        self
+    }
+
+    /// Set the delay between clock edges, i.e. half the clock period.
+    ///
+    /// With no delay, the clock runs as fast as the value ioctls allow.
+    pub fn with_delay(mut self, half_period: Duration) -> Self {
+        self.half_period = half_period;
+        self
+    }
+
+    /// Returns the clock polarity and phase.
+    pub fn mode(&self) -> SpiMode {
+        self.mode
+    }
+
+    /// Returns the delay between clock edges.
+    pub fn delay(&self) -> Duration {
+        self.half_period
+    }
+
+    /// Clock out `data` on MOSI, returning the bytes read from MISO at the same time.
+    ///
+    /// Without a MISO line, the returned bytes are all zero. The clock is left at its idle level.
+    ///
+    /// # Errors
+    /// If an ioctl fails, an [`IoError`][std::io::Error] with the same kind as the OS error is returned wrapping a
+    /// [`GpioError::Os`]. The transfer is abandoned part way through.
+    pub fn transfer(&self, data: &[u8]) -> IoResult<Vec<u8>> {
+        let idle = self.mode.cpol();
+        let clk_mask = 1 << self.clk;
+        let mosi_mask = 1 << self.mosi;
+        let clk_bits = |active: bool| {
+            if active {
+                clk_mask
+            } else {
+                0
+            }
+        };
+
+        self.request.set_values(clk_mask, clk_bits(idle))?;
+
+        let mut received = Vec::with_capacity(data.len());
+        for &byte in data {
+            let mut input = 0u8;
+            for bit in (0..8).rev() {
+                let mosi_bits = if byte & (1 << bit) != 0 {
+                    mosi_mask
+                } else {
+                    0
+                };
+
+                if self.mode.cpha() {
+                    // Data changes on the leading edge and is sampled on the trailing edge.
+                    self.request.set_values(clk_mask | mosi_mask, clk_bits(!idle) | mosi_bits)?;
+                    self.wait();
+                    self.request.set_values(clk_mask, clk_bits(idle))?;
+                    input = input << 1 | self.sample()? as u8;
+                    self.wait();
+                } else {
+                    // Data is set up before the leading edge and sampled on it.
+                    self.request.set_values(mosi_mask, mosi_bits)?;
+                    self.wait();
+                    self.request.set_values(clk_mask, clk_bits(!idle))?;
+                    input = input << 1 | self.sample()? as u8;
+                    self.wait();
+                    self.request.set_values(clk_mask, clk_bits(idle))?;
+                }
+            }
+            received.push(input);
+        }
+
+        Ok(received)
+    }
+
+    /// Read the MISO line, or `false` if there is none.
+    fn sample(&self) -> IoResult<bool> {
+        match self.miso {
+            Some(miso) => self.request.get(miso),
+            None => Ok(false),
+        }
+    }
+
+    /// Wait for half a clock period.
+    fn wait(&self) {
+        if !self.half_period.is_zero() {
+            sleep(self.half_period);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        crate::{GpioLineConfig, GpioLineDirection, backend::fake::fake_gpio},
+        pretty_assertions::assert_eq,
+    };
+
+    #[test]
+    fn test_transfer_modes() {
+        let gpio = fake_gpio();
+        // The fake chip reads back driven values, so holding MISO high reads all ones.
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output).with_output_value(2, true);
+        let request = gpio.request_lines(&[0, 1, 2], &config).unwrap();
+
+        for mode in [SpiMode::Mode0, SpiMode::Mode1, SpiMode::Mode2, SpiMode::Mode3] {
+            let spi = BitBangSpi::new(&request, 0, 1, Some(2)).unwrap().with_mode(mode);
+            assert_eq!(spi.transfer(&[0xa5, 0x00]).unwrap(), vec![0xff, 0xff]);
+            assert_eq!(request.get(0).unwrap(), mode.cpol(), "{mode}");
+        }
+
+        let spi = BitBangSpi::new(&request, 0, 1, None).unwrap();
+        assert_eq!(spi.transfer(&[0x01]).unwrap(), vec![0x00]);
+        assert!(request.get(1).unwrap());
+    }
+
+    #[test]
+    fn test_invalid_lines() {
+        let gpio = fake_gpio();
+        let config = GpioLineConfig::default().with_direction(GpioLineDirection::Output);
+        let request = gpio.request_lines(&[0, 1, 2], &config).unwrap();
+
+        assert_eq!(BitBangSpi::new(&request, 0, 3, None).unwrap_err().kind(), ErrorKind::InvalidInput);
+        assert_eq!(BitBangSpi::new(&request, 0, 1, Some(0)).unwrap_err().kind(), ErrorKind::InvalidInput);
+    }
+}
@@ -0,0 +1,53 @@
+//! Typed sets of line values.
+
+/// Values of some of the lines of a [`GpioLineRequest`][crate::GpioLineRequest].
+///
+/// Lines are identified by their index within the request, as for
+/// [`get_values`][crate::GpioLineRequest::get_values]. The mask records which lines have a value; lines outside of
+/// the mask read as inactive.
+#[derive(Clone, Copy, Debug, Default, Eq, Hash, PartialEq)]
+pub struct GpioLineValues {
+    mask: u64,
+    bits: u64,
+}
+
+impl GpioLineValues {
+    /// Create a set of values from a mask of the lines present and their values.
+    ///
+    /// Bits of `bits` outside of `mask` are ignored.
+    pub fn new(mask: u64, bits: u64) -> Self {
+        Self {
+            mask,
+            bits: bits & mask,
+        }
+    }
+
+    /// Returns the value of the line at `index`: `true` if it is present and active.
+    pub fn get(&self, index: usize) -> bool {
+        index < u64::BITS as usize && self.bits & (1 << index) != 0
+    }
+
+    /// Set the value of the line at `index`, adding it to the mask.
+    ///
+    /// # Panics
+    /// Panics if `index` is not less than 64, the maximum number of lines in a request.
+    pub fn set(&mut self, index: usize, value: bool) {
+        assert!(index < u64::BITS as usize, "GPIO line index out of range: {index}");
+        self.mask |= 1 << index;
+        if value {
+            self.bits |= 1 << index;
+        } else {
+            self.bits &= !(1 << index);
+        }
+    }
+
+    /// Returns the mask of lines present in this set.
+    pub fn mask(&self) -> u64 {
+        self.mask
+    }
+
+    /// Returns the values of the lines, with bit `n` set if line `n` is active.
+    pub fn bits(&self) -> u64 {
+        self.bits
+    }
+}
@@ -1,7 +1,7 @@
 use {
     clap::{Parser, Subcommand},
     gpio_linux_char::Gpio,
-    std::{error::Error, path::Path, process::ExitCode},
+    std::{error::Error, io::stdout, path::Path, process::ExitCode},
 };
 
 #[derive(Parser)]
@@ -73,21 +73,6 @@ fn handle_lines(chip: Option<String>) -> Result<(), Box<dyn Error>> {
 
 fn handle_lines_for_chip(chip: &Path) -> Result<(), Box<dyn Error>> {
     let gpio = Gpio::open(chip)?;
-    let chip_info = gpio.get_chip_info()?;
-
-    println!("Chip: {}", chip.to_string_lossy());
-    println!("    Line   Offset Name                 Consumer             Flags");
-    for line in 0..chip_info.lines {
-        let info = match gpio.get_line_info(line) {
-            Ok(info) => info,
-            Err(e) => {
-                eprintln!("Error getting line info for line {}: {}", line, e);
-                return Err(e.into());
-            }
-        };
-
-        println!("    {:>6} {:>6} {:<20} {:<20} {}", line, info.offset, info.name, info.consumer, info.flags);
-    }
-
+    gpio.dump(stdout().lock())?;
     Ok(())
 }
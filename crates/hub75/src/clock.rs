@@ -0,0 +1,110 @@
+//! Displaying the time, for the many panels used as clocks.
+
+use {
+    crate::{Hub75Panel, text::draw_centered_text},
+    gpio_linux_char::CancelToken,
+    image::Rgba,
+    std::{
+        ffi::CString,
+        io::{Error as IoError, ErrorKind, Result as IoResult},
+        mem::zeroed,
+        time::{Duration, SystemTime, UNIX_EPOCH},
+    },
+};
+
+/// How far ahead of the clock the second to display is chosen, so waking up slightly early from the wait for a second
+/// boundary still shows the new second.
+const TICK_SLACK: Duration = Duration::from_millis(10);
+
+/// The longest formatted time displayed, in bytes.
+const MAX_TIME_LEN: usize = 128;
+
+impl Hub75Panel {
+    /// Display the local time, centered on the panel and updated at the start of every second, until `cancel` is
+    /// cancelled.
+    ///
+    /// The time is formatted with `format` as for C's `strftime`, e.g. `"%H:%M:%S"` or `"%l:%M %p"`, using the time
+    /// zone given by the `TZ` environment variable or the system default. Each update is drawn into the back buffer
+    /// and swapped in (see [`swap_buffers`][Self::swap_buffers]), so the display never shows a partly drawn time,
+    /// and the panel is only redrawn when the text changes. Brightness, color correction, and the other display
+    /// settings apply as usual, and can be changed while the clock runs.
+    ///
+    /// This only draws into the frame buffer, so the refresh thread should be running (see
+    /// [`start`][Hub75Panel::start]) for the time to be displayed. When cancelled, the last time drawn is left on the
+    /// display; cancellation is not an error.
+    ///
+    /// # Errors
+    /// If `format` contains a NUL character, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidInput`][std::io::ErrorKind::InvalidInput]. If the back buffer has been replaced with an image of
+    /// another size, the error is returned as for [`swap_buffers`][Self::swap_buffers].
+    pub fn clock(&mut self, cancel: &CancelToken, format: &str, color: Rgba<u8>) -> IoResult<()> {
+        let Ok(format) = CString::new(format) else {
+            return Err(IoError::new(ErrorKind::InvalidInput, "Clock format contains a NUL character"));
+        };
+
+        let mut shown = None;
+        loop {
+            let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default();
+            let (second, wait) = next_tick(now);
+            let text = format_local_time(second, &format);
+            if shown.as_ref() != Some(&text) {
+                {
+                    let mut buffer = self.draw_buffer();
+                    buffer.fill(0);
+                    draw_centered_text(&mut buffer, &text, color);
+                }
+                self.swap_buffers()?;
+                shown = Some(text);
+            }
+
+            if cancel.wait_timeout(wait) {
+                return Ok(());
+            }
+        }
+    }
+}
+
+/// Returns the second to display at `now` (since the Unix epoch) and how long to wait for the next one to start.
+fn next_tick(now: Duration) -> (u64, Duration) {
+    let second = (now + TICK_SLACK).as_secs();
+    (second, Duration::from_secs(second + 1) - now)
+}
+
+/// Format `second` (since the Unix epoch) as local time with the `strftime` format `format`.
+///
+/// Returns an empty string if the time cannot be converted or the result is longer than [`MAX_TIME_LEN`].
+fn format_local_time(second: u64, format: &CString) -> String {
+    let Ok(time) = libc::time_t::try_from(second) else {
+        return String::new();
+    };
+
+    let mut tm: libc::tm = unsafe { zeroed() };
+    if unsafe { libc::localtime_r(&time, &mut tm) }.is_null() {
+        return String::new();
+    }
+
+    let mut buf = [0u8; MAX_TIME_LEN];
+    let len = unsafe { libc::strftime(buf.as_mut_ptr().cast(), buf.len(), format.as_ptr(), &tm) };
+    String::from_utf8_lossy(&buf[..len]).into_owned()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_next_tick() {
+        assert_eq!(next_tick(Duration::from_millis(41_250)), (41, Duration::from_millis(750)));
+        assert_eq!(next_tick(Duration::from_secs(42)), (42, Duration::from_secs(1)));
+
+        // Waking just before the boundary shows the new second and waits for the one after.
+        assert_eq!(next_tick(Duration::from_millis(42_995)), (43, Duration::from_millis(1005)));
+    }
+
+    #[test]
+    fn test_format_local_time() {
+        // Seconds are the same in every time zone.
+        assert_eq!(format_local_time(90, &CString::new("%S%%").unwrap()), "30%");
+        assert_eq!(format_local_time(90, &CString::new("").unwrap()), "");
+    }
+}
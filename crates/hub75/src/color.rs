@@ -0,0 +1,178 @@
+//! Colors quantized to the panel's color depth, and per-channel color correction.
+
+use {crate::Hub75Panel, image::Rgba};
+
+/// Lookup tables mapping the red, green, and blue 8-bit intensities of the frame to the intensities displayed, after
+/// color correction and gamma correction.
+pub(crate) type ChannelTables = [[u8; 256]; 3];
+
+/// An opaque color with `depth` bits per channel, matching what a panel configured with that
+/// [`color_depth`][crate::Hub75Config::color_depth] can actually display.
+///
+/// The panel displays only the most significant `color_depth` bits of each channel, so 8-bit colors that differ only
+/// in the lower bits look the same. Quantizing a color once when it is drawn makes that explicit: the levels of a
+/// `PanelColor` are what the panel shows, and converting it to [`Rgba`] and back gives the same color.
+#[derive(Clone, Copy, Debug, Eq, Hash, PartialEq)]
+pub struct PanelColor {
+    depth: u8,
+    r: u8,
+    g: u8,
+    b: u8,
+}
+
+impl PanelColor {
+    /// Returns the color with 8-bit components `r`, `g`, and `b` quantized to `depth` bits per channel.
+    ///
+    /// # Panics
+    ///
+    /// If `depth` is not between 1 and 8.
+    pub fn new(depth: u8, r: u8, g: u8, b: u8) -> Self {
+        assert!((1..=8).contains(&depth), "color depth must be between 1 and 8");
+        let shift = 8 - depth;
+        Self {
+            depth,
+            r: r >> shift,
+            g: g >> shift,
+            b: b >> shift,
+        }
+    }
+
+    /// Returns `color` quantized to `depth` bits per channel. The alpha channel is ignored.
+    ///
+    /// # Panics
+    ///
+    /// If `depth` is not between 1 and 8.
+    pub fn from_rgba(depth: u8, color: Rgba<u8>) -> Self {
+        let Rgba([r, g, b, _]) = color;
+        Self::new(depth, r, g, b)
+    }
+
+    /// Returns the number of bits per channel.
+    pub fn depth(&self) -> u8 {
+        self.depth
+    }
+
+    /// Returns the red, green, and blue levels, each from 0 to `2^depth - 1`.
+    pub fn levels(&self) -> (u8, u8, u8) {
+        (self.r, self.g, self.b)
+    }
+
+    /// Returns the color as opaque 8-bit RGBA.
+    ///
+    /// Each level is expanded by repeating its bits, so the maximum level maps to 255 and the most significant
+    /// `depth` bits of each component are the level itself.
+    pub fn to_rgba(&self) -> Rgba<u8> {
+        Rgba([self.expand(self.r), self.expand(self.g), self.expand(self.b), 0xff])
+    }
+
+    /// Expands a `depth`-bit level to 8 bits by bit replication.
+    fn expand(&self, level: u8) -> u8 {
+        let mut value = 0u16;
+        let mut filled = 0;
+        while filled < 8 {
+            value = (value << self.depth) | level as u16;
+            filled += self.depth;
+        }
+        (value >> (filled - 8)) as u8
+    }
+}
+
+impl From<PanelColor> for Rgba<u8> {
+    fn from(color: PanelColor) -> Self {
+        color.to_rgba()
+    }
+}
+
+impl Hub75Panel {
+    /// Returns the number of bits per color channel the panel displays.
+    pub fn color_depth(&self) -> u8 {
+        self.shared.color_depth
+    }
+
+    /// Returns the color with 8-bit components `r`, `g`, and `b` quantized to the panel's color depth.
+    pub fn color(&self, r: u8, g: u8, b: u8) -> PanelColor {
+        PanelColor::new(self.shared.color_depth, r, g, b)
+    }
+
+    /// Scale the red, green, and blue channels by `r_scale`, `g_scale`, and `b_scale` (1.0 each by default) to
+    /// calibrate the panel's white point.
+    ///
+    /// LEDs of different panels differ in relative brightness, so pure white may look tinted; dimming the channels
+    /// that are too strong makes it neutral. The scales multiply the channel values before gamma correction and are
+    /// clamped to 0.0..=1.0 (NaN is treated as 0.0). As with [`set_gamma`][Self::set_gamma], the correction is
+    /// applied when a frame is displayed, so it takes effect on the next refresh without redrawing.
+    pub fn set_color_correction(&self, r_scale: f64, g_scale: f64, b_scale: f64) {
+        let clamp = |scale: f64| {
+            if scale.is_nan() {
+                0.0
+            } else {
+                scale.clamp(0.0, 1.0)
+            }
+        };
+        *self.shared.color_correction.lock().unwrap() = [clamp(r_scale), clamp(g_scale), clamp(b_scale)];
+    }
+
+    /// Returns the red, green, and blue scales set by [`set_color_correction`][Self::set_color_correction].
+    pub fn color_correction(&self) -> (f64, f64, f64) {
+        let [r, g, b] = *self.shared.color_correction.lock().unwrap();
+        (r, g, b)
+    }
+
+    /// Set a pixel in the frame buffer to a quantized color. As with [`set_pixel`][Self::set_pixel], coordinates
+    /// outside of the panel are ignored.
+    pub fn set_pixel_color(&mut self, x: i32, y: i32, color: PanelColor) {
+        self.set_pixel(x, y, color.to_rgba());
+    }
+
+    /// Returns the frame buffer's pixel at (`x`, `y`) quantized to the panel's color depth, or `None` if the
+    /// coordinates are outside of the panel.
+    pub fn get_pixel_color(&self, x: i32, y: i32) -> Option<PanelColor> {
+        self.get_pixel(x, y).map(|color| PanelColor::from_rgba(self.shared.color_depth, color))
+    }
+}
+
+/// Returns the tables mapping each channel's intensities through its scale from `correction` and then `gamma`.
+pub(crate) fn channel_tables(gamma: &[u8; 256], correction: [f64; 3]) -> ChannelTables {
+    let mut tables = [[0; 256]; 3];
+    for (table, scale) in tables.iter_mut().zip(correction) {
+        for (i, entry) in table.iter_mut().enumerate() {
+            *entry = gamma[(i as f64 * scale).round() as usize];
+        }
+    }
+    tables
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_round_trip() {
+        for depth in 1..=8 {
+            for value in 0..=255 {
+                let color = PanelColor::new(depth, value, value, value);
+                assert_eq!(PanelColor::from_rgba(depth, color.to_rgba()), color);
+            }
+        }
+    }
+
+    #[test]
+    fn test_expand() {
+        assert_eq!(PanelColor::new(4, 0xff, 0x80, 0x0f).to_rgba(), Rgba([0xff, 0x88, 0x00, 0xff]));
+        assert_eq!(PanelColor::new(3, 0x60, 0, 0).to_rgba(), Rgba([0x6d, 0, 0, 0xff]));
+        assert_eq!(PanelColor::new(1, 0x80, 0x7f, 0).levels(), (1, 0, 0));
+        assert_eq!(PanelColor::new(8, 0x12, 0x34, 0x56).to_rgba(), Rgba([0x12, 0x34, 0x56, 0xff]));
+    }
+
+    #[test]
+    fn test_channel_tables() {
+        let mut gamma = [0; 256];
+        for (i, entry) in gamma.iter_mut().enumerate() {
+            *entry = 255 - i as u8;
+        }
+
+        let tables = channel_tables(&gamma, [1.0, 0.5, 0.0]);
+        assert_eq!((tables[0][200], tables[1][200], tables[2][200]), (55, 155, 255));
+        assert_eq!(tables[1][255], gamma[128]);
+    }
+}
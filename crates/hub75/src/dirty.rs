@@ -0,0 +1,335 @@
+//! Precomputed line writes for refreshing the panel, reused for row addresses whose pixels have not changed since the
+//! last refresh.
+
+use {
+    crate::{COLOR_MASK, Hub75Panel, LINE_CLK, LINE_R1, Shared, color::ChannelTables},
+    std::sync::atomic::Ordering,
+};
+
+/// The line writes that shift out each row address and bit plane, kept between refreshes.
+#[derive(Debug)]
+pub(crate) struct ShiftCache {
+    /// For each row address, the byte offsets within the frame of the top and bottom pixel shifted out on each clock.
+    order: Vec<Vec<(usize, usize)>>,
+
+    /// For each row address, the frame rows it displays.
+    address_rows: Vec<Vec<usize>>,
+
+    /// The length of a frame row, in bytes.
+    stride: usize,
+
+    color_depth: u8,
+
+    /// The `(mask, bits)` line writes shifting out each bit plane, indexed by `address * color_depth + plane`.
+    writes: Vec<Vec<(u64, u64)>>,
+
+    /// The frame and channel tables `writes` was computed from, if any.
+    previous: Option<(Vec<u8>, ChannelTables)>,
+}
+
+impl ShiftCache {
+    /// Returns an empty cache for a display scanned in `order`, with rows of `stride` bytes.
+    pub(crate) fn new(order: Vec<Vec<(usize, usize)>>, stride: usize, color_depth: u8) -> Self {
+        let address_rows = order
+            .iter()
+            .map(|clocks| {
+                let mut rows: Vec<usize> =
+                    clocks.iter().flat_map(|&(top, bottom)| [top / stride, bottom / stride]).collect();
+                rows.sort_unstable();
+                rows.dedup();
+                rows
+            })
+            .collect();
+        let writes = vec![Vec::new(); order.len() * color_depth as usize];
+
+        Self {
+            order,
+            address_rows,
+            stride,
+            color_depth,
+            writes,
+            previous: None,
+        }
+    }
+
+    /// Recompute the line writes for `frame`, returning the number of row addresses recomputed.
+    ///
+    /// Only addresses displaying a row that differs from the previous frame are recomputed, unless the channel tables
+    /// changed, in which case every address is.
+    pub(crate) fn update(&mut self, frame: &[u8], tables: &ChannelTables) -> usize {
+        let previous = self
+            .previous
+            .take()
+            .filter(|(previous, previous_tables)| previous.len() == frame.len() && previous_tables == tables);
+
+        let mut updated = 0;
+        for address in 0..self.order.len() {
+            if let Some((previous, _)) = &previous {
+                if !rows_changed(previous, frame, self.stride, &self.address_rows[address]) {
+                    continue;
+                }
+            }
+            self.pack(frame, tables, address);
+            updated += 1;
+        }
+
+        let mut previous = previous.map(|(previous, _)| previous).unwrap_or_default();
+        previous.clear();
+        previous.extend_from_slice(frame);
+        self.previous = Some((previous, *tables));
+        updated
+    }
+
+    /// Returns the `(mask, bits)` line writes that shift out bit plane `plane` of row address `address`.
+    pub(crate) fn writes(&self, address: usize, plane: usize) -> &[(u64, u64)] {
+        &self.writes[address * self.color_depth as usize + plane]
+    }
+
+    /// Compute the writes for every bit plane of row address `address` from `frame`, mapping each channel through its
+    /// table.
+    ///
+    /// Each clock takes two writes: the six color bits together with CLK inactive, so the data lines settle together
+    /// before the edge, then CLK active.
+    fn pack(&mut self, frame: &[u8], tables: &ChannelTables, address: usize) {
+        let depth = self.color_depth as usize;
+        let planes = &mut self.writes[address * depth..(address + 1) * depth];
+        for plane in planes.iter_mut() {
+            plane.clear();
+        }
+
+        for &(top, bottom) in &self.order[address] {
+            let mut values = [0; 6];
+            for (i, value) in frame[top..top + 3].iter().chain(&frame[bottom..bottom + 3]).enumerate() {
+                values[i] = tables[i % 3][*value as usize];
+            }
+
+            for (plane, writes) in planes.iter_mut().enumerate() {
+                let mut bits = 0;
+                for (i, value) in values.iter().enumerate() {
+                    if value & (1 << (8 - depth + plane)) != 0 {
+                        bits |= 1 << (LINE_R1 + i);
+                    }
+                }
+                writes.push((COLOR_MASK | 1 << LINE_CLK, bits));
+                writes.push((1 << LINE_CLK, 1 << LINE_CLK));
+            }
+        }
+    }
+}
+
+impl Hub75Panel {
+    /// Enable or disable dirty tracking (disabled by default), which saves bus cycles when refreshing mostly static
+    /// content such as a clock.
+    ///
+    /// Every refresh compares the frame with the previous one and recomputes the line writes to shift out only for
+    /// row addresses displaying a row that changed; every drawing method, including
+    /// [`swap_buffers`][Self::swap_buffers], is covered because the comparison is made on the frame itself. With
+    /// dirty tracking, shifting out a bit plane is also skipped when the shift registers already hold the same data,
+    /// e.g. for blank rows or rows of fully saturated colors, whose bit planes are all alike. This relies on the
+    /// panel's drivers keeping their shift register contents after a latch, as common HUB75 drivers do.
+    ///
+    /// The panel only holds one bit plane of one row address at a time, so binary code modulation still has to
+    /// display every bit plane of every address on each refresh, and unchanged row addresses are still lit for their
+    /// full time. The savings are at row address (row pair) granularity: changing a single pixel recomputes every bit
+    /// plane of the rows sharing its address, and frames that change everywhere gain nothing.
+    pub fn set_dirty_tracking(&self, enabled: bool) {
+        self.shared.dirty_tracking.store(enabled, Ordering::SeqCst);
+    }
+}
+
+impl Shared {
+    /// Returns, for each row address, the byte offsets within the frame of the top and bottom pixel shifted out on
+    /// each clock.
+    pub(crate) fn scan_order(&self) -> Vec<Vec<(usize, usize)>> {
+        let half = self.panel_height / 2;
+        let segments = half / self.scan_rate;
+        let offset = |(x, y): (u32, u32)| (y as usize * self.width as usize + x as usize) * 4;
+
+        (0..self.scan_rate)
+            .map(|y| {
+                let mut order = Vec::with_capacity(self.columns.len() * segments as usize);
+                for panel_columns in self.columns.chunks(self.panel_width as usize) {
+                    for segment in (0..segments).rev() {
+                        let row = y + segment * self.scan_rate;
+                        for &x in panel_columns {
+                            order.push((offset(self.display_pixel(x, row)), offset(self.display_pixel(x, row + half))));
+                        }
+                    }
+                }
+                order
+            })
+            .collect()
+    }
+}
+
+/// Returns whether any of `rows`, each `stride` bytes long, differ between `previous` and `frame`.
+fn rows_changed(previous: &[u8], frame: &[u8], stride: usize, rows: &[usize]) -> bool {
+    rows.iter().any(|&row| {
+        let range = row * stride..(row + 1) * stride;
+        previous[range.clone()] != frame[range]
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        crate::{BCM_BASE_TIME, tests::fake_panel_with},
+        image::Rgba,
+        std::{hint::black_box, time::Instant},
+    };
+
+    /// Returns the scan order of a single `width` by `height` panel at 1/`height / 2` scan.
+    fn single_panel_order(width: usize, height: usize) -> Vec<Vec<(usize, usize)>> {
+        let half = height / 2;
+        let offset = |x: usize, y: usize| (y * width + x) * 4;
+        (0..half).map(|y| (0..width).map(|x| (offset(x, y), offset(x, y + half))).collect()).collect()
+    }
+
+    fn identity_tables() -> ChannelTables {
+        let mut table = [0; 256];
+        for (i, entry) in table.iter_mut().enumerate() {
+            *entry = i as u8;
+        }
+        [table; 3]
+    }
+
+    /// Returns the color line values shifted out on each clock by the writes of a bit plane.
+    fn clocked_bits(cache: &ShiftCache, address: usize, plane: usize) -> Vec<u64> {
+        cache.writes(address, plane).iter().step_by(2).map(|&(_, bits)| bits).collect()
+    }
+
+    #[test]
+    fn test_update_recomputes_changed_addresses() {
+        let tables = identity_tables();
+        let mut cache = ShiftCache::new(single_panel_order(4, 4), 16, 2);
+        let mut frame = vec![0; 64];
+        assert_eq!(cache.update(&frame, &tables), 2);
+        assert_eq!(cache.update(&frame, &tables), 0);
+
+        // Pixel (1, 2) is the bottom half of address 0; red 0x80 sets only the most significant plane of R2.
+        frame[(2 * 4 + 1) * 4] = 0x80;
+        assert_eq!(cache.update(&frame, &tables), 1);
+        assert_eq!(clocked_bits(&cache, 0, 0), [0, 0, 0, 0]);
+        assert_eq!(clocked_bits(&cache, 0, 1), [0, 1 << (LINE_R1 + 3), 0, 0]);
+        assert_eq!(clocked_bits(&cache, 1, 1), [0, 0, 0, 0]);
+        assert_eq!(
+            cache.writes(0, 1)[2..4],
+            [(COLOR_MASK | 1 << LINE_CLK, 1 << (LINE_R1 + 3)), (1 << LINE_CLK, 1 << LINE_CLK)]
+        );
+
+        let mut brighter = tables;
+        brighter[0][0x80] = 0xc0;
+        assert_eq!(cache.update(&frame, &brighter), 2);
+        assert_eq!(clocked_bits(&cache, 0, 0), [0, 1 << (LINE_R1 + 3), 0, 0]);
+    }
+
+    #[test]
+    fn test_rows_changed() {
+        let previous = [0u8; 12];
+        let mut frame = previous;
+        frame[5] = 1;
+        assert!(!rows_changed(&previous, &frame, 4, &[0, 2]));
+        assert!(rows_changed(&previous, &frame, 4, &[1]));
+    }
+
+    /// Compare the work done per refresh of a static 64x32 "clock" frame with that of a frame changing everywhere:
+    /// the time spent computing line writes, and the number of bit planes shifted out with dirty tracking.
+    ///
+    /// Run with `cargo test --release -p hub75 -- --ignored --nocapture bench_static_refresh`.
+    #[test]
+    #[ignore]
+    fn bench_static_refresh() {
+        const FRAMES: u32 = 1000;
+        const DEPTH: u8 = 8;
+        let tables = identity_tables();
+        let mut frame = vec![0; 64 * 32 * 4];
+        for y in 12..20 {
+            for x in 8..56 {
+                if x % 8 < 5 {
+                    frame[(y * 64 + x) * 4..(y * 64 + x) * 4 + 3].fill(0xff);
+                }
+            }
+        }
+        let inverse: Vec<u8> = frame.iter().map(|value| !value).collect();
+
+        let mut cache = ShiftCache::new(single_panel_order(64, 32), 64 * 4, DEPTH);
+        let start = Instant::now();
+        for i in 0..FRAMES {
+            let frame = if i % 2 == 0 {
+                &frame
+            } else {
+                &inverse
+            };
+            black_box(cache.update(black_box(frame), &tables));
+        }
+        let changing = start.elapsed() / FRAMES;
+
+        let start = Instant::now();
+        for _ in 0..FRAMES {
+            black_box(cache.update(black_box(&frame), &tables));
+        }
+        let unchanged = start.elapsed() / FRAMES;
+
+        let mut shifted = 0;
+        let mut loaded = None;
+        for address in 0..16 {
+            for plane in 0..DEPTH as usize {
+                let writes = cache.writes(address, plane);
+                if loaded != Some(writes) {
+                    shifted += 1;
+                }
+                loaded = Some(writes);
+            }
+        }
+
+        println!(
+            "line writes computed in {changing:?}/frame, unchanged frames take {unchanged:?}/frame; with dirty \
+             tracking, {shifted} of {} bit planes shifted out",
+            16 * DEPTH as usize
+        );
+    }
+
+    /// Compare the frame rate of refreshing a static 64x32 frame at 1/16 scan from the cached line writes with that
+    /// of rebuilding them for every frame, as refreshes did before they were cached.
+    ///
+    /// The panel is on a fake GPIO chip, so the line writes cost no system calls and most of each frame is spent in
+    /// the busy-waits of binary code modulation. Besides the frame rates, the time per frame beyond those waits is
+    /// reported; the difference between the two is the work the cache saves.
+    ///
+    /// Run with `cargo test --release -p hub75 -- --ignored --nocapture bench_cached_refresh`.
+    #[test]
+    #[ignore]
+    fn bench_cached_refresh() {
+        const FRAMES: u32 = 200;
+        const SCAN_RATE: u32 = 16;
+        const DEPTH: u8 = 8;
+        let mut panel = fake_panel_with(64, 32, SCAN_RATE, DEPTH);
+        panel.draw_rect(8, 12, 48, 8, Rgba([0xff; 4]), true);
+        let shared = &panel.shared;
+        let frame = shared.physical_frame().unwrap();
+        let bcm_time = BCM_BASE_TIME * ((1 << DEPTH) - 1) * SCAN_RATE;
+
+        let start = Instant::now();
+        for _ in 0..FRAMES {
+            *shared.shift_cache.lock().unwrap() = None;
+            shared.refresh(&frame).unwrap();
+        }
+        let rebuilt = start.elapsed() / FRAMES;
+
+        let start = Instant::now();
+        for _ in 0..FRAMES {
+            shared.refresh(&frame).unwrap();
+        }
+        let cached = start.elapsed() / FRAMES;
+
+        println!(
+            "rebuilding line writes: {:.1} frames/s ({:?}/frame beyond BCM), cached line writes: {:.1} frames/s \
+             ({:?}/frame beyond BCM)",
+            1.0 / rebuilt.as_secs_f64(),
+            rebuilt.saturating_sub(bcm_time),
+            1.0 / cached.as_secs_f64(),
+            cached.saturating_sub(bcm_time)
+        );
+    }
+}
@@ -0,0 +1,388 @@
+//! Drawing into the panel's frame buffer.
+
+use {
+    crate::{Hub75Panel, Shared, put_pixel},
+    embedded_graphics::{
+        Pixel,
+        draw_target::DrawTarget,
+        geometry::{OriginDimensions, Size},
+        pixelcolor::{Rgb888, RgbColor},
+    },
+    image::{GenericImageView, Rgba, RgbaImage},
+    std::convert::Infallible,
+};
+
+impl Hub75Panel {
+    /// Returns the color of a pixel in the frame buffer, or `None` if the coordinates are outside of the panel.
+    pub fn get_pixel(&self, x: i32, y: i32) -> Option<Rgba<u8>> {
+        let (Ok(x), Ok(y)) = (u32::try_from(x), u32::try_from(y)) else {
+            return None;
+        };
+
+        self.shared.buffer.lock().unwrap().get_pixel_checked(x, y).copied()
+    }
+
+    /// Returns a copy of the frame buffer, i.e. what the panel is showing.
+    ///
+    /// This is the logical image as drawn, with the dimensions reported by [`size`][Self::size]; it is useful for
+    /// comparing rendered output against a reference image in tests, or for saving the current display with
+    /// [`RgbaImage::save`][image::ImageBuffer::save].
+    pub fn snapshot(&self) -> RgbaImage {
+        self.shared.snapshot()
+    }
+
+    /// Set every pixel in the frame buffer to transparent black, turning the whole display off on the next refresh.
+    pub fn clear(&mut self) {
+        self.shared.buffer.lock().unwrap().fill(0);
+    }
+
+    /// Set every pixel in the frame buffer to `color`.
+    pub fn fill(&mut self, color: Rgba<u8>) {
+        for pixel in self.shared.buffer.lock().unwrap().pixels_mut() {
+            *pixel = color;
+        }
+    }
+
+    /// Draw a line from (`x0`, `y0`) to (`x1`, `y1`), including both end points, using Bresenham's algorithm.
+    ///
+    /// Parts of the line that fall outside of the panel are clipped.
+    pub fn draw_line(&mut self, x0: i32, y0: i32, x1: i32, y1: i32, color: Rgba<u8>) {
+        draw_line(&mut self.shared.buffer.lock().unwrap(), x0, y0, x1, y1, color);
+    }
+
+    /// Draw a rectangle `width` by `height` pixels with its top-left corner at (`x`, `y`), either filled or as a
+    /// one-pixel outline.
+    ///
+    /// Parts of the rectangle that fall outside of the panel are clipped. Nothing is drawn if `width` or `height` is
+    /// not positive.
+    pub fn draw_rect(&mut self, x: i32, y: i32, width: i32, height: i32, color: Rgba<u8>, fill: bool) {
+        draw_rect(&mut self.shared.buffer.lock().unwrap(), x, y, width, height, color, fill);
+    }
+
+    /// Draw a circle of radius `radius` centered on (`cx`, `cy`), either filled or as a one-pixel outline, using the
+    /// midpoint circle algorithm.
+    ///
+    /// Parts of the circle that fall outside of the panel are clipped. A radius of 0 draws a single pixel; nothing is
+    /// drawn if `radius` is negative.
+    pub fn draw_circle(&mut self, cx: i32, cy: i32, radius: i32, color: Rgba<u8>, fill: bool) {
+        draw_circle(&mut self.shared.buffer.lock().unwrap(), cx, cy, radius, color, fill);
+    }
+
+    /// Copy an image into the frame buffer with its top-left corner at (`x`, `y`), replacing the pixels underneath.
+    ///
+    /// Parts of the image that fall outside of the panel are clipped.
+    pub fn draw_image<I>(&mut self, x: i32, y: i32, image: &I)
+    where
+        I: GenericImageView<Pixel = Rgba<u8>>,
+    {
+        draw_image(&mut self.shared.buffer.lock().unwrap(), x, y, image);
+    }
+
+    /// Composite a sprite over the frame buffer with its top-left corner at (`x`, `y`), respecting its alpha channel.
+    ///
+    /// Fully transparent sprite pixels leave the frame buffer unchanged, fully opaque ones replace it as for
+    /// [`draw_image`][Self::draw_image], and partially transparent ones are blended with the color underneath. The
+    /// color underneath is taken as displayed, so blending over transparent black blends with black. Parts of the
+    /// sprite that fall outside of the panel are clipped.
+    pub fn draw_sprite<I>(&mut self, x: i32, y: i32, sprite: &I)
+    where
+        I: GenericImageView<Pixel = Rgba<u8>>,
+    {
+        draw_sprite(&mut self.shared.buffer.lock().unwrap(), x, y, sprite);
+    }
+}
+
+/// Draw a line into `image`, as for [`Hub75Panel::draw_line`].
+pub(crate) fn draw_line(image: &mut RgbaImage, x0: i32, y0: i32, x1: i32, y1: i32, color: Rgba<u8>) {
+    let dx = (x1 - x0).abs();
+    let dy = -(y1 - y0).abs();
+    let step_x = if x0 < x1 {
+        1
+    } else {
+        -1
+    };
+    let step_y = if y0 < y1 {
+        1
+    } else {
+        -1
+    };
+    let (mut x, mut y) = (x0, y0);
+    let mut error = dx + dy;
+
+    loop {
+        if let (Ok(px), Ok(py)) = (u32::try_from(x), u32::try_from(y)) {
+            if let Some(pixel) = image.get_pixel_mut_checked(px, py) {
+                *pixel = color;
+            }
+        }
+
+        if x == x1 && y == y1 {
+            break;
+        }
+
+        let error2 = 2 * error;
+        if error2 >= dy {
+            error += dy;
+            x += step_x;
+        }
+        if error2 <= dx {
+            error += dx;
+            y += step_y;
+        }
+    }
+}
+
+/// Draw a rectangle into `image`, as for [`Hub75Panel::draw_rect`].
+pub(crate) fn draw_rect(image: &mut RgbaImage, x: i32, y: i32, width: i32, height: i32, color: Rgba<u8>, fill: bool) {
+    if width <= 0 || height <= 0 {
+        return;
+    }
+
+    let (right, bottom) = (x + width - 1, y + height - 1);
+    if fill {
+        fill_rect(image, x, y, right, bottom, color);
+    } else {
+        fill_rect(image, x, y, right, y, color);
+        fill_rect(image, x, bottom, right, bottom, color);
+        fill_rect(image, x, y, x, bottom, color);
+        fill_rect(image, right, y, right, bottom, color);
+    }
+}
+
+/// Copy `source` into `image` with its top-left corner at (`x`, `y`), as for [`Hub75Panel::draw_image`].
+pub(crate) fn draw_image<I>(image: &mut RgbaImage, x: i32, y: i32, source: &I)
+where
+    I: GenericImageView<Pixel = Rgba<u8>>,
+{
+    let (width, height) = source.dimensions();
+    for src_y in 0..height {
+        let Ok(dst_y) = u32::try_from(y + src_y as i32) else {
+            continue;
+        };
+
+        for src_x in 0..width {
+            let Ok(dst_x) = u32::try_from(x + src_x as i32) else {
+                continue;
+            };
+
+            if let Some(pixel) = image.get_pixel_mut_checked(dst_x, dst_y) {
+                *pixel = source.get_pixel(src_x, src_y);
+            }
+        }
+    }
+}
+
+/// Composite `sprite` over `image` with its top-left corner at (`x`, `y`), as for [`Hub75Panel::draw_sprite`].
+pub(crate) fn draw_sprite<I>(image: &mut RgbaImage, x: i32, y: i32, sprite: &I)
+where
+    I: GenericImageView<Pixel = Rgba<u8>>,
+{
+    let (width, height) = sprite.dimensions();
+    for src_y in 0..height {
+        let Ok(dst_y) = u32::try_from(y + src_y as i32) else {
+            continue;
+        };
+
+        for src_x in 0..width {
+            let Ok(dst_x) = u32::try_from(x + src_x as i32) else {
+                continue;
+            };
+
+            if let Some(pixel) = image.get_pixel_mut_checked(dst_x, dst_y) {
+                *pixel = blend(*pixel, sprite.get_pixel(src_x, src_y));
+            }
+        }
+    }
+}
+
+/// Returns `src` composited over `dst`, ignoring the alpha of `dst` (the panel displays its color regardless).
+fn blend(dst: Rgba<u8>, src: Rgba<u8>) -> Rgba<u8> {
+    match src.0[3] {
+        0 => dst,
+        0xff => src,
+        alpha => {
+            let alpha = alpha as u16;
+            let mix = |s: u8, d: u8| ((s as u16 * alpha + d as u16 * (255 - alpha) + 127) / 255) as u8;
+            let [r, g, b, _] = src.0;
+            let [dr, dg, db, da] = dst.0;
+            let da = da as u16;
+            Rgba([mix(r, dr), mix(g, dg), mix(b, db), (alpha + (da * (255 - alpha) + 127) / 255) as u8])
+        }
+    }
+}
+
+/// Fill the rectangle from (`left`, `top`) to (`right`, `bottom`) inclusive, clipped to the image, one row slice at a
+/// time.
+fn fill_rect(image: &mut RgbaImage, left: i32, top: i32, right: i32, bottom: i32, color: Rgba<u8>) {
+    let (width, height) = (image.width() as i32, image.height() as i32);
+    let (left, right) = (left.max(0), right.min(width - 1));
+    let (top, bottom) = (top.max(0), bottom.min(height - 1));
+    if left > right || top > bottom {
+        return;
+    }
+
+    let row_bytes = width as usize * 4;
+    for row in image.chunks_exact_mut(row_bytes).skip(top as usize).take((bottom - top + 1) as usize) {
+        for pixel in row[left as usize * 4..(right as usize + 1) * 4].chunks_exact_mut(4) {
+            pixel.copy_from_slice(&color.0);
+        }
+    }
+}
+
+/// Draw a circle into `image`, as for [`Hub75Panel::draw_circle`]. Filled circles are drawn as horizontal spans.
+pub(crate) fn draw_circle(image: &mut RgbaImage, cx: i32, cy: i32, radius: i32, color: Rgba<u8>, fill: bool) {
+    if radius < 0 {
+        return;
+    }
+
+    let (mut x, mut y) = (radius, 0);
+    let mut error = 1 - radius;
+    while x >= y {
+        if fill {
+            fill_rect(image, cx - x, cy - y, cx + x, cy - y, color);
+            fill_rect(image, cx - x, cy + y, cx + x, cy + y, color);
+            fill_rect(image, cx - y, cy - x, cx + y, cy - x, color);
+            fill_rect(image, cx - y, cy + x, cx + y, cy + x, color);
+        } else {
+            for (dx, dy) in [(x, y), (y, x), (-y, x), (-x, y), (-x, -y), (-y, -x), (y, -x), (x, -y)] {
+                put_pixel(image, cx + dx, cy + dy, color.0);
+            }
+        }
+
+        y += 1;
+        if error < 0 {
+            error += 2 * y + 1;
+        } else {
+            x -= 1;
+            error += 2 * (y - x) + 1;
+        }
+    }
+}
+
+impl Shared {
+    /// Returns a copy of the frame buffer, holding its lock only while copying.
+    pub(crate) fn snapshot(&self) -> RgbaImage {
+        self.buffer.lock().unwrap().clone()
+    }
+}
+
+/// The panel can be used as an [`embedded-graphics`][embedded_graphics] draw target, so its shapes, fonts, and image
+/// formats can draw directly into the frame buffer.
+impl DrawTarget for Hub75Panel {
+    type Color = Rgb888;
+    type Error = Infallible;
+
+    fn draw_iter<I>(&mut self, pixels: I) -> Result<(), Self::Error>
+    where
+        I: IntoIterator<Item = Pixel<Self::Color>>,
+    {
+        ImageTarget(&mut self.shared.buffer.lock().unwrap()).draw_iter(pixels)
+    }
+
+    fn clear(&mut self, color: Self::Color) -> Result<(), Self::Error> {
+        self.fill(Rgba([color.r(), color.g(), color.b(), 0xff]));
+        Ok(())
+    }
+}
+
+impl OriginDimensions for Hub75Panel {
+    fn size(&self) -> Size {
+        let (width, height) = self.size();
+        Size::new(width, height)
+    }
+}
+
+/// Adapter for drawing with [`embedded-graphics`][embedded_graphics] into an off-screen image.
+pub(crate) struct ImageTarget<'a>(pub(crate) &'a mut RgbaImage);
+
+impl DrawTarget for ImageTarget<'_> {
+    type Color = Rgb888;
+    type Error = Infallible;
+
+    fn draw_iter<I>(&mut self, pixels: I) -> Result<(), Self::Error>
+    where
+        I: IntoIterator<Item = Pixel<Self::Color>>,
+    {
+        for Pixel(point, color) in pixels {
+            let (Ok(x), Ok(y)) = (u32::try_from(point.x), u32::try_from(point.y)) else {
+                continue;
+            };
+
+            if let Some(pixel) = self.0.get_pixel_mut_checked(x, y) {
+                *pixel = Rgba([color.r(), color.g(), color.b(), 0xff]);
+            }
+        }
+
+        Ok(())
+    }
+}
+
+impl OriginDimensions for ImageTarget<'_> {
+    fn size(&self) -> Size {
+        Size::new(self.0.width(), self.0.height())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Returns the rows of `image` as strings, with `#` for lit pixels.
+    fn render(image: &RgbaImage) -> Vec<String> {
+        (0..image.height())
+            .map(|y| {
+                (0..image.width())
+                    .map(|x| {
+                        if image.get_pixel(x, y).0[3] != 0 {
+                            '#'
+                        } else {
+                            '.'
+                        }
+                    })
+                    .collect()
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_draw_circle() {
+        let white = Rgba([0xff, 0xff, 0xff, 0xff]);
+        let mut image = RgbaImage::new(7, 7);
+        draw_circle(&mut image, 3, 3, 3, white, false);
+        assert_eq!(render(&image), ["..###..", ".#...#.", "#.....#", "#.....#", "#.....#", ".#...#.", "..###..",]);
+
+        let mut image = RgbaImage::new(7, 7);
+        draw_circle(&mut image, 3, 3, 3, white, true);
+        assert_eq!(render(&image), ["..###..", ".#####.", "#######", "#######", "#######", ".#####.", "..###..",]);
+
+        // Clipped at the corner of the image, and a zero radius is a single pixel.
+        let mut image = RgbaImage::new(4, 4);
+        draw_circle(&mut image, 0, 0, 2, white, true);
+        draw_circle(&mut image, 3, 3, 0, white, false);
+        assert_eq!(render(&image), ["###.", "###.", "##..", "...#"]);
+    }
+
+    #[test]
+    fn test_draw_sprite() {
+        let red = Rgba([0xff, 0, 0, 0xff]);
+        let mut image = RgbaImage::new(3, 1);
+        fill_rect(&mut image, 0, 0, 2, 0, red);
+
+        let mut sprite = RgbaImage::new(3, 1);
+        sprite.put_pixel(0, 0, Rgba([0, 0, 0xff, 0]));
+        sprite.put_pixel(1, 0, Rgba([0, 0, 0xff, 0x80]));
+        sprite.put_pixel(2, 0, Rgba([0, 0, 0xff, 0xff]));
+        draw_sprite(&mut image, 0, 0, &sprite);
+        assert_eq!(*image.get_pixel(0, 0), red);
+        assert_eq!(*image.get_pixel(1, 0), Rgba([0x7f, 0, 0x80, 0xff]));
+        assert_eq!(*image.get_pixel(2, 0), Rgba([0, 0, 0xff, 0xff]));
+
+        // Clipped at the edges, and blended over transparent black.
+        let mut image = RgbaImage::new(2, 2);
+        draw_sprite(&mut image, -2, 1, &sprite);
+        assert_eq!(*image.get_pixel(0, 1), Rgba([0, 0, 0xff, 0xff]));
+        draw_sprite(&mut image, 0, -1, &RgbaImage::from_pixel(1, 2, Rgba([0xff, 0xff, 0xff, 0x40])));
+        assert_eq!(*image.get_pixel(0, 0), Rgba([0x40, 0x40, 0x40, 0x40]));
+        assert_eq!(*image.get_pixel(1, 0), Rgba([0, 0, 0, 0]));
+    }
+}
@@ -0,0 +1,98 @@
+//! Updating the frame buffer from the refresh thread, once per frame.
+
+use {
+    crate::Hub75Panel,
+    image::RgbaImage,
+    std::fmt::{Debug, Formatter, Result as FmtResult},
+};
+
+/// A callback run with the back buffer before each frame is displayed.
+pub(crate) struct FrameCallback(pub(crate) Box<dyn FnMut(&mut RgbaImage) + Send>);
+
+impl Debug for FrameCallback {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        f.write_str("FrameCallback")
+    }
+}
+
+impl Hub75Panel {
+    /// Call `callback` with the back buffer right before each frame is displayed, replacing any previous callback.
+    ///
+    /// The callback runs on the thread refreshing the panel (the background refresh thread, or the caller of
+    /// [`refresh`][Self::refresh]) while holding the frame buffer lock, so it can update the frame exactly once per
+    /// refresh without racing the refresh or other drawing. This suits animations driven by external data: keep the
+    /// latest data where the callback can reach it, and let the callback draw the frame from it.
+    ///
+    /// The callback draws into the back buffer of [`draw_buffer`][Self::draw_buffer], which is then swapped in and
+    /// displayed as by [`swap_buffers`][Self::swap_buffers]. As after any swap, the back buffer the callback gets
+    /// holds the frame displayed before the last one, so it should draw each frame in full. This also means drawing
+    /// to the front buffer with the panel's drawing methods only shows until the next refresh.
+    ///
+    /// Each frame waits for the callback, and the panel is dark while it runs, so it should do little more than
+    /// draw. The back buffer is passed directly; the callback must not call the panel's drawing methods, which would
+    /// wait forever for the lock it holds. It must not replace the back buffer with an image of another size either;
+    /// if it does, the frame is not displayed and the refresh fails (see [`refresh`][Self::refresh]).
+    pub fn set_on_frame(&self, callback: impl FnMut(&mut RgbaImage) + Send + 'static) {
+        *self.shared.on_frame.lock().unwrap() = Some(FrameCallback(Box::new(callback)));
+    }
+
+    /// Stop calling the callback set with [`set_on_frame`][Self::set_on_frame].
+    pub fn clear_on_frame(&self) {
+        *self.shared.on_frame.lock().unwrap() = None;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        crate::{LINE_R1, tests::fake_panel},
+        image::{Rgba, RgbaImage},
+        std::{
+            io::ErrorKind,
+            sync::{
+                Arc,
+                atomic::{AtomicUsize, Ordering},
+            },
+        },
+    };
+
+    #[test]
+    fn test_on_frame() {
+        let mut panel = fake_panel();
+        let calls = Arc::new(AtomicUsize::new(0));
+        let counter = calls.clone();
+        panel.set_on_frame(move |frame| {
+            counter.fetch_add(1, Ordering::SeqCst);
+            frame.put_pixel(2, 0, Rgba([0xff, 0, 0, 0xff]));
+        });
+
+        panel.refresh().unwrap();
+        assert_eq!(calls.load(Ordering::SeqCst), 1);
+
+        // What the callback drew is swapped in, and the previous, blank frame swapped out to the back buffer.
+        assert_eq!(panel.get_pixel(2, 0), Some(Rgba([0xff, 0, 0, 0xff])));
+        assert!(panel.draw_buffer().iter().all(|&c| c == 0));
+
+        // Of everything shifted out, only the top pixel of column 2 sets a color line: R1, in both bit planes of
+        // row address 0.
+        let cache = panel.shared.shift_cache.lock().unwrap();
+        let cache = cache.as_ref().unwrap();
+        let clocked = |address, plane| cache.writes(address, plane).iter().step_by(2).map(|&(_, bits)| bits);
+        for plane in 0..2 {
+            assert_eq!(clocked(0, plane).filter(|&bits| bits != 0).collect::<Vec<_>>(), [1 << LINE_R1]);
+            assert!((1..4).all(|address| clocked(address, plane).all(|bits| bits == 0)));
+        }
+    }
+
+    #[test]
+    fn test_on_frame_resized() {
+        let mut panel = fake_panel();
+        panel.set_on_frame(|frame| *frame = RgbaImage::new(2, 2));
+        assert_eq!(panel.refresh().unwrap_err().kind(), ErrorKind::InvalidData);
+        assert_eq!(panel.size(), (8, 8));
+        assert_eq!(panel.draw_buffer().dimensions(), (8, 8));
+
+        panel.clear_on_frame();
+        panel.refresh().unwrap();
+    }
+}
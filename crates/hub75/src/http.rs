@@ -0,0 +1,331 @@
+//! Serving snapshots of a display over HTTP, as PNG images and as an MJPEG stream, for monitoring it remotely.
+
+use {
+    crate::{
+        Hub75Panel,
+        image_file::{encode_error, rgb_bytes, write_png},
+    },
+    gpio_linux_char::CancelToken,
+    image::{ExtendedColorType, RgbaImage, codecs::jpeg::JpegEncoder},
+    log::debug,
+    std::{
+        io::{BufRead, BufReader, ErrorKind, Result as IoResult, Write},
+        net::{SocketAddr, TcpListener, TcpStream, ToSocketAddrs},
+        sync::{
+            Arc, Mutex,
+            atomic::{AtomicUsize, Ordering},
+        },
+        thread,
+        time::{Duration, Instant},
+    },
+};
+
+/// How often the listener checks for cancellation while waiting for connections.
+const ACCEPT_POLL: Duration = Duration::from_millis(50);
+
+/// The time between frames of the MJPEG stream.
+const STREAM_INTERVAL: Duration = Duration::from_millis(100);
+
+/// The shortest time between snapshots taken for clients; requests arriving sooner get the previous snapshot.
+const MIN_SNAPSHOT_INTERVAL: Duration = Duration::from_millis(100);
+
+/// How long a connection may take to send its request, or to accept each write of the response, before it is closed.
+const IO_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// The most connections served at once; further connections are closed as soon as they are accepted.
+const MAX_CONNECTIONS: usize = 8;
+
+/// The JPEG quality of MJPEG stream frames, from 1 to 100.
+const JPEG_QUALITY: u8 = 85;
+
+/// The multipart boundary separating MJPEG stream frames.
+const BOUNDARY: &str = "frame";
+
+/// The page served at `/`, showing the stream scaled up with the pixels kept sharp.
+const INDEX_HTML: &str = "<!DOCTYPE html>\n<html><head><title>hub75</title></head>\
+    <body style=\"margin:0;background:#000\"><img src=\"/stream.mjpeg\" \
+    style=\"width:100%;image-rendering:pixelated\"></body></html>\n";
+
+impl Hub75Panel {
+    /// Serve the display over HTTP on `addr` from a background thread until `cancel` is cancelled, returning the
+    /// address listened on.
+    ///
+    /// `/` is a page showing the display, `/frame.png` is a snapshot of it, and `/stream.mjpeg` is an MJPEG stream
+    /// of it that browsers play as a live image. Binding to port 0 listens on any free port.
+    ///
+    /// Frames are taken with [`snapshot`][Self::snapshot], which only holds the frame buffer long enough to copy it,
+    /// so serving is safe alongside the refresh thread. Snapshots are rate limited so polling clients cannot starve
+    /// the refresh thread of the frame buffer: however many clients are connected or however fast they poll, at most
+    /// one is taken every 100 ms, and clients asking sooner get the previous one. Encoding images still uses CPU
+    /// time, so on a single-core system keep the number of stream viewers small.
+    ///
+    /// At most 8 connections are served at once, each on its own thread; further connections are closed unanswered.
+    /// A client that sends no request within 10 seconds, or stops reading the response for as long, is disconnected,
+    /// so after `cancel` is cancelled every connection closes within that time.
+    ///
+    /// # Errors
+    /// Returns an [`IoError`][std::io::Error] if `addr` cannot be bound.
+    pub fn serve_http<A: ToSocketAddrs>(&self, cancel: &CancelToken, addr: A) -> IoResult<SocketAddr> {
+        let shared = self.shared.clone();
+        serve(cancel, addr, move || shared.snapshot())
+    }
+}
+
+/// Takes snapshots of a display at most once every [`MIN_SNAPSHOT_INTERVAL`], however many clients ask for them.
+struct SnapshotLimiter {
+    snapshot: Box<dyn Fn() -> RgbaImage + Send + Sync>,
+
+    /// The last snapshot taken and when.
+    last: Mutex<Option<(Instant, Arc<RgbaImage>)>>,
+}
+
+impl SnapshotLimiter {
+    /// Returns a recent snapshot, taking a new one if the last is older than [`MIN_SNAPSHOT_INTERVAL`].
+    fn get(&self) -> Arc<RgbaImage> {
+        let mut last = self.last.lock().unwrap();
+        if let Some((taken, image)) = &*last {
+            if taken.elapsed() < MIN_SNAPSHOT_INTERVAL {
+                return image.clone();
+            }
+        }
+
+        let image = Arc::new((self.snapshot)());
+        *last = Some((Instant::now(), image.clone()));
+        image
+    }
+}
+
+/// Listen on `addr` and serve the images returned by `snapshot` from background threads until `cancel` is cancelled,
+/// returning the address listened on.
+///
+/// Each connection is handled on its own thread, so a client watching the stream does not hold up other requests, up
+/// to [`MAX_CONNECTIONS`] at once. Snapshots are shared between clients and rate limited by [`SnapshotLimiter`].
+pub(crate) fn serve<A, F>(cancel: &CancelToken, addr: A, snapshot: F) -> IoResult<SocketAddr>
+where
+    A: ToSocketAddrs,
+    F: Fn() -> RgbaImage + Send + Sync + 'static,
+{
+    let listener = TcpListener::bind(addr)?;
+    listener.set_nonblocking(true)?;
+    let local_addr = listener.local_addr()?;
+    let cancel = cancel.clone();
+    let snapshots = Arc::new(SnapshotLimiter {
+        snapshot: Box::new(snapshot),
+        last: Mutex::new(None),
+    });
+    let connections = Arc::new(AtomicUsize::new(0));
+
+    thread::spawn(move || {
+        while !cancel.is_cancelled() {
+            match listener.accept() {
+                Ok((stream, peer)) => {
+                    let Some(slot) = ConnectionSlot::acquire(&connections) else {
+                        debug!("Closing HTTP connection from {peer}: too many connections");
+                        continue;
+                    };
+
+                    if let Err(e) = stream.set_nonblocking(false).and_then(|_| set_timeouts(&stream)) {
+                        debug!("Failed to set up HTTP connection from {peer}: {e}");
+                        continue;
+                    }
+
+                    let cancel = cancel.clone();
+                    let snapshots = snapshots.clone();
+                    thread::spawn(move || {
+                        if let Err(e) = handle(stream, &cancel, &snapshots) {
+                            debug!("HTTP connection from {peer} ended: {e}");
+                        }
+                        drop(slot);
+                    });
+                }
+                Err(e) if e.kind() == ErrorKind::WouldBlock => {
+                    cancel.wait_timeout(ACCEPT_POLL);
+                }
+                Err(e) => {
+                    debug!("Failed to accept HTTP connection: {e}");
+                    cancel.wait_timeout(ACCEPT_POLL);
+                }
+            }
+        }
+    });
+
+    Ok(local_addr)
+}
+
+/// Set the read and write timeouts of `stream` to [`IO_TIMEOUT`].
+fn set_timeouts(stream: &TcpStream) -> IoResult<()> {
+    stream.set_read_timeout(Some(IO_TIMEOUT))?;
+    stream.set_write_timeout(Some(IO_TIMEOUT))
+}
+
+/// One of the [`MAX_CONNECTIONS`] connections that may be served at once, released when dropped.
+struct ConnectionSlot(Arc<AtomicUsize>);
+
+impl ConnectionSlot {
+    /// Take a slot from `connections`, the number in use, or return `None` if all are in use.
+    fn acquire(connections: &Arc<AtomicUsize>) -> Option<Self> {
+        if connections.fetch_add(1, Ordering::SeqCst) >= MAX_CONNECTIONS {
+            connections.fetch_sub(1, Ordering::SeqCst);
+            return None;
+        }
+
+        Some(Self(connections.clone()))
+    }
+}
+
+impl Drop for ConnectionSlot {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+/// Read a request from `stream` and send the response.
+fn handle(mut stream: TcpStream, cancel: &CancelToken, snapshots: &SnapshotLimiter) -> IoResult<()> {
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut request_line = String::new();
+    reader.read_line(&mut request_line)?;
+
+    // Skip the headers; nothing served depends on them.
+    let mut header = String::new();
+    while reader.read_line(&mut header)? > 0 && header != "\r\n" && header != "\n" {
+        header.clear();
+    }
+
+    let mut parts = request_line.split_whitespace();
+    let method = parts.next().unwrap_or_default();
+    let target = parts.next().unwrap_or_default();
+    let path = target.split('?').next().unwrap_or_default();
+
+    match (method, path) {
+        ("GET", "/") => respond(&mut stream, "200 OK", "text/html; charset=utf-8", INDEX_HTML.as_bytes()),
+        ("GET", "/frame.png") => {
+            let mut png = Vec::new();
+            write_png(&snapshots.get(), &mut png)?;
+            respond(&mut stream, "200 OK", "image/png", &png)
+        }
+        ("GET", "/stream.mjpeg") => stream_mjpeg(&mut stream, cancel, snapshots),
+        ("GET", _) => respond(&mut stream, "404 Not Found", "text/plain", b"Not found\n"),
+        _ => respond(&mut stream, "405 Method Not Allowed", "text/plain", b"Method not allowed\n"),
+    }
+}
+
+/// Write a complete response with `body` and close the connection.
+fn respond(stream: &mut TcpStream, status: &str, content_type: &str, body: &[u8]) -> IoResult<()> {
+    write!(
+        stream,
+        "HTTP/1.1 {status}\r\nContent-Type: {content_type}\r\nContent-Length: {}\r\nCache-Control: no-cache\r\n\
+         Connection: close\r\n\r\n",
+        body.len()
+    )?;
+    stream.write_all(body)?;
+    stream.flush()
+}
+
+/// Send snapshots as JPEG parts of a `multipart/x-mixed-replace` response until the client disconnects or `cancel`
+/// is cancelled.
+fn stream_mjpeg(stream: &mut TcpStream, cancel: &CancelToken, snapshots: &SnapshotLimiter) -> IoResult<()> {
+    write!(
+        stream,
+        "HTTP/1.1 200 OK\r\nContent-Type: multipart/x-mixed-replace; boundary={BOUNDARY}\r\n\
+         Cache-Control: no-cache\r\nConnection: close\r\n\r\n"
+    )?;
+
+    loop {
+        let jpeg = encode_jpeg(&snapshots.get())?;
+        write!(stream, "--{BOUNDARY}\r\nContent-Type: image/jpeg\r\nContent-Length: {}\r\n\r\n", jpeg.len())?;
+        stream.write_all(&jpeg)?;
+        stream.write_all(b"\r\n")?;
+        stream.flush()?;
+
+        if cancel.wait_timeout(STREAM_INTERVAL) {
+            return Ok(());
+        }
+    }
+}
+
+/// Encode `frame` as a JPEG image, dropping the alpha channel.
+fn encode_jpeg(frame: &RgbaImage) -> IoResult<Vec<u8>> {
+    let mut jpeg = Vec::new();
+    JpegEncoder::new_with_quality(&mut jpeg, JPEG_QUALITY)
+        .encode(&rgb_bytes(frame), frame.width(), frame.height(), ExtendedColorType::Rgb8)
+        .map_err(encode_error)?;
+    Ok(jpeg)
+}
+
+#[cfg(test)]
+mod tests {
+    use {super::*, std::io::Read};
+
+    /// Send a GET request for `path` and return the status line and the rest of the response.
+    fn get(addr: SocketAddr, path: &str) -> (String, Vec<u8>) {
+        let mut stream = TcpStream::connect(addr).unwrap();
+        write!(stream, "GET {path} HTTP/1.1\r\nHost: localhost\r\n\r\n").unwrap();
+        let mut response = Vec::new();
+        stream.read_to_end(&mut response).unwrap();
+        let end = response.windows(2).position(|w| w == b"\r\n").unwrap();
+        (String::from_utf8(response[..end].to_vec()).unwrap(), response[end + 2..].to_vec())
+    }
+
+    #[test]
+    fn test_serve() {
+        let cancel = CancelToken::new().unwrap();
+        let addr = serve(&cancel, "127.0.0.1:0", || RgbaImage::new(4, 2)).unwrap();
+
+        let (status, rest) = get(addr, "/frame.png");
+        assert_eq!(status, "HTTP/1.1 200 OK");
+        let body_start = rest.windows(4).position(|w| w == b"\r\n\r\n").unwrap() + 4;
+        assert!(String::from_utf8_lossy(&rest[..body_start]).contains("Content-Type: image/png\r\n"));
+        assert!(rest[body_start..].starts_with(b"\x89PNG\r\n\x1a\n"));
+
+        assert_eq!(get(addr, "/missing").0, "HTTP/1.1 404 Not Found");
+
+        // The stream ends once cancelled, after at least one frame.
+        let stream = thread::spawn(move || get(addr, "/stream.mjpeg"));
+        thread::sleep(STREAM_INTERVAL);
+        cancel.cancel();
+        let (status, rest) = stream.join().unwrap();
+        assert_eq!(status, "HTTP/1.1 200 OK");
+        let rest = String::from_utf8_lossy(&rest);
+        assert!(rest.contains("multipart/x-mixed-replace; boundary=frame"));
+        assert!(rest.contains("--frame\r\nContent-Type: image/jpeg\r\n"));
+    }
+
+    #[test]
+    fn test_connection_limit() {
+        let cancel = CancelToken::new().unwrap();
+        let addr = serve(&cancel, "127.0.0.1:0", || RgbaImage::new(1, 1)).unwrap();
+
+        // Clients that connect and send nothing hold their connections until they time out, and connections beyond
+        // the limit are closed unanswered.
+        let idle: Vec<_> = (0..MAX_CONNECTIONS).map(|_| TcpStream::connect(addr).unwrap()).collect();
+        let mut refused = TcpStream::connect(addr).unwrap();
+        assert_eq!(refused.read(&mut [0; 16]).unwrap(), 0);
+
+        drop(idle);
+        thread::sleep(ACCEPT_POLL * 2);
+        assert_eq!(get(addr, "/").0, "HTTP/1.1 200 OK");
+        cancel.cancel();
+    }
+
+    #[test]
+    fn test_snapshot_limiter() {
+        let taken = Arc::new(AtomicUsize::new(0));
+        let counter = taken.clone();
+        let snapshots = SnapshotLimiter {
+            snapshot: Box::new(move || {
+                counter.fetch_add(1, Ordering::SeqCst);
+                RgbaImage::new(1, 1)
+            }),
+            last: Mutex::new(None),
+        };
+
+        for _ in 0..10 {
+            snapshots.get();
+        }
+        assert_eq!(taken.load(Ordering::SeqCst), 1);
+
+        thread::sleep(MIN_SNAPSHOT_INTERVAL);
+        snapshots.get();
+        assert_eq!(taken.load(Ordering::SeqCst), 2);
+    }
+}
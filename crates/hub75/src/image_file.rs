@@ -0,0 +1,316 @@
+//! Displaying image files.
+
+use {
+    crate::Hub75Panel,
+    gpio_linux_char::CancelToken,
+    image::{
+        AnimationDecoder, DynamicImage, ExtendedColorType, ImageEncoder, ImageError, RgbaImage,
+        codecs::{gif::GifDecoder, png::PngEncoder},
+        imageops::{FilterType, replace},
+    },
+    std::{
+        fs::{File, read},
+        io::{BufReader, Error as IoError, ErrorKind, Result as IoResult, Write},
+        path::Path,
+        time::Duration,
+    },
+};
+
+/// How long to show GIF frames that do not specify a delay.
+const DEFAULT_GIF_DELAY: Duration = Duration::from_millis(100);
+
+/// How an image whose aspect ratio differs from the panel's is scaled by [`Hub75Panel::draw_image_file`].
+#[derive(Clone, Copy, Debug, Default, Eq, Hash, PartialEq)]
+pub enum ImageFit {
+    /// Scale the image to exactly the size of the panel, distorting it if the aspect ratios differ.
+    Stretch,
+
+    /// Scale the image to fit entirely within the panel, preserving its aspect ratio. The image is centered and the
+    /// uncovered parts of the panel are cleared.
+    #[default]
+    Fit,
+
+    /// Scale the image to cover the entire panel, preserving its aspect ratio. The image is centered and the parts
+    /// that do not fit are cropped.
+    Fill,
+}
+
+impl Hub75Panel {
+    /// Decode an image file and draw it into the frame buffer, scaled to the panel according to `fit`.
+    ///
+    /// The format is detected from the file's contents; PNG, JPEG, and GIF are supported. For animated GIFs, only
+    /// the first frame is drawn; see [`play_gif`][Hub75Panel::play_gif].
+    ///
+    /// # Errors
+    /// If the file cannot be read, the underlying [`IoError`][std::io::Error] is returned. If the file is empty or
+    /// cannot be decoded, an [`IoError`][std::io::Error] with kind [`InvalidData`][std::io::ErrorKind::InvalidData] is
+    /// returned.
+    pub fn draw_image_file<P: AsRef<Path>>(&mut self, path: P, fit: ImageFit) -> IoResult<()> {
+        let path = path.as_ref();
+        let data = read(path)?;
+        if data.is_empty() {
+            return Err(IoError::new(ErrorKind::InvalidData, format!("{}: image file is empty", path.display())));
+        }
+
+        let image = image::load_from_memory(&data).map_err(|e| image_error(path, e))?;
+        let (width, height) = self.size();
+        self.draw_image(0, 0, &scale_to(&image, fit, width, height));
+        Ok(())
+    }
+
+    /// Play an animated GIF file in a loop until `cancel` is cancelled.
+    ///
+    /// Each frame is shown for its own delay; frames with no delay are shown for 100 ms, as browsers do. Frames are
+    /// composited onto the full canvas before display, honoring each frame's disposal method, so GIFs whose later
+    /// frames only update a sub-rectangle play correctly. The composited frames are scaled to fit the panel.
+    ///
+    /// All frames are decoded and scaled up front, so playback timing is not affected by decoding.
+    ///
+    /// This only draws into the frame buffer, so the refresh thread should be running (see
+    /// [`start`][Hub75Panel::start]) for the animation to be displayed.
+    ///
+    /// # Errors
+    /// If the file cannot be read, the underlying [`IoError`][std::io::Error] is returned. If the file cannot be
+    /// decoded or contains no frames, an [`IoError`][std::io::Error] with kind
+    /// [`InvalidData`][std::io::ErrorKind::InvalidData] is returned. Cancellation is not an error.
+    pub fn play_gif<P: AsRef<Path>>(&mut self, cancel: &CancelToken, path: P) -> IoResult<()> {
+        let (width, height) = self.size();
+        let frames = gif_frames(path.as_ref(), width, height)?;
+        loop {
+            for (image, delay) in &frames {
+                self.draw_image(0, 0, image);
+                if cancel.wait_timeout(*delay) {
+                    return Ok(());
+                }
+            }
+        }
+    }
+}
+
+/// Decode the GIF file at `path` into its composited frames, each scaled to fit `width` x `height`, along with how
+/// long to show them.
+fn gif_frames(path: &Path, width: u32, height: u32) -> IoResult<Vec<(RgbaImage, Duration)>> {
+    let decoder = GifDecoder::new(BufReader::new(File::open(path)?)).map_err(|e| image_error(path, e))?;
+    let frames = decoder.into_frames().collect_frames().map_err(|e| image_error(path, e))?;
+    if frames.is_empty() {
+        return Err(IoError::new(ErrorKind::InvalidData, format!("{}: GIF contains no frames", path.display())));
+    }
+
+    Ok(frames
+        .into_iter()
+        .map(|frame| {
+            let delay = match Duration::from(frame.delay()) {
+                Duration::ZERO => DEFAULT_GIF_DELAY,
+                delay => delay,
+            };
+            (scale_to(&DynamicImage::from(frame.into_buffer()), ImageFit::Fit, width, height), delay)
+        })
+        .collect())
+}
+
+/// Scale an image according to `fit`, returning an image of exactly `width` x `height`.
+///
+/// With [`ImageFit::Fit`], the image is centered and the uncovered area is transparent black.
+fn scale_to(image: &DynamicImage, fit: ImageFit, width: u32, height: u32) -> RgbaImage {
+    let scaled = match fit {
+        ImageFit::Stretch => return image.resize_exact(width, height, FilterType::Triangle).into_rgba8(),
+        ImageFit::Fit => image.resize(width, height, FilterType::Triangle).into_rgba8(),
+        ImageFit::Fill => return image.resize_to_fill(width, height, FilterType::Triangle).into_rgba8(),
+    };
+
+    let mut canvas = RgbaImage::new(width, height);
+    let x = (width - scaled.width()) / 2;
+    let y = (height - scaled.height()) / 2;
+    replace(&mut canvas, &scaled, x.into(), y.into());
+    canvas
+}
+
+/// Convert an image decoding error into an [`IoError`], keeping I/O errors as they are.
+pub(crate) fn image_error(path: &Path, error: ImageError) -> IoError {
+    match error {
+        ImageError::IoError(e) => e,
+        e => IoError::new(ErrorKind::InvalidData, format!("{}: {e}", path.display())),
+    }
+}
+
+/// Convert an image encoding error into an [`IoError`], keeping I/O errors as they are.
+pub(crate) fn encode_error(error: ImageError) -> IoError {
+    match error {
+        ImageError::IoError(e) => e,
+        e => IoError::other(e),
+    }
+}
+
+/// Returns the RGB components of the pixels in `frame`, dropping the alpha channel, which the panel does not display.
+pub(crate) fn rgb_bytes(frame: &RgbaImage) -> Vec<u8> {
+    frame.chunks_exact(4).flat_map(|pixel| &pixel[..3]).copied().collect()
+}
+
+/// Write `frame` to `writer` as a PNG image without an alpha channel, i.e. as a panel would show it.
+pub(crate) fn write_png<W: Write>(frame: &RgbaImage, writer: W) -> IoResult<()> {
+    PngEncoder::new(writer)
+        .write_image(&rgb_bytes(frame), frame.width(), frame.height(), ExtendedColorType::Rgb8)
+        .map_err(encode_error)
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        crate::tests::fake_panel,
+        image::Rgba,
+        std::{env::temp_dir, fs::remove_file, path::PathBuf, process::id, time::Instant},
+    };
+
+    const RED: Rgba<u8> = Rgba([0xff, 0, 0, 0xff]);
+    const GREEN: Rgba<u8> = Rgba([0, 0xff, 0, 0xff]);
+    const BLUE: Rgba<u8> = Rgba([0, 0, 0xff, 0xff]);
+    const CLEAR: Rgba<u8> = Rgba([0; 4]);
+
+    /// The header of a 4x4 GIF with a global color table of black, red, blue, and green.
+    const GIF_HEADER: &[u8] = &[
+        0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x04, 0x00, 0x04, 0x00, 0x91, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x00,
+        0x00, 0x00, 0x00, 0xff, 0x00, 0xff, 0x00,
+    ];
+
+    /// A GIF frame covering the whole 4x4 canvas in red, with no delay, kept when the next frame is drawn.
+    const GIF_RED_FRAME: &[u8] = &[
+        0x21, 0xf9, 0x04, 0x04, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x04, 0x00, 0x00,
+        0x02, 0x0d, 0x0c, 0xc3, 0x30, 0x0c, 0xc3, 0x30, 0x0c, 0xc3, 0x30, 0x0c, 0xc3, 0x30, 0x05, 0x00,
+    ];
+
+    /// A GIF frame covering the 2x2 square at (1, 1) in blue for 20 cs, restored to the background afterwards.
+    const GIF_BLUE_FRAME: &[u8] = &[
+        0x21, 0xf9, 0x04, 0x08, 0x14, 0x00, 0x00, 0x00, 0x2c, 0x01, 0x00, 0x01, 0x00, 0x02, 0x00, 0x02, 0x00, 0x00,
+        0x02, 0x04, 0x14, 0x45, 0x51, 0x05, 0x00,
+    ];
+
+    /// A GIF frame covering the pixel at (0, 0) in green for 5 cs, kept when the next frame is drawn.
+    const GIF_GREEN_FRAME: &[u8] = &[
+        0x21, 0xf9, 0x04, 0x04, 0x05, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00,
+        0x02, 0x02, 0x5c, 0x01, 0x00,
+    ];
+
+    /// The GIF trailer.
+    const GIF_TRAILER: &[u8] = &[0x3b];
+
+    /// Returns a 4x4 GIF of the red, blue, and green frames in turn. The LZW data of each frame resets the code table
+    /// before every pixel, so the codes stay 3 bits wide.
+    fn three_frame_gif() -> Vec<u8> {
+        [GIF_HEADER, GIF_RED_FRAME, GIF_BLUE_FRAME, GIF_GREEN_FRAME, GIF_TRAILER].concat()
+    }
+
+    /// Write `data` to a file in the temporary directory unique to this process and `name`, returning its path.
+    fn temp_file(name: &str, data: &[u8]) -> PathBuf {
+        let path = temp_dir().join(format!("hub75-image-file-{}-{name}", id()));
+        std::fs::write(&path, data).unwrap();
+        path
+    }
+
+    /// Returns a 6x2 image of vertical red, green, and blue stripes, each 2 pixels wide.
+    fn stripes() -> DynamicImage {
+        DynamicImage::from(RgbaImage::from_fn(6, 2, |x, _| [RED, GREEN, BLUE][x as usize / 2]))
+    }
+
+    #[test]
+    fn test_scale_to_stretch() {
+        // Only stretched vertically, so each column keeps its color exactly.
+        let image = scale_to(&stripes(), ImageFit::Stretch, 6, 6);
+        assert_eq!(image.dimensions(), (6, 6));
+        for (x, y, pixel) in image.enumerate_pixels() {
+            assert_eq!(*pixel, [RED, GREEN, BLUE][x as usize / 2], "pixel ({x}, {y})");
+        }
+    }
+
+    #[test]
+    fn test_scale_to_fit() {
+        // The whole image fits at its own size, centered between transparent bars above and below.
+        let image = scale_to(&stripes(), ImageFit::Fit, 6, 6);
+        assert_eq!(image.dimensions(), (6, 6));
+        for (x, y, pixel) in image.enumerate_pixels() {
+            let expected = if (2..4).contains(&y) {
+                [RED, GREEN, BLUE][x as usize / 2]
+            } else {
+                CLEAR
+            };
+            assert_eq!(*pixel, expected, "pixel ({x}, {y})");
+        }
+    }
+
+    #[test]
+    fn test_scale_to_fill() {
+        // Scaled up 3 times to cover the height, leaving only the middle of the green stripe, blended with its
+        // neighbors at the edges.
+        let image = scale_to(&stripes(), ImageFit::Fill, 6, 6);
+        assert_eq!(image.dimensions(), (6, 6));
+        for (x, y, pixel) in image.enumerate_pixels() {
+            if (1..5).contains(&x) {
+                assert_eq!(*pixel, GREEN, "pixel ({x}, {y})");
+            } else {
+                let [r, g, b, a] = pixel.0;
+                assert!(g > r && g > b && a == 0xff, "pixel ({x}, {y}) is {pixel:?}");
+            }
+        }
+    }
+
+    #[test]
+    fn test_draw_image_file_invalid() {
+        let mut panel = fake_panel();
+        for (name, data) in [("empty", &b""[..]), ("garbage", b"not an image")] {
+            let path = temp_file(name, data);
+            let result = panel.draw_image_file(&path, ImageFit::Fit);
+            remove_file(&path).unwrap();
+            assert_eq!(result.unwrap_err().kind(), ErrorKind::InvalidData, "{name} file");
+        }
+    }
+
+    #[test]
+    fn test_gif_frames() {
+        let path = temp_file("three-frames.gif", &three_frame_gif());
+        let frames = gif_frames(&path, 4, 4);
+        remove_file(&path).unwrap();
+        let frames = frames.unwrap();
+
+        // Each frame is drawn over what the previous ones left, and the square disposed to the background after
+        // frame 2 is transparent in frame 3.
+        let expected = [
+            (|_, _| RED) as fn(u32, u32) -> Rgba<u8>,
+            |x, y| {
+                if (1..3).contains(&x) && (1..3).contains(&y) {
+                    BLUE
+                } else {
+                    RED
+                }
+            },
+            |x, y| match (x, y) {
+                (0, 0) => GREEN,
+                (1..3, 1..3) => CLEAR,
+                _ => RED,
+            },
+        ];
+        assert_eq!(frames.len(), expected.len());
+        for (i, ((image, _), expected)) in frames.iter().zip(expected).enumerate() {
+            assert_eq!(*image, RgbaImage::from_fn(4, 4, expected), "frame {i}");
+        }
+
+        let delays: Vec<_> = frames.iter().map(|&(_, delay)| delay).collect();
+        assert_eq!(delays, [DEFAULT_GIF_DELAY, Duration::from_millis(200), Duration::from_millis(50)]);
+    }
+
+    #[test]
+    fn test_play_gif_cancelled() {
+        let mut panel = fake_panel();
+        let cancel = CancelToken::new().unwrap();
+        cancel.cancel();
+
+        // The first frame is drawn, scaled up to the 8x8 panel, and playback stops without waiting out its delay.
+        let path = temp_file("cancelled.gif", &three_frame_gif());
+        let start = Instant::now();
+        let result = panel.play_gif(&cancel, &path);
+        remove_file(&path).unwrap();
+        result.unwrap();
+        assert!(start.elapsed() < DEFAULT_GIF_DELAY);
+        assert_eq!(panel.get_pixel(0, 0), Some(RED));
+        assert_eq!(panel.get_pixel(7, 7), Some(RED));
+    }
+}
@@ -0,0 +1,1027 @@
+//! Driver for HUB75 RGB LED matrix panels connected directly to GPIO lines.
+
+#![warn(missing_docs)]
+
+mod clock;
+mod color;
+mod dirty;
+mod draw;
+mod frame_callback;
+mod http;
+mod image_file;
+mod mapper;
+mod panel;
+mod power;
+mod test_pattern;
+mod text;
+mod timing;
+mod virtual_panel;
+
+pub use {
+    color::PanelColor,
+    image_file::ImageFit,
+    mapper::{PixelMapper, SerpentineMapper},
+    panel::Panel,
+    test_pattern::TestPattern,
+    timing::Hub75Timing,
+    virtual_panel::VirtualPanel,
+};
+
+use {
+    color::channel_tables,
+    dirty::ShiftCache,
+    frame_callback::FrameCallback,
+    gpio_linux_char::{CancelToken, Gpio, GpioLineConfig, GpioLineDirection, GpioLineFlag, GpioLineRequest},
+    image::{Rgba, RgbaImage},
+    log::error,
+    power::{capped_brightness, frame_lit_fraction},
+    signal_hook::{
+        consts::{SIGINT, SIGTERM},
+        iterator::Signals,
+    },
+    std::{
+        hint::spin_loop,
+        io::{Error as IoError, ErrorKind, Result as IoResult},
+        mem::swap,
+        process::exit,
+        sync::{
+            Arc, Mutex, MutexGuard, PoisonError,
+            atomic::{AtomicBool, Ordering},
+        },
+        thread::{Builder, JoinHandle, sleep, spawn},
+        time::{Duration, Instant},
+    },
+};
+
+/// Consumer label attached to the GPIO lines requested by the panel.
+const CONSUMER: &str = "hub75";
+
+/// Index of the first color line within the line request. The lines are requested in the order R1, G1, B1, R2, G2,
+/// B2, CLK, LAT, OE, A, B, C, D, E.
+const LINE_R1: usize = 0;
+
+/// Index of the clock line within the line request.
+const LINE_CLK: usize = 6;
+
+/// Index of the latch line within the line request.
+const LINE_LAT: usize = 7;
+
+/// Index of the output enable line within the line request.
+const LINE_OE: usize = 8;
+
+/// Index of the first address line within the line request.
+const LINE_A: usize = 9;
+
+/// Mask selecting the six color lines.
+const COLOR_MASK: u64 = 0b111111 << LINE_R1;
+
+/// The default gamma correction exponent.
+pub const DEFAULT_GAMMA: f64 = 2.2;
+
+/// How long each row address is lit for the least significant bit plane during a refresh. Bit plane `n` is lit for
+/// `BCM_BASE_TIME * 2^n`.
+const BCM_BASE_TIME: Duration = Duration::from_micros(4);
+
+/// How many times [`Hub75Panel::reset`] clears and latches the shift registers.
+const RESET_PASSES: usize = 3;
+
+/// Weight given to the latest frame time in the frame rate average.
+const FPS_SMOOTHING: f64 = 0.1;
+
+/// How often [`Hub75Panel::fade`] updates the brightness when the refresh thread's frame rate is unknown.
+const FADE_STEP: Duration = Duration::from_millis(10);
+
+/// GPIO line offsets for the signals of a HUB75 connector.
+///
+/// These are chip offsets on the [`Gpio`] passed to [`Hub75Panel::new`]. The mapping depends on how the panel is
+/// wired (directly or via an adapter board), so there is no default.
+#[derive(Clone, Debug)]
+pub struct Hub75Pins {
+    /// Red data for the top half of the panel.
+    pub r1: usize,
+
+    /// Green data for the top half of the panel.
+    pub g1: usize,
+
+    /// Blue data for the top half of the panel.
+    pub b1: usize,
+
+    /// Red data for the bottom half of the panel.
+    pub r2: usize,
+
+    /// Green data for the bottom half of the panel.
+    pub g2: usize,
+
+    /// Blue data for the bottom half of the panel.
+    pub b2: usize,
+
+    /// Row address bit 0.
+    pub a: usize,
+
+    /// Row address bit 1.
+    pub b: usize,
+
+    /// Row address bit 2.
+    pub c: usize,
+
+    /// Row address bit 3.
+    pub d: usize,
+
+    /// Row address bit 4. This is only present on panels with 32 row pairs (e.g. 64 rows at 1/32 scan).
+    pub e: Option<usize>,
+
+    /// Shift register clock.
+    pub clk: usize,
+
+    /// Latch (sometimes labelled STB).
+    pub lat: usize,
+
+    /// Output enable (active low on the connector).
+    pub oe: usize,
+}
+
+/// Which of the panel's control lines are active low, i.e. asserted by driving them low.
+///
+/// The default matches the HUB75 standard: OE is active low, and CLK and LAT are active high. Boards with inverting
+/// level shifters may differ.
+#[derive(Clone, Copy, Debug, Eq, Hash, PartialEq)]
+pub struct Hub75ActiveLow {
+    /// Whether output enable is active low.
+    pub oe: bool,
+
+    /// Whether the latch is active low.
+    pub lat: bool,
+
+    /// Whether the clock is active low. Data is shifted in when the clock becomes active.
+    pub clk: bool,
+}
+
+impl Default for Hub75ActiveLow {
+    fn default() -> Self {
+        Self {
+            oe: true,
+            lat: false,
+            clk: false,
+        }
+    }
+}
+
+impl Hub75Pins {
+    /// Returns the line offsets in line request order, including only the first `address_lines` address lines.
+    fn offsets(&self, address_lines: usize) -> IoResult<Vec<usize>> {
+        let mut offsets = vec![self.r1, self.g1, self.b1, self.r2, self.g2, self.b2, self.clk, self.lat, self.oe];
+        let address = [Some(self.a), Some(self.b), Some(self.c), Some(self.d), self.e];
+        for line in &address[..address_lines] {
+            let Some(line) = line else {
+                return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 scan rate requires the E address line"));
+            };
+            offsets.push(*line);
+        }
+        Ok(offsets)
+    }
+}
+
+/// Configuration for a HUB75 panel.
+#[derive(Clone, Debug)]
+pub struct Hub75Config {
+    /// The GPIO lines the panel is wired to.
+    pub pins: Hub75Pins,
+
+    /// The width of a single panel, in pixels (e.g. 64).
+    pub width: u32,
+
+    /// The height of the panel, in pixels (e.g. 32).
+    pub height: u32,
+
+    /// The number of bits per color channel to display, from 1 to 8.
+    ///
+    /// Colors are displayed using binary code modulation: each bit plane is shifted out and lit for a time
+    /// proportional to its weight, so a frame takes `scan_rate` row addresses times `color_depth` shifts plus
+    /// `2^color_depth - 1` units of lit time. The most significant bit plane alone accounts for half of the lit time,
+    /// so each additional bit roughly halves the refresh rate once lit time dominates; deeper color means more
+    /// visible flicker. 4 or 5 bits is usually a good compromise.
+    pub color_depth: u8,
+
+    /// The number of row addresses the panel multiplexes between, e.g. 16 for a 1/16 scan panel.
+    ///
+    /// This must be a power of two from 1 to 32 that divides `height / 2`. Only the address lines needed to select
+    /// `scan_rate` rows are requested, starting from A; e.g. a 1/8 scan panel uses A, B, and C, and the D and E pins
+    /// are ignored.
+    ///
+    /// Each address lights the same row in each half of the panel. If `scan_rate` is less than `height / 2`, each
+    /// address also lights every `scan_rate`th row below it within the half. The shift registers for those rows are
+    /// chained within each panel, with the data for the bottom-most row shifted in first; panels wired otherwise need
+    /// their pixels remapped before drawing.
+    pub scan_rate: u32,
+
+    /// The number of panels daisy-chained horizontally in each row, at least 1.
+    ///
+    /// The logical width of the display is `width * chain_length`. The panel connected to the controller is the
+    /// rightmost one when viewed from the front; x = 0 is the left edge of the panel at the end of the chain.
+    pub chain_length: u32,
+
+    /// The number of rows of panels stacked vertically, at least 1.
+    ///
+    /// All panels are driven as a single chain of `chain_length * rows` panels, so no extra GPIO lines are needed.
+    /// The logical height of the display is `height * rows`. The chain starts from the controller in the bottom row
+    /// and continues row by row upwards, so the top row holds the end of the chain. How the rows are oriented is
+    /// given by `row_order`.
+    pub rows: u32,
+
+    /// How the chain runs between stacked rows of panels; ignored if `rows` is 1.
+    pub row_order: Hub75RowOrder,
+
+    /// Positions within the chain (0 being the panel at the end of the chain, i.e. the leftmost panel of the top
+    /// row) of panels whose columns are shifted in the reverse direction, e.g. because they are a different model
+    /// or are wired from the other side.
+    pub reversed_panels: Vec<u32>,
+
+    /// The polarity of the control lines.
+    pub active_low: Hub75ActiveLow,
+
+    /// Extra delays while driving the control lines; the default adds none. Delays too short for the panel cause
+    /// garbled pixels or ghosting; see [`Hub75Timing`].
+    pub timing: Hub75Timing,
+}
+
+/// How a chain of panels runs between the rows of a display stacked [`rows`][Hub75Config::rows] high.
+#[derive(Clone, Copy, Debug, Default, Eq, Hash, PartialEq)]
+pub enum Hub75RowOrder {
+    /// Every row is mounted the same way up, so the chain runs right to left along each row (viewed from the
+    /// front) and the cable returns from the left end of one row to the right end of the row above.
+    #[default]
+    Aligned,
+
+    /// The chain runs back and forth: right to left along the bottom row, then left to right along the row above,
+    /// and so on. Panels in alternate rows, counting from the bottom, are mounted upside down so that the short
+    /// cables between rows reach.
+    Serpentine,
+}
+
+/// A HUB75 RGB LED panel.
+///
+/// The panel holds all of its GPIO lines as outputs in a single line request until it is dropped. Drawing operations
+/// write to a frame buffer in memory; the panel only shows an image while it is being refreshed, either by calling
+/// [`refresh`][Self::refresh] repeatedly or by running a background refresh thread with [`start`][Self::start].
+#[derive(Debug)]
+pub struct Hub75Panel {
+    shared: Arc<Shared>,
+    refresh_thread: Option<JoinHandle<()>>,
+}
+
+/// Panel state shared with the refresh thread.
+#[derive(Debug)]
+struct Shared {
+    request: GpioLineRequest,
+    width: u32,
+    height: u32,
+    panel_width: u32,
+    panel_height: u32,
+    rows: u32,
+    row_order: Hub75RowOrder,
+    scan_rate: u32,
+    color_depth: u8,
+    columns: Vec<u32>,
+    buffer: Mutex<RgbaImage>,
+    gamma: Mutex<[u8; 256]>,
+    color_correction: Mutex<[f64; 3]>,
+    brightness: Mutex<f64>,
+    running: AtomicBool,
+
+    /// Held while driving the lines, so a frame is never interrupted part way by blanking the panel.
+    output: Mutex<()>,
+
+    /// Exponentially weighted average of the refresh thread's frame time, in seconds; 0.0 before the first frame.
+    frame_time: Mutex<f64>,
+
+    /// The maximum frame rate of the refresh thread, or 0.0 for unlimited.
+    max_fps: Mutex<f64>,
+
+    /// Maps the frame buffer's logical coordinates to physical ones before each refresh.
+    mapper: Mutex<Option<Box<dyn PixelMapper>>>,
+
+    /// The clockwise rotation of the frame buffer on the display, in degrees. Only changed while `buffer` is locked,
+    /// together with the buffer's dimensions.
+    rotation: Mutex<u32>,
+
+    /// Whether refreshes reuse the bit planes of unchanged row addresses.
+    dirty_tracking: AtomicBool,
+
+    /// The bit planes of the last frame displayed, created on the first refresh.
+    shift_cache: Mutex<Option<ShiftCache>>,
+
+    /// The maximum average fraction of LEDs lit; 1.0 for no limit.
+    power_limit: Mutex<f64>,
+
+    /// The estimated fraction of LEDs lit at full brightness by the frame last displayed.
+    lit_fraction: Mutex<f64>,
+
+    /// Extra delays while driving the control lines.
+    timing: Mutex<Hub75Timing>,
+
+    /// The back buffer for double-buffered drawing, drawn into by its owner or the frame callback and then swapped
+    /// with `buffer`. Locked after `buffer` when both are held.
+    back_buffer: Mutex<RgbaImage>,
+
+    /// Called with the back buffer before each frame is displayed. Only locked while `buffer` is locked.
+    on_frame: Mutex<Option<FrameCallback>>,
+}
+
+impl Hub75Panel {
+    /// Request the lines for a panel wired to `gpio` according to `config`.
+    ///
+    /// All lines are configured as outputs and start inactive, so the panel is dark. Control lines listed in
+    /// `config.active_low` are requested with the [`ActiveLow`][GpioLineFlag::ActiveLow] flag, so the refresh logic
+    /// deals only in active and inactive states.
+    ///
+    /// # Errors
+    /// If `config.color_depth` is not between 1 and 8, `config.scan_rate` is invalid for the panel height or needs
+    /// the E pin but none is given, or the chain configuration is invalid, an [`IoError`][std::io::Error] is returned
+    /// with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput].
+    ///
+    /// If the lines cannot be requested, the underlying [`IoError`][std::io::Error] is returned. If the kernel does not
+    /// report the requested polarity of a control line afterwards, an [`IoError`][std::io::Error] is returned with a
+    /// kind of [`Other`][std::io::ErrorKind::Other].
+    pub fn new(gpio: &Gpio, config: &Hub75Config) -> IoResult<Self> {
+        if !(1..=8).contains(&config.color_depth) {
+            return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 color depth must be between 1 and 8"));
+        }
+
+        let half = config.height / 2;
+        if !config.scan_rate.is_power_of_two() || config.scan_rate > 32 || half % config.scan_rate != 0 {
+            return Err(IoError::new(
+                ErrorKind::InvalidInput,
+                "HUB75 scan rate must be a power of two up to 32 that divides half the panel height",
+            ));
+        }
+
+        if config.chain_length == 0 {
+            return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 chain length must be at least 1"));
+        }
+
+        if config.rows == 0 {
+            return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 panel rows must be at least 1"));
+        }
+
+        let num_panels = config.chain_length * config.rows;
+        if config.reversed_panels.iter().any(|&panel| panel >= num_panels) {
+            return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 reversed panel is beyond the end of the chain"));
+        }
+
+        let width = config.width * config.chain_length;
+        let height = config.height * config.rows;
+        let mut columns = Vec::with_capacity((config.width * num_panels) as usize);
+        for panel in 0..num_panels {
+            let start = panel * config.width;
+            if config.reversed_panels.contains(&panel) {
+                columns.extend((start..start + config.width).rev());
+            } else {
+                columns.extend(start..start + config.width);
+            }
+        }
+
+        let control_lines = [
+            (LINE_OE, config.pins.oe, config.active_low.oe),
+            (LINE_LAT, config.pins.lat, config.active_low.lat),
+            (LINE_CLK, config.pins.clk, config.active_low.clk),
+        ];
+
+        let mut line_config =
+            GpioLineConfig::default().with_consumer(CONSUMER).with_direction(GpioLineDirection::Output);
+        for (index, _, active_low) in control_lines {
+            if active_low {
+                line_config = line_config.with_line_flags(index, GpioLineFlag::ActiveLow);
+            }
+        }
+        let offsets = config.pins.offsets(config.scan_rate.trailing_zeros() as usize)?;
+        let request = gpio.request_lines(&offsets, &line_config)?;
+
+        for (_, offset, active_low) in control_lines {
+            if gpio.get_line_info(offset)?.flags.contains(GpioLineFlag::ActiveLow) != active_low {
+                return Err(IoError::other(format!(
+                    "HUB75 control line {offset} does not have the requested polarity"
+                )));
+            }
+        }
+
+        Ok(Self {
+            shared: Arc::new(Shared {
+                request,
+                width,
+                height,
+                panel_width: config.width,
+                panel_height: config.height,
+                rows: config.rows,
+                row_order: config.row_order,
+                scan_rate: config.scan_rate,
+                color_depth: config.color_depth,
+                columns,
+                buffer: Mutex::new(RgbaImage::new(width, height)),
+                gamma: Mutex::new(gamma_table(DEFAULT_GAMMA)),
+                color_correction: Mutex::new([1.0; 3]),
+                brightness: Mutex::new(1.0),
+                running: AtomicBool::new(false),
+                output: Mutex::new(()),
+                frame_time: Mutex::new(0.0),
+                max_fps: Mutex::new(0.0),
+                mapper: Mutex::new(None),
+                rotation: Mutex::new(0),
+                dirty_tracking: AtomicBool::new(false),
+                shift_cache: Mutex::new(None),
+                power_limit: Mutex::new(1.0),
+                lit_fraction: Mutex::new(0.0),
+                timing: Mutex::new(config.timing),
+                back_buffer: Mutex::new(RgbaImage::new(width, height)),
+                on_frame: Mutex::new(None),
+            }),
+            refresh_thread: None,
+        })
+    }
+
+    /// Returns the width and height of the display, in pixels. For chained or stacked panels, this is the combined
+    /// size. If the display is rotated by 90 or 270 degrees, the width and height are swapped.
+    pub fn size(&self) -> (u32, u32) {
+        self.shared.buffer.lock().unwrap().dimensions()
+    }
+
+    /// Set a pixel in the frame buffer.
+    ///
+    /// Coordinates outside of the panel are silently ignored, so drawing code does not need to clip.
+    pub fn set_pixel(&mut self, x: i32, y: i32, color: Rgba<u8>) {
+        put_pixel(&mut self.shared.buffer.lock().unwrap(), x, y, color.0);
+    }
+
+    /// Set a pixel in the frame buffer to an opaque color given by its components.
+    ///
+    /// This writes the components straight into the frame buffer's storage, which makes it the cheapest way to draw
+    /// individual pixels. As with [`set_pixel`][Self::set_pixel], coordinates outside of the panel are ignored.
+    pub fn set_pixel_rgb(&mut self, x: i32, y: i32, r: u8, g: u8, b: u8) {
+        put_pixel(&mut self.shared.buffer.lock().unwrap(), x, y, [r, g, b, 0xff]);
+    }
+
+    /// Returns the back buffer for double-buffered drawing.
+    ///
+    /// The drawing methods of the panel write directly to the front buffer, which is what gets displayed. For
+    /// complex redraws, draw into this buffer instead and call [`swap_buffers`][Self::swap_buffers] when the frame is
+    /// complete. The back buffer has the same size as the display, and must keep it: it may be replaced with another
+    /// image, but only one of the same size can be swapped in.
+    ///
+    /// The back buffer stays locked until the returned guard is dropped. If a frame callback is set (see
+    /// [`set_on_frame`][Self::set_on_frame]), refreshing waits for it, so the guard should not be held for long.
+    pub fn draw_buffer(&mut self) -> MutexGuard<'_, RgbaImage> {
+        self.shared.back_buffer.lock().unwrap()
+    }
+
+    /// Exchange the back buffer with the front buffer, displaying everything drawn into the back buffer.
+    ///
+    /// This swaps the buffers' storage under the frame buffer lock rather than copying pixels, so it is cheap
+    /// regardless of the display size. Afterwards, [`draw_buffer`][Self::draw_buffer] returns the previous front
+    /// buffer, so the next frame should be drawn in full.
+    ///
+    /// # Errors
+    /// If the back buffer no longer has the size of the display, having been replaced with an image of another size,
+    /// an [`IoError`][std::io::Error] is returned with a kind of [`InvalidInput`][std::io::ErrorKind::InvalidInput]
+    /// and the buffers are not swapped.
+    pub fn swap_buffers(&mut self) -> IoResult<()> {
+        let mut buffer = self.shared.buffer.lock().unwrap();
+        let mut back_buffer = self.shared.back_buffer.lock().unwrap();
+        if back_buffer.dimensions() != buffer.dimensions() {
+            return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 back buffer does not match the display size"));
+        }
+
+        swap(&mut *buffer, &mut *back_buffer);
+        Ok(())
+    }
+
+    /// Set the gamma correction exponent; the default is [`DEFAULT_GAMMA`].
+    ///
+    /// LED brightness is roughly linear in duty cycle, which makes linear RGB values look washed out. Each channel
+    /// value `v` is displayed as `255 * (v / 255)^gamma`. The correction is applied when a frame is displayed, not
+    /// when pixels are drawn, so changing it takes effect on the next refresh without redrawing.
+    pub fn set_gamma(&self, gamma: f64) {
+        *self.shared.gamma.lock().unwrap() = gamma_table(gamma);
+    }
+
+    /// Set the overall brightness of the panel, from 0.0 (off) to 1.0 (full brightness, the default).
+    ///
+    /// Values outside of this range are clamped (and NaN is treated as 0.0). Brightness is controlled by the fraction
+    /// of each bit plane's time that OE is enabled, so it does not require redrawing the frame buffer and takes
+    /// effect on the next refresh.
+    pub fn set_brightness(&self, level: f64) {
+        *self.shared.brightness.lock().unwrap() = if level.is_nan() {
+            0.0
+        } else {
+            level.clamp(0.0, 1.0)
+        };
+    }
+
+    /// Returns the overall brightness of the panel, from 0.0 to 1.0.
+    pub fn brightness(&self) -> f64 {
+        *self.shared.brightness.lock().unwrap()
+    }
+
+    /// Ramp the brightness linearly from `from` to `to` over `duration`, blocking until done or `cancel` is
+    /// cancelled.
+    ///
+    /// The brightness is updated once per frame of the background refresh thread (or every 10 ms if it is not
+    /// running), so each frame is displayed at a single level. Levels are clamped as for
+    /// [`set_brightness`][Self::set_brightness]. When cancelled, the brightness is left at the level reached;
+    /// cancellation is not an error. A zero `duration` sets `to` immediately.
+    pub fn fade(&self, cancel: &CancelToken, from: f64, to: f64, duration: Duration) {
+        let start = Instant::now();
+        loop {
+            let elapsed = start.elapsed();
+            self.set_brightness(fade_level(from, to, elapsed, duration));
+            if elapsed >= duration {
+                break;
+            }
+
+            let step = match self.fps() {
+                fps if fps > 0.0 => Duration::from_secs_f64(1.0 / fps),
+                _ => FADE_STEP,
+            };
+            if cancel.wait_timeout(step.min(duration - elapsed)) {
+                break;
+            }
+        }
+    }
+
+    /// Display one full frame from the frame buffer.
+    ///
+    /// The panel is driven one row address at a time (row `y` together with row `y + height / 2`, plus the rows
+    /// sharing the address on panels scanning fewer than `height / 2` rows). For each address, the most significant
+    /// `color_depth` bits of each color channel are displayed using binary code modulation: each bit plane (after
+    /// gamma correction) is shifted out, latched, and lit for a time proportional to its weight.
+    /// OE is disabled while the address and latch change to avoid ghosting (see [`set_timing`][Self::set_timing] for
+    /// panels needing longer delays), and the panel is left dark when this returns. The line writes for each bit
+    /// plane are precomputed and reused by later refreshes for row addresses whose pixels have not changed (see also
+    /// [`set_dirty_tracking`][Self::set_dirty_tracking]).
+    ///
+    /// This must not be called while the background refresh thread is running.
+    ///
+    /// # Errors
+    /// If setting the GPIO lines fails, the underlying [`IoError`][std::io::Error] is returned.
+    ///
+    /// If the frame buffer has been replaced with an image of another size, or the callback set with
+    /// [`set_on_frame`][Self::set_on_frame] replaced the back buffer with one, nothing is displayed, that buffer is
+    /// cleared to the right size, and an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidData`][std::io::ErrorKind::InvalidData].
+    pub fn refresh(&self) -> IoResult<()> {
+        self.shared.refresh(&self.shared.physical_frame()?)
+    }
+
+    /// Limit the background refresh thread to at most `fps` frames per second; 0.0 (the default) means unlimited.
+    ///
+    /// Without a limit, the refresh thread displays frames back to back and keeps a CPU core busy. With one, it
+    /// sleeps for the rest of each frame period after displaying a frame. The panel is dark while the thread sleeps,
+    /// so a limit lowers the average brightness and, if set below roughly 100 frames per second, causes visible
+    /// flicker; it is best used on displays that refresh far faster than needed. Negative, infinite, and NaN values
+    /// are treated as unlimited.
+    pub fn set_max_fps(&self, fps: f64) {
+        *self.shared.max_fps.lock().unwrap() = if fps.is_finite() && fps > 0.0 {
+            fps
+        } else {
+            0.0
+        };
+    }
+
+    /// Returns the frame rate achieved by the background refresh thread, in frames per second.
+    ///
+    /// This is derived from an exponentially weighted moving average of the time taken by each full frame (including
+    /// any sleep imposed by [`set_max_fps`][Self::set_max_fps]), so it tracks changes in color depth or system load
+    /// within a few dozen frames. Returns 0.0 until the refresh thread has completed a frame since it was last
+    /// started.
+    pub fn fps(&self) -> f64 {
+        let frame_time = *self.shared.frame_time.lock().unwrap();
+        if frame_time > 0.0 {
+            1.0 / frame_time
+        } else {
+            0.0
+        }
+    }
+
+    /// Start refreshing the panel continuously on a background thread.
+    ///
+    /// Each refresh displays a copy of the frame buffer taken at the start of the frame, so drawing while the
+    /// thread is running never shows a partially drawn frame. If the thread is already running, this does nothing.
+    ///
+    /// If refreshing fails, the error is logged and the thread exits.
+    pub fn start(&mut self) {
+        if self.refresh_thread.is_some() {
+            return;
+        }
+
+        self.shared.running.store(true, Ordering::SeqCst);
+        *self.shared.frame_time.lock().unwrap() = 0.0;
+        let shared = self.shared.clone();
+        self.refresh_thread = Some(spawn(move || shared.refresh_loop()));
+    }
+
+    /// Stop the background refresh thread, blocking until it has finished its current frame and exited.
+    ///
+    /// The panel is left dark, with OE inactive and all other lines low. If the thread is not running, this only
+    /// blanks the panel.
+    pub fn stop(&mut self) {
+        if let Some(refresh_thread) = self.refresh_thread.take() {
+            self.shared.running.store(false, Ordering::SeqCst);
+            if refresh_thread.join().is_err() {
+                error!("HUB75 refresh thread panicked");
+            }
+        }
+
+        drop(self.shared.blank());
+    }
+
+    /// Clear the panel's shift registers, e.g. to recover from interference or a loose cable leaving the display
+    /// garbled.
+    ///
+    /// This waits for any frame being displayed to finish, then makes all lines inactive and shifts a full chain of
+    /// zeros into the shift registers on all color lines, latching them, several times over. The panel is left dark
+    /// with OE disabled. The frame buffers are not touched, so the next refresh (including by the background refresh
+    /// thread, which may keep running) displays the current frame again.
+    ///
+    /// # Errors
+    /// If setting the GPIO lines fails, the underlying [`IoError`][std::io::Error] is returned.
+    pub fn reset(&self) -> IoResult<()> {
+        self.shared.reset()
+    }
+
+    /// Blank the panel and release its GPIO lines. This is equivalent to dropping the panel.
+    ///
+    /// The refresh thread is stopped and all lines are made inactive before the lines are released, so the LEDs are
+    /// not left lit (and drawing current) at whatever state the last frame left them in. This also happens when the
+    /// panel is dropped while unwinding from a panic.
+    pub fn close(self) {}
+
+    /// Blank the panel and exit the process when one of `signals` is received.
+    ///
+    /// If `signals` is empty, `SIGINT` and `SIGTERM` are handled. A background thread waits for the signals; on
+    /// receipt, it waits for any frame being displayed to finish, makes all lines inactive, and exits the process
+    /// with status 128 plus the signal number, as the shell reports for a process killed by a signal. Handlers for
+    /// `SIGKILL`, `SIGSTOP`, and other signals that cannot be caught cannot be installed.
+    ///
+    /// The process exits without running destructors, so this is intended for programs that would otherwise be
+    /// terminated by the signal.
+    ///
+    /// # Errors
+    /// If the signal handlers cannot be installed or the thread cannot be spawned, the underlying
+    /// [`IoError`][std::io::Error] is returned.
+    pub fn close_on_signal(&self, signals: &[i32]) -> IoResult<()> {
+        let signals = if signals.is_empty() {
+            &[SIGINT, SIGTERM][..]
+        } else {
+            signals
+        };
+
+        let mut signals = Signals::new(signals)?;
+        let shared = self.shared.clone();
+
+        Builder::new().name("hub75-signals".to_string()).spawn(move || {
+            if let Some(signal) = signals.forever().next() {
+                shared.running.store(false, Ordering::SeqCst);
+                let _output = shared.blank();
+                exit(128 + signal);
+            }
+        })?;
+
+        Ok(())
+    }
+}
+
+impl Drop for Hub75Panel {
+    fn drop(&mut self) {
+        self.stop();
+    }
+}
+
+impl Shared {
+    /// Make all lines inactive, turning the panel off, and return the output lock so that nothing can drive the
+    /// lines again while the guard is held.
+    ///
+    /// Any frame being displayed by another thread is finished first.
+    fn blank(&self) -> MutexGuard<'_, ()> {
+        let output = self.output.lock().unwrap_or_else(PoisonError::into_inner);
+        let all_lines = (1 << self.request.num_lines()) - 1;
+        if let Err(e) = self.request.set_values(all_lines, 0) {
+            error!("Failed to blank HUB75 panel: {e}");
+        }
+        output
+    }
+
+    /// Clear and latch the shift registers, leaving the panel dark.
+    fn reset(&self) -> IoResult<()> {
+        let _output = self.blank();
+        let timing = *self.timing.lock().unwrap();
+        let clocks = self.columns.len() * (self.panel_height / 2 / self.scan_rate) as usize;
+        let zeros = [(COLOR_MASK | 1 << LINE_CLK, 0), (1 << LINE_CLK, 1 << LINE_CLK)].repeat(clocks);
+        for _ in 0..RESET_PASSES {
+            self.shift_out(&zeros, &timing)?;
+            self.request.set_values(1 << LINE_CLK, 0)?;
+            self.request.set(LINE_LAT, true)?;
+            hold(timing.latch_width);
+            self.request.set(LINE_LAT, false)?;
+        }
+        Ok(())
+    }
+
+    /// Refresh the panel continuously until `running` is cleared.
+    fn refresh_loop(&self) {
+        while self.running.load(Ordering::SeqCst) {
+            let start = Instant::now();
+            if let Err(e) = self.physical_frame().and_then(|frame| self.refresh(&frame)) {
+                error!("HUB75 refresh failed: {e}");
+                break;
+            }
+
+            let max_fps = *self.max_fps.lock().unwrap();
+            if max_fps > 0.0 {
+                if let Some(remaining) = Duration::from_secs_f64(1.0 / max_fps).checked_sub(start.elapsed()) {
+                    sleep(remaining);
+                }
+            }
+
+            let elapsed = start.elapsed().as_secs_f64();
+            let mut frame_time = self.frame_time.lock().unwrap();
+            *frame_time = if *frame_time > 0.0 {
+                *frame_time + FPS_SMOOTHING * (elapsed - *frame_time)
+            } else {
+                elapsed
+            };
+        }
+    }
+
+    /// Returns the display coordinates of the pixel at column `x` of the chain, counted from the end of the chain,
+    /// and row `y` of its panel.
+    fn display_pixel(&self, x: u32, y: u32) -> (u32, u32) {
+        chain_to_display(x, y, self.width, self.panel_height, self.rows, self.row_order)
+    }
+
+    /// Display one full frame from `frame`.
+    fn refresh(&self, frame: &RgbaImage) -> IoResult<()> {
+        let _output = self.output.lock().unwrap_or_else(PoisonError::into_inner);
+        let tables = channel_tables(&self.gamma.lock().unwrap(), *self.color_correction.lock().unwrap());
+        let num_address_lines = self.request.num_lines() - LINE_A;
+        let address_mask = ((1 << num_address_lines) - 1) << LINE_A;
+
+        let timing = *self.timing.lock().unwrap();
+        let dirty_tracking = self.dirty_tracking.load(Ordering::SeqCst);
+        let mut cache = self.shift_cache.lock().unwrap();
+        let cache =
+            cache.get_or_insert_with(|| ShiftCache::new(self.scan_order(), self.width as usize * 4, self.color_depth));
+
+        // The estimate only changes with the frame or the channel tables, which the cache already compares.
+        let lit_fraction = {
+            let mut lit_fraction = self.lit_fraction.lock().unwrap();
+            if cache.update(frame, &tables) > 0 {
+                *lit_fraction = frame_lit_fraction(frame, &tables, self.color_depth);
+            }
+            *lit_fraction
+        };
+        let brightness =
+            capped_brightness(*self.brightness.lock().unwrap(), lit_fraction, *self.power_limit.lock().unwrap());
+
+        // The bit plane currently held in the shift registers, if it may be latched again without shifting it out.
+        let mut loaded: Option<&[(u64, u64)]> = None;
+
+        // When OE was last disabled; the panel is dark on entry.
+        let mut blanked = Instant::now();
+        for y in 0..self.scan_rate {
+            for plane in 0..self.color_depth {
+                let writes = cache.writes(y as usize, plane as usize);
+                if loaded != Some(writes) {
+                    self.shift_out(writes, &timing)?;
+                }
+                if dirty_tracking {
+                    loaded = Some(writes);
+                }
+
+                // OE is inactive here, so changing the address and latch is not visible once the row drivers have
+                // turned off.
+                hold(timing.blank_before_address.saturating_sub(blanked.elapsed()));
+                self.latch(address_mask, (y as u64) << LINE_A, &timing)?;
+
+                // Scale the lit portion of each bit plane equally so the BCM weighting (and thus color balance) is
+                // preserved, and stay dark for the remainder so the refresh rate is independent of brightness.
+                let plane_time = BCM_BASE_TIME * (1 << plane);
+                let on_time = plane_time.mul_f64(brightness);
+                if !on_time.is_zero() {
+                    self.request.set(LINE_OE, true)?;
+                    hold(on_time);
+                    self.request.set(LINE_OE, false)?;
+                    blanked = Instant::now();
+                }
+                hold(plane_time - on_time);
+            }
+        }
+
+        Ok(())
+    }
+}
+
+/// Map column `x` of a chain of stacked rows of panels, each row `row_width` pixels wide, and row `y` of a panel
+/// `panel_height` pixels high to display coordinates.
+fn chain_to_display(
+    x: u32,
+    y: u32,
+    row_width: u32,
+    panel_height: u32,
+    rows: u32,
+    row_order: Hub75RowOrder,
+) -> (u32, u32) {
+    let row = x / row_width;
+    let x = x % row_width;
+
+    // Rows are counted from the top, but the chain (and the upside-down rows of a serpentine) from the bottom.
+    if row_order == Hub75RowOrder::Serpentine && (rows - 1 - row) % 2 == 1 {
+        (row_width - 1 - x, row * panel_height + panel_height - 1 - y)
+    } else {
+        (x, row * panel_height + y)
+    }
+}
+
+/// Write the RGBA components of a pixel directly into `image`'s storage, ignoring coordinates outside of it.
+fn put_pixel(image: &mut RgbaImage, x: i32, y: i32, rgba: [u8; 4]) {
+    let (width, height) = image.dimensions();
+    let (Ok(x), Ok(y)) = (u32::try_from(x), u32::try_from(y)) else {
+        return;
+    };
+
+    if x < width && y < height {
+        let start = (y as usize * width as usize + x as usize) * 4;
+        image[start..start + 4].copy_from_slice(&rgba);
+    }
+}
+
+/// Returns the brightness `elapsed` into a linear fade from `from` to `to` lasting `duration`.
+fn fade_level(from: f64, to: f64, elapsed: Duration, duration: Duration) -> f64 {
+    if elapsed >= duration {
+        to
+    } else {
+        from + (to - from) * elapsed.as_secs_f64() / duration.as_secs_f64()
+    }
+}
+
+/// Build a lookup table mapping 8-bit intensities to gamma-corrected 8-bit intensities.
+fn gamma_table(gamma: f64) -> [u8; 256] {
+    let mut table = [0; 256];
+    for (i, entry) in table.iter_mut().enumerate() {
+        *entry = (255.0 * (i as f64 / 255.0).powf(gamma)).round() as u8;
+    }
+    table
+}
+
+/// Busy-wait for `duration`.
+///
+/// Bit plane times are far shorter than the scheduler's sleep granularity, so sleeping would distort the BCM
+/// weighting.
+fn hold(duration: Duration) {
+    let start = Instant::now();
+    while start.elapsed() < duration {
+        spin_loop();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {
+        super::*,
+        std::{hint::black_box, time::Instant},
+    };
+
+    /// Returns an 8x8 panel at 1/4 scan with a color depth of 2, wired to consecutive lines of a fake GPIO chip.
+    pub(crate) fn fake_panel() -> Hub75Panel {
+        fake_panel_with(8, 8, 4, 2)
+    }
+
+    /// Returns a `width` by `height` panel at 1/`scan_rate` scan with a color depth of `color_depth`, wired to
+    /// consecutive lines of a fake GPIO chip.
+    pub(crate) fn fake_panel_with(width: u32, height: u32, scan_rate: u32, color_depth: u8) -> Hub75Panel {
+        let names: Vec<String> = (0..13).map(|line| format!("GPIO{line}")).collect();
+        let names: Vec<&str> = names.iter().map(String::as_str).collect();
+        let pins = Hub75Pins {
+            r1: 0,
+            g1: 1,
+            b1: 2,
+            r2: 3,
+            g2: 4,
+            b2: 5,
+            a: 6,
+            b: 7,
+            c: 8,
+            d: 9,
+            e: None,
+            clk: 10,
+            lat: 11,
+            oe: 12,
+        };
+        let config = Hub75Config {
+            pins,
+            width,
+            height,
+            color_depth,
+            scan_rate,
+            chain_length: 1,
+            rows: 1,
+            row_order: Hub75RowOrder::Aligned,
+            reversed_panels: vec![],
+            active_low: Hub75ActiveLow::default(),
+            timing: Hub75Timing::default(),
+        };
+        Hub75Panel::new(&Gpio::fake("fake", &names), &config).unwrap()
+    }
+
+    #[test]
+    fn test_refresh_fake_panel() {
+        // The fake chip accepts the panel's line requests and every write of a refresh.
+        let panel = fake_panel();
+        panel.refresh().unwrap();
+        assert_eq!(panel.size(), (8, 8));
+    }
+
+    #[test]
+    fn test_fade_level() {
+        let duration = Duration::from_millis(400);
+        assert_eq!(fade_level(0.0, 1.0, Duration::ZERO, duration), 0.0);
+        assert_eq!(fade_level(0.0, 1.0, Duration::from_millis(100), duration), 0.25);
+        assert_eq!(fade_level(1.0, 0.5, Duration::from_millis(200), duration), 0.75);
+        assert_eq!(fade_level(1.0, 0.5, Duration::from_millis(500), duration), 0.5);
+        assert_eq!(fade_level(0.2, 0.8, Duration::ZERO, Duration::ZERO), 0.8);
+    }
+
+    #[test]
+    fn test_chain_to_display() {
+        // A single row maps straight through.
+        assert_eq!(chain_to_display(70, 5, 128, 32, 1, Hub75RowOrder::Serpentine), (70, 5));
+
+        // Two rows of two 64x32 panels: the end of the chain is the top row.
+        assert_eq!(chain_to_display(10, 5, 128, 32, 2, Hub75RowOrder::Aligned), (10, 5));
+        assert_eq!(chain_to_display(138, 5, 128, 32, 2, Hub75RowOrder::Aligned), (10, 37));
+
+        // In a serpentine, the bottom row is upright and the row above it is upside down.
+        assert_eq!(chain_to_display(10, 5, 128, 32, 2, Hub75RowOrder::Serpentine), (117, 26));
+        assert_eq!(chain_to_display(138, 5, 128, 32, 2, Hub75RowOrder::Serpentine), (10, 37));
+    }
+
+    #[test]
+    fn test_swap_buffers() {
+        let mut panel = fake_panel();
+        panel.draw_buffer().put_pixel(1, 2, Rgba([1, 2, 3, 4]));
+        panel.swap_buffers().unwrap();
+        assert_eq!(panel.get_pixel(1, 2), Some(Rgba([1, 2, 3, 4])));
+
+        // Swapping in an image of another size would leave the refresh reading beyond the end of the frame.
+        *panel.draw_buffer() = RgbaImage::new(4, 4);
+        assert_eq!(panel.swap_buffers().unwrap_err().kind(), ErrorKind::InvalidInput);
+        assert_eq!(panel.draw_buffer().dimensions(), (4, 4));
+        assert_eq!(panel.size(), (8, 8));
+        panel.refresh().unwrap();
+    }
+
+    #[test]
+    fn test_put_pixel_clips() {
+        let mut image = RgbaImage::new(4, 2);
+        put_pixel(&mut image, 3, 1, [1, 2, 3, 4]);
+        put_pixel(&mut image, 4, 1, [5, 5, 5, 5]);
+        put_pixel(&mut image, -1, 0, [5, 5, 5, 5]);
+        put_pixel(&mut image, 0, 2, [5, 5, 5, 5]);
+
+        assert_eq!(*image.get_pixel(3, 1), Rgba([1, 2, 3, 4]));
+        assert_eq!(image.iter().map(|&c| c as u32).sum::<u32>(), 10);
+    }
+
+    /// Compare writing a full 64x64 frame through `put_pixel` with the checked per-pixel accessor it replaced.
+    ///
+    /// Run with `cargo test --release -p hub75 -- --ignored --nocapture bench_put_pixel`.
+    #[test]
+    #[ignore]
+    fn bench_put_pixel() {
+        const FRAMES: u32 = 1000;
+        let mut image = RgbaImage::new(64, 64);
+
+        let start = Instant::now();
+        for frame in 0..FRAMES {
+            for y in 0..64 {
+                for x in 0..64 {
+                    if let Some(pixel) = image.get_pixel_mut_checked(x, y) {
+                        *pixel = Rgba([frame as u8, x as u8, y as u8, 0xff]);
+                    }
+                }
+            }
+            black_box(&image);
+        }
+        let checked = start.elapsed() / (FRAMES * 64 * 64);
+
+        let start = Instant::now();
+        for frame in 0..FRAMES {
+            for y in 0..64 {
+                for x in 0..64 {
+                    put_pixel(&mut image, x, y, [frame as u8, x as u8, y as u8, 0xff]);
+                }
+            }
+            black_box(&image);
+        }
+        let direct = start.elapsed() / (FRAMES * 64 * 64);
+
+        println!("get_pixel_mut_checked: {checked:?}/pixel, put_pixel: {direct:?}/pixel");
+    }
+}
@@ -0,0 +1,227 @@
+//! Remapping logical pixel coordinates to the panel's physical layout: rotation and pixel mappers.
+
+use {
+    crate::{Hub75Panel, Shared, frame_callback::FrameCallback},
+    image::RgbaImage,
+    std::{
+        fmt::Debug,
+        io::{Error as IoError, ErrorKind, Result as IoResult},
+        mem::swap,
+    },
+};
+
+/// Maps the logical coordinates used for drawing to the physical coordinates the panel is refreshed from.
+///
+/// Set a mapper with [`Hub75Panel::set_pixel_mapper`] for displays whose pixels are not laid out the way the chain
+/// configuration expects, e.g. flexible matrices wired in a serpentine. Drawing always uses logical coordinates;
+/// each refresh moves every pixel of the frame to the position given by the mapper. Physical coordinates outside
+/// the display are dropped.
+///
+/// Mappers compose as tuples: `(a, b)` applies `a` and then `b` to its result.
+pub trait PixelMapper: Debug + Send + Sync {
+    /// Returns the physical coordinates of logical pixel (`x`, `y`) on a display of `width` by `height` pixels.
+    fn map(&self, x: u32, y: u32, width: u32, height: u32) -> (u32, u32);
+}
+
+impl<M: PixelMapper + ?Sized> PixelMapper for Box<M> {
+    fn map(&self, x: u32, y: u32, width: u32, height: u32) -> (u32, u32) {
+        (**self).map(x, y, width, height)
+    }
+}
+
+impl<A: PixelMapper, B: PixelMapper> PixelMapper for (A, B) {
+    fn map(&self, x: u32, y: u32, width: u32, height: u32) -> (u32, u32) {
+        let (x, y) = self.0.map(x, y, width, height);
+        self.1.map(x, y, width, height)
+    }
+}
+
+/// A mapper for displays wired in a serpentine, where every other row runs in the opposite direction.
+///
+/// Rows are `row_height` pixels high (1 for matrices that snake pixel by pixel); the first row runs left to right
+/// and the second right to left, and so on.
+#[derive(Clone, Copy, Debug, Eq, Hash, PartialEq)]
+pub struct SerpentineMapper {
+    /// The height of each row of the serpentine, in pixels. A height of 0 is treated as 1.
+    pub row_height: u32,
+}
+
+impl PixelMapper for SerpentineMapper {
+    fn map(&self, x: u32, y: u32, width: u32, _height: u32) -> (u32, u32) {
+        if (y / self.row_height.max(1)) % 2 == 1 {
+            (width - 1 - x, y)
+        } else {
+            (x, y)
+        }
+    }
+}
+
+impl Hub75Panel {
+    /// Remap pixels with `mapper` when refreshing the panel, replacing any previous mapper.
+    pub fn set_pixel_mapper(&self, mapper: impl PixelMapper + 'static) {
+        *self.shared.mapper.lock().unwrap() = Some(Box::new(mapper));
+    }
+
+    /// Stop remapping pixels, so logical and physical coordinates are the same.
+    pub fn clear_pixel_mapper(&self) {
+        *self.shared.mapper.lock().unwrap() = None;
+    }
+
+    /// Rotate the display clockwise by `degrees`, which must be 0, 90, 180, or 270, for panels mounted sideways or
+    /// upside down.
+    ///
+    /// Drawing then uses the rotated coordinates: (0, 0) is the top left corner as seen with the panel mounted, and
+    /// at 90 or 270 degrees [`size`][Self::size] reports the width and height swapped. The rotation is applied before
+    /// any [pixel mapper][Self::set_pixel_mapper]. Since the frame buffer's dimensions may change, this clears both
+    /// the frame buffer and the back buffer.
+    ///
+    /// # Errors
+    /// If `degrees` is not one of the accepted values, an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidInput`][std::io::ErrorKind::InvalidInput].
+    pub fn set_rotation(&mut self, degrees: u32) -> IoResult<()> {
+        if !matches!(degrees, 0 | 90 | 180 | 270) {
+            return Err(IoError::new(ErrorKind::InvalidInput, "HUB75 rotation must be 0, 90, 180, or 270 degrees"));
+        }
+
+        let (width, height) = rotated_size(self.shared.width, self.shared.height, degrees);
+        let mut buffer = self.shared.buffer.lock().unwrap();
+        *buffer = RgbaImage::new(width, height);
+        *self.shared.rotation.lock().unwrap() = degrees;
+        *self.shared.back_buffer.lock().unwrap() = RgbaImage::new(width, height);
+        Ok(())
+    }
+
+    /// Returns the clockwise rotation of the display, in degrees.
+    pub fn rotation(&self) -> u32 {
+        *self.shared.rotation.lock().unwrap()
+    }
+}
+
+impl Shared {
+    /// Returns a copy of the frame buffer rearranged from logical to physical coordinates, applying the rotation and
+    /// then the pixel mapper, if any.
+    ///
+    /// The frame callback, if any, is run on the back buffer first, which is then swapped in as the frame buffer.
+    ///
+    /// # Errors
+    /// If the frame buffer no longer has the display's size, having been replaced with an image of another size, or
+    /// the frame callback replaced the back buffer with one, that buffer is replaced with a blank frame of the right
+    /// size and an [`IoError`][std::io::Error] is returned with a kind of
+    /// [`InvalidData`][std::io::ErrorKind::InvalidData].
+    pub(crate) fn physical_frame(&self) -> IoResult<RgbaImage> {
+        let (frame, rotation) = {
+            let mut buffer = self.buffer.lock().unwrap();
+            let rotation = *self.rotation.lock().unwrap();
+            let (width, height) = rotated_size(self.width, self.height, rotation);
+            if let Some(FrameCallback(callback)) = self.on_frame.lock().unwrap().as_mut() {
+                let mut back_buffer = self.back_buffer.lock().unwrap();
+                callback(&mut back_buffer);
+                if back_buffer.dimensions() != (width, height) {
+                    *back_buffer = RgbaImage::new(width, height);
+                    return Err(IoError::new(
+                        ErrorKind::InvalidData,
+                        "HUB75 back buffer does not match the display size",
+                    ));
+                }
+                swap(&mut *buffer, &mut *back_buffer);
+            }
+
+            if buffer.dimensions() != (width, height) {
+                *buffer = RgbaImage::new(width, height);
+                return Err(IoError::new(ErrorKind::InvalidData, "HUB75 frame buffer does not match the display size"));
+            }
+            (buffer.clone(), rotation)
+        };
+        let mapper = self.mapper.lock().unwrap();
+        if rotation == 0 && mapper.is_none() {
+            return Ok(frame);
+        }
+
+        let (width, height) = (self.width, self.height);
+        let mut physical = RgbaImage::new(width, height);
+        for y in 0..frame.height() {
+            for x in 0..frame.width() {
+                let (mut px, mut py) = rotate(x, y, width, height, rotation);
+                if let Some(mapper) = mapper.as_ref() {
+                    (px, py) = mapper.map(px, py, width, height);
+                }
+                if let Some(pixel) = physical.get_pixel_mut_checked(px, py) {
+                    *pixel = *frame.get_pixel(x, y);
+                }
+            }
+        }
+        Ok(physical)
+    }
+}
+
+/// Returns the logical size of a `width` by `height` display rotated by `degrees`.
+fn rotated_size(width: u32, height: u32, degrees: u32) -> (u32, u32) {
+    if degrees % 180 == 90 {
+        (height, width)
+    } else {
+        (width, height)
+    }
+}
+
+/// Returns the physical coordinates on a `width` by `height` display of logical pixel (`x`, `y`) when the display is
+/// rotated clockwise by `degrees`.
+fn rotate(x: u32, y: u32, width: u32, height: u32, degrees: u32) -> (u32, u32) {
+    match degrees {
+        90 => (width - 1 - y, x),
+        180 => (width - 1 - x, height - 1 - y),
+        270 => (y, height - 1 - x),
+        _ => (x, y),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[derive(Debug)]
+    struct FlipVertical;
+
+    impl PixelMapper for FlipVertical {
+        fn map(&self, x: u32, y: u32, _width: u32, height: u32) -> (u32, u32) {
+            (x, height - 1 - y)
+        }
+    }
+
+    #[test]
+    fn test_serpentine_mapper() {
+        let mapper = SerpentineMapper {
+            row_height: 1,
+        };
+        assert_eq!(mapper.map(0, 0, 16, 4), (0, 0));
+        assert_eq!(mapper.map(0, 1, 16, 4), (15, 1));
+        assert_eq!(mapper.map(3, 2, 16, 4), (3, 2));
+
+        let mapper = SerpentineMapper {
+            row_height: 2,
+        };
+        assert_eq!(mapper.map(0, 1, 16, 4), (0, 1));
+        assert_eq!(mapper.map(0, 2, 16, 4), (15, 2));
+    }
+
+    #[test]
+    fn test_rotate() {
+        // A 4x2 display rotated 90 degrees is 2 pixels wide and 4 high; its top left is the display's top right.
+        assert_eq!(rotated_size(4, 2, 90), (2, 4));
+        assert_eq!(rotate(0, 0, 4, 2, 90), (3, 0));
+        assert_eq!(rotate(1, 3, 4, 2, 90), (0, 1));
+        assert_eq!(rotate(0, 0, 4, 2, 180), (3, 1));
+        assert_eq!(rotated_size(4, 2, 270), (2, 4));
+        assert_eq!(rotate(0, 0, 4, 2, 270), (0, 1));
+        assert_eq!(rotate(1, 3, 4, 2, 270), (3, 0));
+    }
+
+    #[test]
+    fn test_composed_mappers() {
+        let serpentine = SerpentineMapper {
+            row_height: 1,
+        };
+        let mapper: Box<dyn PixelMapper> = Box::new((serpentine, FlipVertical));
+        assert_eq!(mapper.map(0, 0, 16, 4), (0, 3));
+        assert_eq!(mapper.map(0, 1, 16, 4), (15, 2));
+    }
+}
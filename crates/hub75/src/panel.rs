@@ -0,0 +1,122 @@
+//! The drawing interface shared by [`Hub75Panel`] and [`VirtualPanel`][crate::VirtualPanel].
+
+use {
+    crate::{
+        Hub75Panel,
+        draw::{draw_circle, draw_image, draw_line, draw_rect, draw_sprite},
+        put_pixel,
+        text::draw_text,
+    },
+    image::{GenericImageView, Rgba, RgbaImage},
+};
+
+/// A display that can be drawn to, so drawing code can target either the hardware panel or a virtual one.
+///
+/// Implementations only provide access to their frame buffer; the drawing methods are provided by the trait and
+/// behave the same on every implementation, clipping anything outside of the display. [`Hub75Panel`] also has these
+/// as inherent methods, so they can be called on it without importing this trait.
+///
+/// The frame buffer accessors take closures, so the trait is meant for generic code (`fn draw<P: Panel>(panel: &mut
+/// P)`) rather than trait objects.
+pub trait Panel {
+    /// Call `f` with the frame buffer, returning its result.
+    fn with_frame<R>(&self, f: impl FnOnce(&RgbaImage) -> R) -> R;
+
+    /// Call `f` with the frame buffer for drawing, returning its result.
+    fn with_frame_mut<R>(&mut self, f: impl FnOnce(&mut RgbaImage) -> R) -> R;
+
+    /// Returns the width and height of the display, in pixels.
+    fn size(&self) -> (u32, u32) {
+        self.with_frame(|frame| frame.dimensions())
+    }
+
+    /// Set a pixel in the frame buffer.
+    ///
+    /// Coordinates outside of the display are silently ignored, so drawing code does not need to clip.
+    fn set_pixel(&mut self, x: i32, y: i32, color: Rgba<u8>) {
+        self.with_frame_mut(|frame| put_pixel(frame, x, y, color.0));
+    }
+
+    /// Set a pixel in the frame buffer to an opaque color given by its components.
+    fn set_pixel_rgb(&mut self, x: i32, y: i32, r: u8, g: u8, b: u8) {
+        self.with_frame_mut(|frame| put_pixel(frame, x, y, [r, g, b, 0xff]));
+    }
+
+    /// Returns the color of a pixel in the frame buffer, or `None` if the coordinates are outside of the display.
+    fn get_pixel(&self, x: i32, y: i32) -> Option<Rgba<u8>> {
+        let (Ok(x), Ok(y)) = (u32::try_from(x), u32::try_from(y)) else {
+            return None;
+        };
+
+        self.with_frame(|frame| frame.get_pixel_checked(x, y).copied())
+    }
+
+    /// Returns a copy of the frame buffer, i.e. what the display is showing.
+    fn snapshot(&self) -> RgbaImage {
+        self.with_frame(|frame| frame.clone())
+    }
+
+    /// Set every pixel in the frame buffer to transparent black, turning the whole display off.
+    fn clear(&mut self) {
+        self.with_frame_mut(|frame| frame.fill(0));
+    }
+
+    /// Set every pixel in the frame buffer to `color`.
+    fn fill(&mut self, color: Rgba<u8>) {
+        self.with_frame_mut(|frame| {
+            for pixel in frame.chunks_exact_mut(4) {
+                pixel.copy_from_slice(&color.0);
+            }
+        });
+    }
+
+    /// Draw a line from (`x0`, `y0`) to (`x1`, `y1`), including both end points, using Bresenham's algorithm.
+    fn draw_line(&mut self, x0: i32, y0: i32, x1: i32, y1: i32, color: Rgba<u8>) {
+        self.with_frame_mut(|frame| draw_line(frame, x0, y0, x1, y1, color));
+    }
+
+    /// Draw a rectangle `width` by `height` pixels with its top-left corner at (`x`, `y`), either filled or as a
+    /// one-pixel outline.
+    fn draw_rect(&mut self, x: i32, y: i32, width: i32, height: i32, color: Rgba<u8>, fill: bool) {
+        self.with_frame_mut(|frame| draw_rect(frame, x, y, width, height, color, fill));
+    }
+
+    /// Draw a circle of radius `radius` centered on (`cx`, `cy`), either filled or as a one-pixel outline.
+    fn draw_circle(&mut self, cx: i32, cy: i32, radius: i32, color: Rgba<u8>, fill: bool) {
+        self.with_frame_mut(|frame| draw_circle(frame, cx, cy, radius, color, fill));
+    }
+
+    /// Copy an image into the frame buffer with its top-left corner at (`x`, `y`), replacing the pixels underneath.
+    fn draw_image<I>(&mut self, x: i32, y: i32, image: &I)
+    where
+        I: GenericImageView<Pixel = Rgba<u8>>,
+    {
+        self.with_frame_mut(|frame| draw_image(frame, x, y, image));
+    }
+
+    /// Composite a sprite over the frame buffer with its top-left corner at (`x`, `y`), respecting its alpha channel
+    /// as for [`Hub75Panel::draw_sprite`].
+    fn draw_sprite<I>(&mut self, x: i32, y: i32, sprite: &I)
+    where
+        I: GenericImageView<Pixel = Rgba<u8>>,
+    {
+        self.with_frame_mut(|frame| draw_sprite(frame, x, y, sprite));
+    }
+
+    /// Draw a string with the 7x13 fixed-width font, with the left edge of the text at `x` and its baseline at `y`.
+    ///
+    /// Returns the advance width of the text in pixels, so multiple strings can be laid out one after another.
+    fn draw_text(&mut self, x: i32, y: i32, s: &str, color: Rgba<u8>) -> i32 {
+        self.with_frame_mut(|frame| draw_text(frame, x, y, s, color))
+    }
+}
+
+impl Panel for Hub75Panel {
+    fn with_frame<R>(&self, f: impl FnOnce(&RgbaImage) -> R) -> R {
+        f(&self.shared.buffer.lock().unwrap())
+    }
+
+    fn with_frame_mut<R>(&mut self, f: impl FnOnce(&mut RgbaImage) -> R) -> R {
+        f(&mut self.shared.buffer.lock().unwrap())
+    }
+}
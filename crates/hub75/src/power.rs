@@ -0,0 +1,120 @@
+//! Bounding the panel's current draw by capping the brightness of frames with many LEDs lit.
+
+use crate::{Hub75Panel, color::ChannelTables};
+
+impl Hub75Panel {
+    /// Limit the average fraction of LEDs lit to `max_lit_fraction`, from 0.0 to 1.0 (the default, meaning no
+    /// limit).
+    ///
+    /// A panel's current draw is roughly proportional to the number of LEDs lit at once, averaged over the frame.
+    /// Each refresh estimates the fraction of LEDs the frame would light at full brightness (see
+    /// [`lit_fraction`][Self::lit_fraction]); if the estimate times the brightness exceeds the limit, that frame is
+    /// displayed at the highest brightness within it instead. The brightness set with
+    /// [`set_brightness`][Self::set_brightness] is unchanged, so it applies again once the content is dim enough.
+    ///
+    /// Values outside of the range are clamped, and NaN is treated as no limit.
+    pub fn set_power_limit(&self, max_lit_fraction: f64) {
+        *self.shared.power_limit.lock().unwrap() = if max_lit_fraction.is_nan() {
+            1.0
+        } else {
+            max_lit_fraction.clamp(0.0, 1.0)
+        };
+    }
+
+    /// Returns the limit set by [`set_power_limit`][Self::set_power_limit].
+    pub fn power_limit(&self) -> f64 {
+        *self.shared.power_limit.lock().unwrap()
+    }
+
+    /// Returns the estimated fraction of LEDs lit by the frame last displayed, at full brightness.
+    ///
+    /// This is each LED's duty cycle after color correction, gamma correction, and quantization to the color depth,
+    /// averaged over every LED of the display, so a frame of solid white is 1.0 and solid red is 1/3 (without color
+    /// correction). It is updated by each refresh that displays a changed frame, or the same frame with other color
+    /// settings, so it follows [`swap_buffers`][Self::swap_buffers] as well as drawing to the front buffer. Returns
+    /// 0.0 before the first refresh.
+    pub fn lit_fraction(&self) -> f64 {
+        *self.shared.lit_fraction.lock().unwrap()
+    }
+}
+
+/// Returns the average duty cycle of the LEDs displaying the RGBA pixels in `frame` at full brightness, with each
+/// channel mapped through its table.
+pub(crate) fn frame_lit_fraction(frame: &[u8], tables: &ChannelTables, color_depth: u8) -> f64 {
+    let mask = !((1u16 << (8 - color_depth)) - 1) as u8;
+    let mut lit = 0u64;
+    let mut leds = 0u64;
+    for pixel in frame.chunks_exact(4) {
+        for (table, value) in tables.iter().zip(&pixel[..3]) {
+            lit += (table[*value as usize] & mask) as u64;
+        }
+        leds += 3;
+    }
+
+    if leds == 0 {
+        0.0
+    } else {
+        lit as f64 / (leds * 255) as f64
+    }
+}
+
+/// Returns `brightness` reduced, if necessary, so a frame lighting `lit_fraction` of the LEDs at full brightness
+/// lights no more than `limit` of them.
+pub(crate) fn capped_brightness(brightness: f64, lit_fraction: f64, limit: f64) -> f64 {
+    if lit_fraction * brightness > limit {
+        limit / lit_fraction
+    } else {
+        brightness
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use {super::*, crate::tests::fake_panel, image::Rgba};
+
+    #[test]
+    fn test_frame_lit_fraction() {
+        let mut table = [0; 256];
+        for (i, entry) in table.iter_mut().enumerate() {
+            *entry = i as u8;
+        }
+        let tables = [table; 3];
+
+        let white = [0xff, 0xff, 0xff, 0xff];
+        let red = [0xff, 0, 0, 0xff];
+        assert_eq!(frame_lit_fraction(&[white, white].concat(), &tables, 8), 1.0);
+        assert_eq!(frame_lit_fraction(&[red, [0; 4]].concat(), &tables, 8), 1.0 / 6.0);
+
+        // 0x7f shows as 0x70 at 4 bits.
+        assert_eq!(frame_lit_fraction(&[0x7f, 0x7f, 0x7f, 0], &tables, 4), 0x70 as f64 / 255.0);
+        assert_eq!(frame_lit_fraction(&[], &tables, 8), 0.0);
+    }
+
+    #[test]
+    fn test_capped_brightness() {
+        assert_eq!(capped_brightness(1.0, 0.25, 0.5), 1.0);
+        assert_eq!(capped_brightness(1.0, 1.0, 0.5), 0.5);
+        assert_eq!(capped_brightness(0.8, 0.5, 0.2), 0.4);
+        assert_eq!(capped_brightness(0.3, 0.5, 0.2), 0.3);
+        assert_eq!(capped_brightness(1.0, 0.0, 0.0), 1.0);
+    }
+
+    #[test]
+    fn test_lit_fraction() {
+        let mut panel = fake_panel();
+        assert_eq!(panel.lit_fraction(), 0.0);
+        panel.fill(Rgba([0xff, 0xff, 0xff, 0xff]));
+        panel.refresh().unwrap();
+
+        // White shows as 0xc0 at the fake panel's 2 bits.
+        let white = 0xc0 as f64 / 255.0;
+        assert_eq!(panel.lit_fraction(), white);
+
+        // Refreshing an unchanged frame keeps the estimate; changing the frame updates it.
+        panel.refresh().unwrap();
+        assert_eq!(panel.lit_fraction(), white);
+        panel.clear();
+        panel.refresh().unwrap();
+        assert_eq!(panel.lit_fraction(), 0.0);
+    }
+}
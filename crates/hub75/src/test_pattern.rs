@@ -0,0 +1,105 @@
+//! Built-in patterns for checking a newly assembled panel.
+
+use crate::{Hub75Panel, put_pixel};
+
+/// A pattern drawn by [`Hub75Panel::test_pattern`].
+///
+/// The solid patterns light a single color channel across the whole panel. The top and bottom halves of the panel
+/// are driven by separate color lines (R1/G1/B1 and R2/G2/B2), so a half showing the wrong color points at the
+/// swapped or miswired line: for example, if [`Red`][Self::Red] shows green on the bottom half only, R2 and G2 are
+/// swapped.
+#[derive(Clone, Copy, Debug, Eq, Hash, PartialEq)]
+pub enum TestPattern {
+    /// The whole panel at full red.
+    Red,
+
+    /// The whole panel at full green.
+    Green,
+
+    /// The whole panel at full blue.
+    Blue,
+
+    /// Vertical bars of red, green, blue, and white, from left to right.
+    Bars,
+
+    /// Alternating white and black squares with sides of `size` pixels. A size of 1 lights every other pixel, which
+    /// shows up stuck or shorted address lines as rows that are lit solid or doubled.
+    Checkerboard {
+        /// The side of each square, in pixels. A size of 0 is treated as 1.
+        size: u32,
+    },
+
+    /// Horizontal bands of red, green, and blue, each ramping from black at the left edge to full intensity at the
+    /// right. Steps or missing shades in a ramp point at a problem with the color depth or gamma settings.
+    Gradient,
+}
+
+impl Hub75Panel {
+    /// Draw `pattern` over the entire frame buffer, so the next refresh shows it.
+    pub fn test_pattern(&mut self, pattern: TestPattern) {
+        let (width, height) = self.size();
+        let mut buffer = self.shared.buffer.lock().unwrap();
+        for y in 0..height {
+            for x in 0..width {
+                put_pixel(&mut buffer, x as i32, y as i32, pattern_color(pattern, x, y, width, height));
+            }
+        }
+    }
+}
+
+/// Returns the color of `pattern` at (`x`, `y`) on a display of `width` by `height` pixels.
+fn pattern_color(pattern: TestPattern, x: u32, y: u32, width: u32, height: u32) -> [u8; 4] {
+    const RED: [u8; 4] = [0xff, 0, 0, 0xff];
+    const GREEN: [u8; 4] = [0, 0xff, 0, 0xff];
+    const BLUE: [u8; 4] = [0, 0, 0xff, 0xff];
+    const WHITE: [u8; 4] = [0xff, 0xff, 0xff, 0xff];
+    const BLACK: [u8; 4] = [0, 0, 0, 0xff];
+
+    match pattern {
+        TestPattern::Red => RED,
+        TestPattern::Green => GREEN,
+        TestPattern::Blue => BLUE,
+        TestPattern::Bars => [RED, GREEN, BLUE, WHITE][(x * 4 / width) as usize],
+        TestPattern::Checkerboard {
+            size,
+        } => {
+            let size = size.max(1);
+            if (x / size + y / size) % 2 == 0 {
+                WHITE
+            } else {
+                BLACK
+            }
+        }
+        TestPattern::Gradient => {
+            let level = if width > 1 {
+                (x * 0xff / (width - 1)) as u8
+            } else {
+                0xff
+            };
+            let mut color = BLACK;
+            color[((y * 3 / height) as usize).min(2)] = level;
+            color
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_pattern_colors() {
+        assert_eq!(pattern_color(TestPattern::Bars, 0, 0, 64, 32), [0xff, 0, 0, 0xff]);
+        assert_eq!(pattern_color(TestPattern::Bars, 63, 31, 64, 32), [0xff, 0xff, 0xff, 0xff]);
+
+        let checkerboard = TestPattern::Checkerboard {
+            size: 2,
+        };
+        assert_eq!(pattern_color(checkerboard, 1, 1, 64, 32), [0xff, 0xff, 0xff, 0xff]);
+        assert_eq!(pattern_color(checkerboard, 2, 1, 64, 32), [0, 0, 0, 0xff]);
+
+        assert_eq!(pattern_color(TestPattern::Gradient, 0, 0, 64, 32), [0, 0, 0, 0xff]);
+        assert_eq!(pattern_color(TestPattern::Gradient, 63, 16, 64, 32), [0, 0xff, 0, 0xff]);
+        assert_eq!(pattern_color(TestPattern::Gradient, 63, 31, 64, 32), [0, 0, 0xff, 0xff]);
+    }
+}
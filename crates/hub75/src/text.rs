@@ -0,0 +1,79 @@
+//! Text rendering into the panel's frame buffer.
+
+use {
+    crate::{Hub75Panel, draw::ImageTarget},
+    embedded_graphics::{
+        Drawable,
+        geometry::Point,
+        mono_font::{MonoTextStyle, ascii::FONT_7X13},
+        pixelcolor::Rgb888,
+        text::{Baseline, Text},
+    },
+    gpio_linux_char::CancelToken,
+    image::{Rgba, RgbaImage},
+    std::time::Duration,
+};
+
+impl Hub75Panel {
+    /// Draw a string with the 7x13 fixed-width font, with the left edge of the text at `x` and its baseline at `y`.
+    ///
+    /// Returns the advance width of the text in pixels, so multiple strings can be laid out one after another.
+    /// Text running off the edges of the panel is clipped.
+    pub fn draw_text(&mut self, x: i32, y: i32, s: &str, color: Rgba<u8>) -> i32 {
+        draw_text(&mut self.shared.buffer.lock().unwrap(), x, y, s, color)
+    }
+
+    /// Scroll a string from right to left across the panel, moving one column every `speed`, until `cancel` is
+    /// cancelled.
+    ///
+    /// The text is vertically centered and scrolls across the full width of chained panels. Each pass starts with
+    /// the text just off the right edge and ends once it has left the left edge, then the next pass begins. The
+    /// whole panel is redrawn on every step.
+    ///
+    /// This only draws into the frame buffer, so the refresh thread should be running (see
+    /// [`start`][Hub75Panel::start]) for the text to be displayed.
+    pub fn scroll_text(&mut self, cancel: &CancelToken, s: &str, color: Rgba<u8>, speed: Duration) {
+        let (width, height) = self.size();
+        let text_width = text_width(s);
+
+        // Render the text once, with a blank panel's width of padding on both sides so every step is a plain copy.
+        let mut strip = RgbaImage::new(width + text_width + width, height);
+        let origin = Point::new(width as i32, height as i32 / 2);
+        let Ok(_) =
+            Text::with_baseline(s, origin, text_style(color), Baseline::Middle).draw(&mut ImageTarget(&mut strip));
+
+        loop {
+            for offset in 0..=(width + text_width) as i32 {
+                self.draw_image(-offset, 0, &strip);
+                if cancel.wait_timeout(speed) {
+                    return;
+                }
+            }
+        }
+    }
+}
+
+/// Draw a string into `image`, as for [`Hub75Panel::draw_text`].
+pub(crate) fn draw_text(image: &mut RgbaImage, x: i32, y: i32, s: &str, color: Rgba<u8>) -> i32 {
+    let Ok(next) =
+        Text::with_baseline(s, Point::new(x, y), text_style(color), Baseline::Alphabetic).draw(&mut ImageTarget(image));
+    next.x - x
+}
+
+/// Draw a string into `image`, centered both horizontally and vertically.
+pub(crate) fn draw_centered_text(image: &mut RgbaImage, s: &str, color: Rgba<u8>) {
+    let (width, height) = image.dimensions();
+    let origin = Point::new((width as i32 - text_width(s) as i32) / 2, height as i32 / 2);
+    let Ok(_) = Text::with_baseline(s, origin, text_style(color), Baseline::Middle).draw(&mut ImageTarget(image));
+}
+
+/// Returns the advance width of a string in the 7x13 font, in pixels.
+fn text_width(s: &str) -> u32 {
+    s.chars().count() as u32 * (FONT_7X13.character_size.width + FONT_7X13.character_spacing)
+}
+
+/// Returns the text style used for a given color.
+fn text_style(color: Rgba<u8>) -> MonoTextStyle<'static, Rgb888> {
+    let Rgba([r, g, b, _]) = color;
+    MonoTextStyle::new(&FONT_7X13, Rgb888::new(r, g, b))
+}
@@ -0,0 +1,85 @@
+//! Tuning the timing of the signals driving the panel.
+
+use {
+    crate::{Hub75Panel, LINE_LAT, Shared, hold},
+    std::{io::Result as IoResult, time::Duration},
+};
+
+/// Extra delays inserted while driving the panel's control lines, for panels whose drivers need longer setup or hold
+/// times than the GPIO lines provide on their own.
+///
+/// Each line write through the GPIO character device takes on the order of a microsecond on a Raspberry Pi, which is
+/// already longer than common HUB75 drivers require, so the defaults add no delay. Panels that show garbled or
+/// shifted pixels, especially at high refresh rates, may need longer clock times; panels that show ghosting (faint
+/// copies of lit rows on neighbouring rows) may need a longer latch or a longer delay between blanking the display and
+/// changing the row address. Delays that are too short for the panel cause these artifacts, while longer ones lower
+/// the refresh rate, so increase them one at a time until the artifacts disappear.
+///
+/// Delays are busy-waits, so they are accurate to well under a microsecond but keep the refreshing CPU core busy.
+#[derive(Clone, Copy, Debug, Default, Eq, Hash, PartialEq)]
+pub struct Hub75Timing {
+    /// How long to wait after making the clock active, before the next clock begins.
+    pub clock_high: Duration,
+
+    /// How long to wait after setting the color lines with the clock inactive, before making the clock active. This
+    /// is the setup time of the data shifted in.
+    pub clock_low: Duration,
+
+    /// How long to hold the latch active.
+    pub latch_width: Duration,
+
+    /// The minimum time between disabling output (OE) at the end of a bit plane and changing the row address for the
+    /// next. If the row drivers have not turned off by the time the address changes, the previous bit plane briefly
+    /// lights the new row, which shows as ghosting.
+    pub blank_before_address: Duration,
+}
+
+impl Hub75Panel {
+    /// Set the delays used while driving the panel, replacing those given in [`Hub75Config`][crate::Hub75Config].
+    ///
+    /// This takes effect on the next refresh, so timing can be tuned while watching the display.
+    pub fn set_timing(&self, timing: Hub75Timing) {
+        *self.shared.timing.lock().unwrap() = timing;
+    }
+
+    /// Returns the delays used while driving the panel.
+    pub fn timing(&self) -> Hub75Timing {
+        *self.shared.timing.lock().unwrap()
+    }
+}
+
+impl Shared {
+    /// Perform the `(mask, bits)` line writes shifting out a bit plane, inserting the clock delays of `timing`.
+    ///
+    /// The writes alternate between setting the color lines with the clock inactive and making the clock active. If
+    /// there are no clock delays, the writes are issued as a single sequence.
+    pub(crate) fn shift_out(&self, writes: &[(u64, u64)], timing: &Hub75Timing) -> IoResult<()> {
+        if timing.clock_low.is_zero() && timing.clock_high.is_zero() {
+            return self.request.set_values_sequence(writes);
+        }
+
+        for clock in writes.chunks(2) {
+            for (&(mask, bits), delay) in clock.iter().zip([timing.clock_low, timing.clock_high]) {
+                self.request.set_values(mask, bits)?;
+                hold(delay);
+            }
+        }
+        Ok(())
+    }
+
+    /// Set the row address lines selected by `address_mask` to `address_bits` and pulse the latch, holding it for
+    /// the latch width of `timing`.
+    pub(crate) fn latch(&self, address_mask: u64, address_bits: u64, timing: &Hub75Timing) -> IoResult<()> {
+        if timing.latch_width.is_zero() {
+            return self.request.set_values_sequence(&[
+                (address_mask, address_bits),
+                (1 << LINE_LAT, 1 << LINE_LAT),
+                (1 << LINE_LAT, 0),
+            ]);
+        }
+
+        self.request.set_values_sequence(&[(address_mask, address_bits), (1 << LINE_LAT, 1 << LINE_LAT)])?;
+        hold(timing.latch_width);
+        self.request.set_values(1 << LINE_LAT, 0)
+    }
+}
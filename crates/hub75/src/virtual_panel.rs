@@ -0,0 +1,155 @@
+//! An in-memory panel for developing and testing drawing code without hardware.
+
+use {
+    crate::{Panel, draw::ImageTarget, http, image_file::write_png},
+    embedded_graphics::{
+        Pixel,
+        draw_target::DrawTarget,
+        geometry::{OriginDimensions, Size},
+        pixelcolor::{Rgb888, RgbColor},
+    },
+    gpio_linux_char::CancelToken,
+    image::{Rgba, RgbaImage},
+    std::{
+        convert::Infallible,
+        fs::File,
+        io::{BufWriter, Result as IoResult},
+        net::{SocketAddr, ToSocketAddrs},
+        path::Path,
+        sync::{Arc, Mutex},
+    },
+};
+
+/// A display that only exists in memory, drawn to through the same [`Panel`] interface as
+/// [`Hub75Panel`][crate::Hub75Panel].
+///
+/// What would be shown can be saved with [`save_png`][Self::save_png] or watched live in a browser with
+/// [`serve_http`][Self::serve_http]. Clones share the same frame buffer, so one clone can be drawn to while another
+/// is used elsewhere.
+#[derive(Clone, Debug)]
+pub struct VirtualPanel {
+    buffer: Arc<Mutex<RgbaImage>>,
+}
+
+impl VirtualPanel {
+    /// Create a virtual panel `width` by `height` pixels, initially blank.
+    pub fn new(width: u32, height: u32) -> Self {
+        Self {
+            buffer: Arc::new(Mutex::new(RgbaImage::new(width, height))),
+        }
+    }
+
+    /// Returns the width and height of the display, in pixels.
+    pub fn size(&self) -> (u32, u32) {
+        self.buffer.lock().unwrap().dimensions()
+    }
+
+    /// Save the frame buffer to `path` as a PNG image.
+    ///
+    /// The image is saved as a panel would show it: the alpha channel is dropped, so transparent pixels are black.
+    ///
+    /// # Errors
+    /// Returns an [`IoError`][std::io::Error] if the file cannot be created or written.
+    pub fn save_png<P: AsRef<Path>>(&self, path: P) -> IoResult<()> {
+        let frame = self.snapshot();
+        write_png(&frame, BufWriter::new(File::create(path)?))
+    }
+
+    /// Serve the display over HTTP on `addr` from a background thread until `cancel` is cancelled, returning the
+    /// address listened on.
+    ///
+    /// `/` is a page showing the display, `/frame.png` is a snapshot of it, and `/stream.mjpeg` is an MJPEG stream
+    /// of it that browsers play as a live image. Binding to port 0 listens on any free port. Snapshots are rate
+    /// limited as for [`Hub75Panel::serve_http`][crate::Hub75Panel::serve_http].
+    ///
+    /// # Errors
+    /// Returns an [`IoError`][std::io::Error] if `addr` cannot be bound.
+    pub fn serve_http<A: ToSocketAddrs>(&self, cancel: &CancelToken, addr: A) -> IoResult<SocketAddr> {
+        let panel = self.clone();
+        http::serve(cancel, addr, move || panel.snapshot())
+    }
+}
+
+impl Panel for VirtualPanel {
+    fn with_frame<R>(&self, f: impl FnOnce(&RgbaImage) -> R) -> R {
+        f(&self.buffer.lock().unwrap())
+    }
+
+    fn with_frame_mut<R>(&mut self, f: impl FnOnce(&mut RgbaImage) -> R) -> R {
+        f(&mut self.buffer.lock().unwrap())
+    }
+}
+
+/// The virtual panel is an [`embedded-graphics`][embedded_graphics] draw target, just like
+/// [`Hub75Panel`][crate::Hub75Panel].
+impl DrawTarget for VirtualPanel {
+    type Color = Rgb888;
+    type Error = Infallible;
+
+    fn draw_iter<I>(&mut self, pixels: I) -> Result<(), Self::Error>
+    where
+        I: IntoIterator<Item = Pixel<Self::Color>>,
+    {
+        ImageTarget(&mut self.buffer.lock().unwrap()).draw_iter(pixels)
+    }
+
+    fn clear(&mut self, color: Self::Color) -> Result<(), Self::Error> {
+        self.fill(Rgba([color.r(), color.g(), color.b(), 0xff]));
+        Ok(())
+    }
+}
+
+impl OriginDimensions for VirtualPanel {
+    fn size(&self) -> Size {
+        let (width, height) = self.size();
+        Size::new(width, height)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Drawing code written against the trait, as an application would.
+    fn draw_badge<P: Panel>(panel: &mut P) {
+        panel.clear();
+        panel.draw_rect(0, 0, 4, 4, Rgba([0xff, 0, 0, 0xff]), false);
+        panel.set_pixel(1, 1, Rgba([0, 0xff, 0, 0xff]));
+        panel.draw_line(2, 2, 5, 2, Rgba([0, 0, 0xff, 0xff]));
+    }
+
+    #[test]
+    fn test_draw_through_panel() {
+        let mut panel = VirtualPanel::new(5, 4);
+        draw_badge(&mut panel);
+
+        assert_eq!(panel.size(), (5, 4));
+        assert_eq!(panel.get_pixel(0, 3), Some(Rgba([0xff, 0, 0, 0xff])));
+        assert_eq!(panel.get_pixel(1, 1), Some(Rgba([0, 0xff, 0, 0xff])));
+        assert_eq!(panel.get_pixel(2, 1), Some(Rgba([0, 0, 0, 0])));
+        assert_eq!(panel.get_pixel(3, 2), Some(Rgba([0, 0, 0xff, 0xff])));
+        assert_eq!(panel.get_pixel(4, 2), Some(Rgba([0, 0, 0xff, 0xff])));
+        assert_eq!(panel.get_pixel(5, 2), None);
+
+        // Clones share the frame buffer.
+        let mut other = panel.clone();
+        other.fill(Rgba([1, 2, 3, 0xff]));
+        assert_eq!(panel.get_pixel(0, 0), Some(Rgba([1, 2, 3, 0xff])));
+    }
+
+    #[test]
+    fn test_draw_text() {
+        let mut panel = VirtualPanel::new(16, 16);
+        assert_eq!(panel.draw_text(0, 12, "A", Rgba([0xff; 4])), 7);
+        assert!(panel.snapshot().chunks_exact(4).any(|pixel| pixel == [0xff; 4]));
+    }
+
+    #[test]
+    fn test_save_png() {
+        let path = std::env::temp_dir().join(format!("hub75-virtual-panel-{}.png", std::process::id()));
+        VirtualPanel::new(4, 4).save_png(&path).unwrap();
+        let saved = std::fs::read(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+        assert!(saved.starts_with(b"\x89PNG\r\n\x1a\n"));
+    }
+}